@@ -19,6 +19,7 @@ const (
 	apiRouters     = "v2.0/routers"
 	apiFloatingIPs = "v2.0/floatingips"
 	apiPorts       = "v2.0/ports"
+	apiQuotas      = "v2.0/quotas"
 )
 
 // Client provides a means to access the OpenStack Neutron Service.
@@ -92,6 +93,16 @@ type Port struct {
 	DeviceId     string    `json:"device_id"`
 }
 
+// Quota holds the number of each resource the tenant may have, -1 for no limit
+type Quota struct {
+	FloatingIP    int `json:"floatingip"`
+	Network       int `json:"network"`
+	Subnet        int `json:"subnet"`
+	Port          int `json:"port"`
+	Router        int `json:"router"`
+	SecurityGroup int `json:"security_group"`
+}
+
 type ExternalGatewayInfo struct {
 	NetworkId string `json:"network_id"`
 }
@@ -369,6 +380,19 @@ func (c *Client) ListFloatingIPs(params *url.Values) ([]FloatingIP, error) {
 	return resp.FloatingIPs, nil
 }
 
+// GetQuota returns the quota of the tenant.
+func (c *Client) GetQuota(tenantId string) (*Quota, error) {
+	var resp struct {
+		Quota Quota `json:"quota"`
+	}
+	requestData := goosehttp.RequestData{RespValue: &resp}
+	err := c.client.SendRequest(client.GET, "network", apiQuotas+"/"+tenantId, &requestData)
+	if err != nil {
+		return nil, errors.Newf(err, "failed to get the quota of tenant %s", tenantId)
+	}
+	return &resp.Quota, nil
+}
+
 // Port API
 func (c *Client) CreatePort(network *Port) (*Port, error) {
 	type typenetwork struct {
@@ -23,6 +23,7 @@ const (
 	apiSecurityGroups     = "os-security-groups"
 	apiSecurityGroupRules = "os-security-group-rules"
 	apiFloatingIPs        = "os-floating-ips"
+	apiLimits             = "limits"
 )
 
 // Server status values.
@@ -223,6 +224,9 @@ type ServerDetail struct {
 	Links  []Link
 	Name   string
 
+	// Metadata holds the key/value pairs the server was run with.
+	Metadata map[string]string
+
 	// HP Cloud returns security groups in server details.
 	Groups []Entity `json:"security_groups"`
 
@@ -705,3 +709,36 @@ func (c *Client) RemoveServerFloatingIP(serverId, address string) error {
 	}
 	return err
 }
+
+// AbsoluteLimits holds the quota of the tenant and how much of it is used.
+// A negative maximum means there is no limit.
+type AbsoluteLimits struct {
+	MaxTotalInstances       int `json:"maxTotalInstances"`
+	TotalInstancesUsed      int `json:"totalInstancesUsed"`
+	MaxTotalCores           int `json:"maxTotalCores"`
+	TotalCoresUsed          int `json:"totalCoresUsed"`
+	MaxTotalRAMSize         int `json:"maxTotalRAMSize"` // in MB
+	TotalRAMUsed            int `json:"totalRAMUsed"`
+	MaxTotalFloatingIps     int `json:"maxTotalFloatingIps"`
+	TotalFloatingIpsUsed    int `json:"totalFloatingIpsUsed"`
+	MaxSecurityGroups       int `json:"maxSecurityGroups"`
+	TotalSecurityGroupsUsed int `json:"totalSecurityGroupsUsed"`
+}
+
+// Limits describes the limits applying to the tenant.
+type Limits struct {
+	Absolute AbsoluteLimits `json:"absolute"`
+}
+
+// GetLimits returns the absolute limits of the tenant along with its usage.
+func (c *Client) GetLimits() (*Limits, error) {
+	var resp struct {
+		Limits Limits `json:"limits"`
+	}
+	requestData := goosehttp.RequestData{RespValue: &resp}
+	err := c.client.SendRequest(client.GET, "compute", apiLimits, &requestData)
+	if err != nil {
+		return nil, errors.Newf(err, "failed to get limits")
+	}
+	return &resp.Limits, nil
+}
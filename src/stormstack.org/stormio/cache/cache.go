@@ -11,8 +11,10 @@ import (
 var (
 	ap = struct {
 		svcProvCache map[string]*provision.ServiceProvision
+		providers    map[string]*persistence.AssetProvider
 		sync.RWMutex
-	}{svcProvCache: make(map[string]*provision.ServiceProvision)}
+	}{svcProvCache: make(map[string]*provision.ServiceProvision),
+		providers: make(map[string]*persistence.AssetProvider)}
 
 	gooseclient = goosehttp.New()
 )
@@ -42,11 +44,27 @@ func GetProvider(ar *persistence.AssetProvider) (*provision.ServiceProvision, er
 			return nil, err
 		}
 		ap.svcProvCache[key] = svcProv
+		provider := *ar
+		ap.providers[key] = &provider
 		log.Debug("[areq %s] Not Found Asset Provider in Cache, Keep it in Cache UUID", ar.EndPointURL)
 		return svcProv, nil
 	}
 }
 
+// Each calls f on every asset provider in the cache, outside of its lock
+func Each(f func(ar *persistence.AssetProvider, svcProv *provision.ServiceProvision)) {
+	ap.RLock()
+	svcProvs := make([]*provision.ServiceProvision, 0, len(ap.svcProvCache))
+	providers := make([]*persistence.AssetProvider, 0, len(ap.svcProvCache))
+	for key, svcProv := range ap.svcProvCache {
+		svcProvs, providers = append(svcProvs, svcProv), append(providers, ap.providers[key])
+	}
+	ap.RUnlock()
+	for i := range svcProvs {
+		f(providers[i], svcProvs[i])
+	}
+}
+
 /*
 func GetProviderById(id string) *provision.ServiceProvision {
 	ap.Lock()
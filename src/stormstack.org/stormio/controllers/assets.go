@@ -1,17 +1,24 @@
 package controllers
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/gorilla/mux"
 	"io/ioutil"
+	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"net/http"
+	"net/url"
 	"stormstack.org/stormio/cache"
+	"stormstack.org/stormio/events"
 	"stormstack.org/stormio/persistence"
 	"stormstack.org/stormio/provision"
+	"stormstack.org/stormio/scheduler"
 	"stormstack.org/stormio/util"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,9 +26,19 @@ func initAssetRoutes(contextPath string, router *mux.Router) {
 	router.HandleFunc(contextPath+"/createAsset", createAsset).Methods("POST")
 	router.HandleFunc(contextPath+"/deleteAsset", destroyAsset).Methods("POST")
 	subRouter := router.PathPrefix(contextPath + "/tasks").Subrouter()
+	subRouter.HandleFunc("", listAssets).Methods("GET")
 	subRouter.HandleFunc("/{id}", retrieveAsset).Methods("GET")
-	//subRouter.HandleFunc("/{id}/rename/{newName}", renameAsset).Methods("PUT")
-	//subRouter.HandleFunc("/{id}", destroyAsset).Methods("DELETE")
+	subRouter.HandleFunc("/{id}", renameAsset).Methods("PATCH")
+	subRouter.HandleFunc("/{id}", deleteAsset).Methods("DELETE")
+	subRouter.HandleFunc("/{id}/events", assetEvents).Methods("GET")
+	subRouter.HandleFunc("/{id}/timeline", assetTimeline).Methods("GET")
+	subRouter.HandleFunc("/{id}/remediate", remediateAsset).Methods("POST")
+	subRouter.HandleFunc("/{id}/lease", extendLease).Methods("PUT")
+	subRouter.HandleFunc("/{id}/priority", prioritizeAsset).Methods("PUT")
+	router.HandleFunc(contextPath+"/events", allEvents).Methods("GET")
+	groupRouter := router.PathPrefix(contextPath + "/groups").Subrouter()
+	groupRouter.HandleFunc("/{id}", retrieveGroup).Methods("GET")
+	groupRouter.HandleFunc("/{id}", deleteGroup).Methods("DELETE")
 }
 
 // CRUD for AssetRequest starts from here
@@ -36,25 +53,201 @@ func retrieveAsset(response http.ResponseWriter, request *http.Request) {
 	if ar, err := conn.Find(bson.M{"_id": anAssetId}); err != nil {
 		sendErrorResponse(response, http.StatusNotFound, err)
 	} else {
+		ar.Provider.Password = ""
 		b, _ := json.Marshal(ar)
 		sendByteResponse(b, http.StatusOK, response)
 	}
 	return
 }
 
+type AssetTimeline struct {
+	Id            string            `json:"id"`
+	Status        string            `json:"status"`
+	FailureReason string            `json:"failureReason,omitempty"`
+	Logs          []persistence.Log `json:"logs"`
+}
+
+/*
+ * The steps the server of the request went through, oldest first, with
+ * when, how long they took and why they failed, whichever stormio took them.
+ */
+func assetTimeline(response http.ResponseWriter, request *http.Request) {
+	assetId := mux.Vars(request)["id"]
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
+		return
+	}
+	defer conn.Close()
+	ar, err := conn.Find(bson.M{"_id": assetId})
+	if err != nil {
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Asset %s not found", assetId))
+		return
+	}
+	if ar.Logs, err = conn.Timeline(assetId); err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	sendResponse(util.ToString(AssetTimeline{ar.Id, ar.Status, ar.FailureReason, ar.Logs}), http.StatusOK, response)
+}
+
+type AssetPage struct {
+	Tasks []*persistence.AssetRequest `json:"tasks"`
+	Count int                         `json:"count"`
+	Next  string                      `json:"next,omitempty"`
+}
+
+/*
+ * Lists the asset requests, filtered on status (comma separated), resource,
+ * hostName, provider endpoint and the receivedOn range. Pages are walked with
+ * the opaque cursor handed back in "next".
+ */
+func listAssets(response http.ResponseWriter, request *http.Request) {
+	params := request.URL.Query()
+	page, err := pageFromQuery(params)
+	if err != nil {
+		sendErrorResponse(response, http.StatusBadRequest, err)
+		return
+	}
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendResponse("DB connection failure", http.StatusServiceUnavailable, response)
+		return
+	}
+	defer conn.Close()
+	assets, next, err := conn.FindPage(page)
+	if _, ok := err.(*persistence.QueryError); ok {
+		sendErrorResponse(response, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	var listResponse AssetPage
+	listResponse.Tasks = make([]*persistence.AssetRequest, 0, len(assets))
+	for _, ar := range assets {
+		ar.Provider.Password = ""
+		listResponse.Tasks = append(listResponse.Tasks, ar)
+	}
+	listResponse.Count = len(assets)
+	listResponse.Next = next
+	sendResponse(util.ToString(listResponse), http.StatusOK, response)
+}
+
+func pageFromQuery(params url.Values) (*persistence.Page, error) {
+	criteria := bson.M{}
+	if status := params.Get("status"); status != "" {
+		criteria["status"] = bson.M{"$in": strings.Split(status, ",")}
+	}
+	if resource := params.Get("resource"); resource != "" {
+		criteria["resourceid"] = resource
+	}
+	if hostName := params.Get("hostName"); hostName != "" {
+		criteria["hostname"] = hostName
+	}
+	if group := params.Get("group"); group != "" {
+		criteria["groupid"] = group
+	}
+	if endPoint := params.Get("provider"); endPoint != "" {
+		criteria["provider.endpointurl"] = endPoint
+	}
+	received := bson.M{}
+	for param, op := range map[string]string{"receivedAfter": "$gte", "receivedBefore": "$lt"} {
+		if value := params.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC3339 timestamp", param)
+			}
+			received[op] = persistence.FormatTime(t)
+		}
+	}
+	if len(received) > 0 {
+		criteria["receivedon"] = received
+	}
+
+	page := &persistence.Page{Criteria: criteria, Cursor: params.Get("cursor")}
+	if sortBy := params.Get("sort"); sortBy != "" {
+		if strings.HasPrefix(sortBy, "-") {
+			page.Desc = true
+			sortBy = sortBy[1:]
+		}
+		if !persistence.IsSortField(sortBy) {
+			return nil, fmt.Errorf("Can't sort on %s", sortBy)
+		}
+		page.SortBy = sortBy
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("limit must be a positive number")
+		}
+		page.Limit = n
+	}
+	return page, nil
+}
+
+/*
+ * A client retrying a timed out create sends the same Idempotency-Key, the
+ * request created by the first attempt is answered again instead of queuing
+ * a second server.
+ */
 func createAsset(response http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("Could not read the request body"))
+		return
+	}
 	asset := &persistence.AssetRequest{}
-	asset.DecodeFromRequest(request)
-	asset.Id = persistence.NewUUID()       //set the new uuid
-	asset.ReceivedOn = time.Now().String() //set the created time
+	if err := asset.DecodeFromBuffer(body); err != nil {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("Could not unmarshal the request body: %v", err))
+		return
+	}
+	if err := asset.Validate(); err != nil {
+		sendValidationError(response, err)
+		return
+	}
+	if maxCount := util.GetIntDefault("server", "max-count", 20); asset.Count > maxCount {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("count can't be over %d", maxCount))
+		return
+	}
+	// owned by the scheduler, not taken from the caller
+	asset.ServerId, asset.IpAddress, asset.Remediation, asset.Logs = "", "", false, nil
+	asset.Attempts, asset.FailureReason, asset.NextAttemptOn, asset.Remediations = 0, "", "", 0
+	asset.Id = persistence.NewUUID()     //set the new uuid
+	asset.ReceivedOn = persistence.Now() //set the created time
 	asset.Status = persistence.RequestNew
+	asset.PreviousStatus, asset.StatusChangedOn = "", asset.ReceivedOn
 	asset.ModelId = asset.Model.Id
+	// the model name is not held to the hostname rules a caller's name is
+	if asset.HostName == "" {
+		asset.HostName = asset.Model.Name
+	}
+	// kept in the layout the scheduler compares times in
+	if asset.NotBefore != "" {
+		asset.NotBefore, _ = persistence.ParseTime(asset.NotBefore)
+	}
+	if asset.ExpiresAt != "" {
+		asset.ExpiresAt, _ = persistence.ParseTime(asset.ExpiresAt)
+	}
 	log.Debugf("Asset Request recieved is %#v", asset)
 	conn, err := persistence.DefaultSession()
 	if err != nil {
 		sendErrorResponse(response, http.StatusInternalServerError, err)
 		return
 	}
+	defer conn.Close()
+
+	if key := request.Header.Get("Idempotency-Key"); key != "" {
+		asset.IdempotencyKey = key
+		asset.RequestHash = fmt.Sprintf("%x", sha256.Sum256(body))
+		if original, err := conn.Find(bson.M{"idempotencykey": key}); err == nil {
+			replayCreate(original, asset, response)
+			return
+		}
+	}
+
 	//validate the assetprovider
 	prov, err := cache.GetProvider(&asset.Provider)
 	if err != nil {
@@ -62,48 +255,129 @@ func createAsset(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if count, err := prov.CheckAvailability(); count <= 0 || err != nil {
-		log.Debugf("No FIP available, sending 412 to caller")
-		sendErrorResponse(response, http.StatusPreconditionFailed, fmt.Errorf("No FIP available"))
-		return
-	} else {
-		log.Debugf("Still %d fips are available", count)
+	needed := 1
+	if asset.Count > 1 {
+		needed = asset.Count
 	}
-
-	if asset.Notify.Url == "" {
-		sendErrorResponse(response, http.StatusPreconditionFailed, fmt.Errorf("No Notify callback URL present"))
+	if err := prov.Admit(asset.Model.Flavor, needed); err != nil {
+		log.Debugf("[areq %s] Not admitted :%v", asset.Id, err)
+		sendAdmissionError(response, err)
 		return
 	}
 
-	if asset.AgentId == "" {
-		sendErrorResponse(response, http.StatusPreconditionFailed, fmt.Errorf("No agentId present in the request"))
+	if asset.Count > 1 {
+		createGroup(conn, asset, response)
 		return
 	}
 
-	if asset.HostName == "" {
-		asset.HostName = asset.Model.Name
-	}
-
-	err = conn.Create(asset)
-	defer conn.Close()
-	if err != nil {
-		sendErrorResponse(response, http.StatusInternalServerError, err)
+	// kept for the replays, without the password
+	accepted := *asset
+	accepted.Provider.Password = ""
+	resp := util.ToString(&accepted)
+	asset.AcceptedResponse = resp
+	if !createOrReplay(conn, asset, response) {
 		return
 	}
 
-	resp := util.ToString(asset)
 	//Provision for new instance starts from here
 	log.Debug("Asset request created in the db, uuid:" + asset.Id + " Passing request to scheduler")
-	provisioner.CRequest <- asset
+	if err := provisioner.Enqueue(persistence.JobCreate, asset); err != nil {
+		// not accepted after all, a retry with the same key starts afresh
+		conn.Remove(asset.Id)
+		sendQueueError(response, err)
+		return
+	}
+	provisioner.Events.Publish(events.FromAsset(events.TypeStatus, asset))
 	log.Debug("Passed to the scheduler, returning 202..")
 	sendResponse(resp, http.StatusAccepted, response)
 	return
 }
 
+/*
+ * Creates the members of a request with a count, the group taking the id of
+ * the request, and answers the group. Every member is accepted or none is.
+ */
+func createGroup(conn *persistence.Connection, asset *persistence.AssetRequest, response http.ResponseWriter) {
+	members := asset.Members(asset.Id)
+	// kept for the replays, without the password
+	answered := make([]*persistence.AssetRequest, len(members))
+	for i, member := range members {
+		copied := *member
+		copied.Provider.Password = ""
+		answered[i] = &copied
+	}
+	resp := util.ToString(persistence.NewAssetGroup(asset.Id, answered))
+	// a retry with the same key is answered from the first member
+	first := members[0]
+	first.IdempotencyKey, first.RequestHash, first.AcceptedResponse = asset.IdempotencyKey, asset.RequestHash, resp
+
+	for i, member := range members {
+		if err := conn.Create(member); err != nil {
+			removeMembers(conn, members[:i])
+			if mgo.IsDup(err) && i == 0 && asset.IdempotencyKey != "" {
+				if original, err := conn.Find(bson.M{"idempotencykey": asset.IdempotencyKey}); err == nil {
+					replayCreate(original, asset, response)
+					return
+				}
+			}
+			sendErrorResponse(response, http.StatusInternalServerError, err)
+			return
+		}
+		if err := provisioner.Enqueue(persistence.JobCreate, member); err != nil {
+			removeMembers(conn, members[:i+1])
+			sendQueueError(response, err)
+			return
+		}
+	}
+	for _, member := range members {
+		provisioner.Events.Publish(events.FromAsset(events.TypeStatus, member))
+	}
+	log.Debugf("[group %s] %d members passed to the scheduler, returning 202..", asset.Id, len(members))
+	sendResponse(resp, http.StatusAccepted, response)
+}
+
+// Their jobs already queued find them gone and are dropped
+func removeMembers(conn *persistence.Connection, members []*persistence.AssetRequest) {
+	for _, member := range members {
+		conn.Remove(member.Id)
+	}
+}
+
+/*
+ * Creates the request, false once the caller is answered otherwise: with the
+ * original request when a concurrent retry with the same key got in first.
+ */
+func createOrReplay(conn *persistence.Connection, asset *persistence.AssetRequest, response http.ResponseWriter) bool {
+	err := conn.Create(asset)
+	if err == nil {
+		return true
+	}
+	if mgo.IsDup(err) && asset.IdempotencyKey != "" {
+		if original, err := conn.Find(bson.M{"idempotencykey": asset.IdempotencyKey}); err == nil {
+			replayCreate(original, asset, response)
+			return false
+		}
+	}
+	sendErrorResponse(response, http.StatusInternalServerError, err)
+	return false
+}
+
+func replayCreate(original, retry *persistence.AssetRequest, response http.ResponseWriter) {
+	if original.RequestHash != retry.RequestHash {
+		sendErrorResponse(response, http.StatusUnprocessableEntity,
+			fmt.Errorf("Idempotency-Key %s was already used with a different request", retry.IdempotencyKey))
+		return
+	}
+	log.Debugf("[areq %s] Replaying the create for Idempotency-Key %s", original.Id, original.IdempotencyKey)
+	response.Header().Set("Idempotent-Replayed", "true")
+	sendResponse(original.AcceptedResponse, http.StatusAccepted, response)
+}
+
 type AssetDestroy struct {
-	Id string `json:"id"`
+	Id string `json:"id" valid:"required"`
 }
 
+// Kept for the callers still posting {"id": ...}, same as DELETE /tasks/{id}
 func destroyAsset(response http.ResponseWriter, request *http.Request) {
 	body, err := ioutil.ReadAll(request.Body)
 	if err != nil {
@@ -113,29 +387,102 @@ func destroyAsset(response http.ResponseWriter, request *http.Request) {
 
 	var aAsset AssetDestroy
 	err = json.Unmarshal(body, &aAsset)
-	if err != nil {
+	if err != nil || aAsset.Id == "" {
 		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("Could not unmarshal the request body"))
 		return
 	}
+	requestDeletion(aAsset.Id, response)
+}
 
-	log.Debugf("Finding an asset with ID %v in DB", aAsset.Id)
+func deleteAsset(response http.ResponseWriter, request *http.Request) {
+	requestDeletion(mux.Vars(request)["id"], response)
+}
+
+/*
+ * Deletes are idempotent, an asset already marked for deletion is not queued
+ * again and one that is already gone answers 204. A server still being built
+ * is cancelled and cleaned up before the delete runs.
+ */
+func requestDeletion(assetId string, response http.ResponseWriter) {
+	log.Debugf("Finding an asset with ID %v in DB", assetId)
 	conn, err := persistence.DefaultSession()
 	if err != nil {
-		sendResponse("DB connection failure", http.StatusServiceUnavailable, response)
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
 		return
 	}
 	defer conn.Close()
-	asset, err := conn.Find(bson.M{"_id": aAsset.Id})
-
+	asset, err := conn.Find(bson.M{"_id": assetId})
+	if err == mgo.ErrNotFound {
+		log.Debugf("[areq %s] Asset not found / already deleted %v", assetId, err)
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
 	if err != nil {
-		sendResponse("Asset not found / already deleted", http.StatusNotFound, response)
-		log.Debugf("Error in finding asset %s %v", asset.Id, err)
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
 		return
 	}
+
 	log.Debugf("Asset Request recieved is %#v", asset)
-	provisioner.DelNotification <- asset
+	if err := provisioner.Delete(conn, asset); err != nil {
+		sendQueueError(response, err)
+		return
+	}
+	sendResponse(util.Response{"id": asset.Id, "status": asset.Status}.String(), http.StatusAccepted, response)
+}
+
+// The members of a group and where they are, see persistence.AssetGroup
+func retrieveGroup(response http.ResponseWriter, request *http.Request) {
+	groupId := mux.Vars(request)["id"]
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
+		return
+	}
 	defer conn.Close()
-	sendResponse("Asset "+aAsset.Id+" delete request accepted", http.StatusAccepted, response)
+	members, err := conn.FindGroup(groupId)
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	if len(members) == 0 {
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Group %s not found", groupId))
+		return
+	}
+	for _, member := range members {
+		member.Provider.Password = ""
+	}
+	sendResponse(util.ToString(persistence.NewAssetGroup(groupId, members)), http.StatusOK, response)
+}
+
+// Deletes every member of the group, a group already gone answers 204
+func deleteGroup(response http.ResponseWriter, request *http.Request) {
+	groupId := mux.Vars(request)["id"]
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
+		return
+	}
+	defer conn.Close()
+	members, err := conn.FindGroup(groupId)
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	if len(members) == 0 {
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for _, member := range members {
+		if err := provisioner.Delete(conn, member); err != nil && !persistence.IsStatusConflict(err) {
+			log.Errorf("[group %s] Unable to delete member %s :%v", groupId, member.Id, err)
+			sendQueueError(response, err)
+			return
+		}
+	}
+	for _, member := range members {
+		member.Provider.Password = ""
+	}
+	sendResponse(util.ToString(persistence.NewAssetGroup(groupId, members)), http.StatusAccepted, response)
 }
 
 func ValidateAssetProvider(response http.ResponseWriter, request *http.Request) (*provision.ServiceProvision, error) {
@@ -146,28 +493,206 @@ func ValidateAssetProvider(response http.ResponseWriter, request *http.Request)
 	}
 }
 
+type AssetRename struct {
+	HostName string `json:"hostName" valid:"required,hostname"`
+}
+
 func renameAsset(response http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	assetId := vars["id"]
-	newName := vars["newName"]
+	assetId := mux.Vars(request)["id"]
+	var rename AssetRename
+	if err := json.NewDecoder(request.Body).Decode(&rename); err != nil {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("Could not unmarshal the request body"))
+		return
+	}
+	if errs := persistence.Validate(&rename); len(errs) > 0 {
+		sendValidationError(response, errs)
+		return
+	}
 	conn, err := persistence.DefaultSession()
 	if err != nil {
-		sendResponse("DB connection failure", http.StatusServiceUnavailable, response)
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
 		return
 	}
 	defer conn.Close()
-	if asset, err := conn.Find(bson.M{"_id": assetId}); err == nil {
-		if prov, err := cache.GetProvider(&asset.Provider); err == nil {
-			if err := prov.RenameServer(asset.ServerId, newName); err != nil {
-				sendResponse("{'error':'Unable to rename'}", http.StatusExpectationFailed, response)
-				return
-			}
-			sendResponse("{'message':'Rename success'}", http.StatusOK, response)
-		} else {
-			sendErrorResponse(response, http.StatusBadRequest, err)
+	asset, err := conn.Find(bson.M{"_id": assetId})
+	switch {
+	case err == mgo.ErrNotFound:
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Asset %s not found", assetId))
+		return
+	case err != nil:
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := provisioner.RenameServer(asset, rename.HostName); err != nil {
+		sendErrorResponse(response, http.StatusBadGateway, err)
+		return
+	}
+	// only the host name, the status may have moved on meanwhile
+	asset, err = conn.Set(bson.M{"_id": assetId}, bson.M{"hostname": rename.HostName})
+	switch {
+	case err == mgo.ErrNotFound:
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Asset %s not found", assetId))
+		return
+	case err != nil:
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	asset.Provider.Password = ""
+	sendResponse(util.ToString(asset), http.StatusOK, response)
+}
+
+// Either the new expiry or the seconds to push the current one by
+type AssetLease struct {
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	ExtendBy  int    `json:"extendBy,omitempty"`
+}
+
+/*
+ * Moves the expiry of the request, the time after which it is deleted. A
+ * request without one gets one with expiresAt, extendBy needs one to extend.
+ */
+func extendLease(response http.ResponseWriter, request *http.Request) {
+	assetId := mux.Vars(request)["id"]
+	var lease AssetLease
+	if err := json.NewDecoder(request.Body).Decode(&lease); err != nil {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("Could not unmarshal the request body"))
+		return
+	}
+	if (lease.ExpiresAt == "") == (lease.ExtendBy == 0) {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("Either expiresAt or extendBy is required"))
+		return
+	}
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
+		return
+	}
+	defer conn.Close()
+	asset, err := conn.Find(bson.M{"_id": assetId})
+	if err != nil {
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Asset %s not found", assetId))
+		return
+	}
+	if asset.Status == persistence.RequestMarkDeletion {
+		sendErrorResponse(response, http.StatusConflict, fmt.Errorf("Asset %s is being deleted", assetId))
+		return
+	}
+
+	expiresAt := lease.ExpiresAt
+	if lease.ExtendBy != 0 {
+		current, err := time.Parse(persistence.TimeLayout, asset.ExpiresAt)
+		if err != nil {
+			sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("Asset %s has no expiry to extend, expiresAt is required", assetId))
+			return
 		}
-	} else {
-		sendErrorResponse(response, http.StatusNotFound, err)
+		expiresAt = persistence.FormatTime(current.Add(time.Duration(lease.ExtendBy) * time.Second))
+	} else if expiresAt, err = persistence.ParseTime(expiresAt); err != nil {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("expiresAt %v", err))
+		return
 	}
-	return
+	if expiresAt <= persistence.Now() {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("The lease would end at %s, already past", expiresAt))
+		return
+	}
+	// the expiry alone, a build in flight saves the rest of the request
+	asset, err = conn.Set(bson.M{"_id": assetId, "status": bson.M{"$ne": persistence.RequestMarkDeletion}},
+		bson.M{"expiresat": expiresAt})
+	switch {
+	case err == mgo.ErrNotFound:
+		// deleted, or marked for deletion meanwhile
+		sendErrorResponse(response, http.StatusConflict, fmt.Errorf("Asset %s is being deleted", assetId))
+		return
+	case err != nil:
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	log.Infof("[areq %s] Expires at %s", assetId, expiresAt)
+	asset.Provider.Password = ""
+	sendResponse(util.ToString(asset), http.StatusOK, response)
+}
+
+type AssetPriority struct {
+	Priority int `json:"priority"`
+}
+
+/*
+ * Overrides the priority class of the create of the request, and of its
+ * retries, the create still queued included. 0 goes back to the class.
+ */
+func prioritizeAsset(response http.ResponseWriter, request *http.Request) {
+	assetId := mux.Vars(request)["id"]
+	var priority AssetPriority
+	if err := json.NewDecoder(request.Body).Decode(&priority); err != nil {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("Could not unmarshal the request body"))
+		return
+	}
+	if priority.Priority < 0 || priority.Priority > persistence.MaxPriority {
+		sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("priority must be between 0 and %d", persistence.MaxPriority))
+		return
+	}
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
+		return
+	}
+	defer conn.Close()
+	// the priority alone, a build in flight saves the rest of the request
+	asset, err := conn.Set(bson.M{"_id": assetId}, bson.M{"priority": priority.Priority})
+	switch {
+	case err == mgo.ErrNotFound:
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Asset %s not found", assetId))
+		return
+	case err != nil:
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err := provisioner.Reprioritize(asset); err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	log.Infof("[areq %s] Priority set to %d", assetId, asset.Priority)
+	asset.Provider.Password = ""
+	sendResponse(util.ToString(asset), http.StatusOK, response)
+}
+
+type AssetRemediation struct {
+	Id           string `json:"id"`
+	Status       string `json:"status"`
+	IpAddress    string `json:"ipAddress"`
+	Remediations int    `json:"remediations"`
+}
+
+/*
+ * Rebuilds the server of the request keeping its floating ip. The progress
+ * is that of the request, through REMEDIATION, BUILD and SERVER_CREATED, on
+ * GET /tasks/{id}, its events or the status of its resource.
+ */
+func remediateAsset(response http.ResponseWriter, request *http.Request) {
+	assetId := mux.Vars(request)["id"]
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
+		return
+	}
+	defer conn.Close()
+	asset, err := conn.Find(bson.M{"_id": assetId})
+	if err != nil {
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Asset %s not found", assetId))
+		return
+	}
+
+	switch err := provisioner.Remediate(conn, asset); {
+	case err == nil:
+	case err == scheduler.ErrNoFloatingIP || persistence.IsStatusConflict(err):
+		sendErrorResponse(response, http.StatusConflict, err)
+		return
+	case err == persistence.ErrQueueFull:
+		sendQueueError(response, err)
+		return
+	default:
+		sendErrorResponse(response, http.StatusBadGateway, err)
+		return
+	}
+	sendResponse(util.ToString(AssetRemediation{asset.Id, asset.Status, asset.IpAddress, asset.Remediations}),
+		http.StatusAccepted, response)
 }
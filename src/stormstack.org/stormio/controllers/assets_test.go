@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"encoding/json"
+	"labix.org/v2/mgo/bson"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/util"
+	"strings"
+)
+
+type AssetsSuite struct{}
+
+var _ = Suite(&AssetsSuite{})
+
+func (s *AssetsSuite) TestReplayCreate(c *C) {
+	original := &persistence.AssetRequest{Id: "a1", IdempotencyKey: "k1", RequestHash: "h1", AcceptedResponse: `{"id":"a1"}`}
+
+	response := httptest.NewRecorder()
+	replayCreate(original, &persistence.AssetRequest{IdempotencyKey: "k1", RequestHash: "h1"}, response)
+	c.Assert(response.Code, Equals, http.StatusAccepted)
+	c.Assert(response.Header().Get("Idempotent-Replayed"), Equals, "true")
+	c.Assert(response.Body.String(), Equals, `{"id":"a1"}`)
+
+	// the key of another request
+	response = httptest.NewRecorder()
+	replayCreate(original, &persistence.AssetRequest{IdempotencyKey: "k1", RequestHash: "h2"}, response)
+	c.Assert(response.Code, Equals, http.StatusUnprocessableEntity)
+	c.Assert(response.Header().Get("Idempotent-Replayed"), Equals, "")
+}
+
+func (s *ControllerSuite) TestRemediateAsset(c *C) {
+	ar := s.request(c, persistence.RequestFulfilled)
+	response := s.serve("POST", "/tasks/"+ar.Id+"/remediate", "", nil)
+	c.Assert(response.Code, Equals, http.StatusAccepted)
+	var remediation AssetRemediation
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &remediation), IsNil)
+	c.Assert(remediation, DeepEquals, AssetRemediation{ar.Id, persistence.RequestRemediation, "10.0.0.7", 1})
+	job, err := provisioner.Queue.Claim("test", persistence.JobRemediate)
+	c.Assert(err, IsNil)
+	c.Assert(job.AssetId, Equals, ar.Id)
+
+	// already being remediated
+	c.Assert(s.serve("POST", "/tasks/"+ar.Id+"/remediate", "", nil).Code, Equals, http.StatusConflict)
+	c.Assert(s.serve("POST", "/tasks/unknown/remediate", "", nil).Code, Equals, http.StatusNotFound)
+
+	// nothing to keep
+	ar = s.request(c, persistence.RequestFulfilled)
+	s.conn.Set(bson.M{"_id": ar.Id}, bson.M{"ipaddress": ""})
+	c.Assert(s.serve("POST", "/tasks/"+ar.Id+"/remediate", "", nil).Code, Equals, http.StatusConflict)
+}
+
+func (s *AssetsSuite) TestPageFromQuery(c *C) {
+	page, err := pageFromQuery(url.Values{"status": {"NEW,BUILD"}, "hostName": {"vcg"}, "group": {"g1"},
+		"receivedAfter": {"2026-03-01T10:00:00+02:00"}, "sort": {"-status"}, "limit": {"10"}, "cursor": {"c1"}})
+	c.Assert(err, IsNil)
+	c.Assert(page.Criteria, DeepEquals, bson.M{
+		"status":     bson.M{"$in": []string{"NEW", "BUILD"}},
+		"hostname":   "vcg",
+		"groupid":    "g1",
+		"receivedon": bson.M{"$gte": "2026-03-01T08:00:00.000000000Z"},
+	})
+	c.Assert(page.SortBy, Equals, "status")
+	c.Assert(page.Desc, Equals, true)
+	c.Assert(page.Limit, Equals, 10)
+	c.Assert(page.Cursor, Equals, "c1")
+
+	page, err = pageFromQuery(url.Values{})
+	c.Assert(err, IsNil)
+	c.Assert(page.Criteria, HasLen, 0)
+	c.Assert(page.SortBy, Equals, "")
+
+	for _, bad := range []url.Values{
+		{"receivedBefore": {"yesterday"}},
+		{"sort": {"password"}},
+		{"limit": {"0"}},
+		{"limit": {"ten"}},
+	} {
+		_, err := pageFromQuery(bad)
+		c.Assert(err, NotNil, Commentf("%v", bad))
+	}
+}
+
+// A create of the asset provider of the suite
+func (s *ControllerSuite) createBody(resource string) string {
+	return util.ToString(map[string]interface{}{
+		"resource": resource, "agentId": "agent1", "assetProvider": s.provider,
+		"assetModel": map[string]string{"name": "kvm", "flavor": "m1.small", "image": "cloudnode"},
+		"Notify":     map[string]string{"url": "http://127.0.0.1:1/notify"},
+	})
+}
+
+func (s *ControllerSuite) TestCreateAsset(c *C) {
+	key := http.Header{"Idempotency-Key": {persistence.NewUUID()}}
+	body := s.createBody(persistence.NewUUID())
+	response := s.serve("POST", "/createAsset", body, key)
+	c.Assert(response.Code, Equals, http.StatusAccepted, Commentf(response.Body.String()))
+	c.Assert(strings.Contains(response.Body.String(), "secret"), Equals, false)
+	var accepted persistence.AssetRequest
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &accepted), IsNil)
+	s.created = append(s.created, accepted.Id)
+	stored, err := s.conn.Find(bson.M{"_id": accepted.Id})
+	c.Assert(err, IsNil)
+	c.Assert(stored.Status, Equals, persistence.RequestNew)
+	c.Assert(stored.Provider.Password, Equals, "secret")
+	c.Assert(strings.Contains(stored.AcceptedResponse, "secret"), Equals, false)
+
+	// the retry is answered the same, without queuing another server
+	replay := s.serve("POST", "/createAsset", body, key)
+	c.Assert(replay.Code, Equals, http.StatusAccepted)
+	c.Assert(replay.Header().Get("Idempotent-Replayed"), Equals, "true")
+	c.Assert(replay.Body.String(), Equals, response.Body.String())
+	job, err := provisioner.Queue.Claim("test", persistence.JobCreate)
+	c.Assert(err, IsNil)
+	c.Assert(job.AssetId, Equals, accepted.Id)
+	job, err = provisioner.Queue.Claim("test", persistence.JobCreate)
+	c.Assert(err, IsNil)
+	c.Assert(job, IsNil)
+
+	// the same key on another request
+	response = s.serve("POST", "/createAsset", s.createBody(persistence.NewUUID()), key)
+	c.Assert(response.Code, Equals, http.StatusUnprocessableEntity)
+}
+
+// Lost the race against a concurrent retry with the same key
+func (s *ControllerSuite) TestCreateOrReplay(c *C) {
+	original := s.request(c, persistence.RequestNew)
+	key := persistence.NewUUID()
+	s.conn.Set(bson.M{"_id": original.Id}, bson.M{"idempotencykey": key, "requesthash": "h1", "acceptedresponse": `{"id":"first"}`})
+
+	retry := &persistence.AssetRequest{Id: persistence.NewUUID(), IdempotencyKey: key, RequestHash: "h1"}
+	response := httptest.NewRecorder()
+	c.Assert(createOrReplay(s.conn, retry, response), Equals, false)
+	c.Assert(response.Code, Equals, http.StatusAccepted)
+	c.Assert(response.Body.String(), Equals, `{"id":"first"}`)
+	_, err := s.conn.Find(bson.M{"_id": retry.Id})
+	c.Assert(err, NotNil)
+
+	retry.Id, retry.RequestHash = persistence.NewUUID(), "h2"
+	response = httptest.NewRecorder()
+	c.Assert(createOrReplay(s.conn, retry, response), Equals, false)
+	c.Assert(response.Code, Equals, http.StatusUnprocessableEntity)
+
+	fresh := &persistence.AssetRequest{Id: persistence.NewUUID(), IdempotencyKey: persistence.NewUUID()}
+	s.created = append(s.created, fresh.Id)
+	c.Assert(createOrReplay(s.conn, fresh, httptest.NewRecorder()), Equals, true)
+}
+
+func (s *ControllerSuite) TestCreateGroup(c *C) {
+	var body map[string]interface{}
+	json.Unmarshal([]byte(s.createBody("")), &body)
+	body["count"], body["resources"] = 2, []string{persistence.NewUUID(), persistence.NewUUID()}
+	response := s.serve("POST", "/createAsset", util.ToString(body), http.Header{"Idempotency-Key": {persistence.NewUUID()}})
+	c.Assert(response.Code, Equals, http.StatusAccepted, Commentf(response.Body.String()))
+	c.Assert(strings.Contains(response.Body.String(), "secret"), Equals, false)
+	var group persistence.AssetGroup
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &group), IsNil)
+	c.Assert(group.Members, HasLen, 2)
+	for _, member := range group.Members {
+		s.created = append(s.created, member.Id)
+	}
+
+	first, err := s.conn.Find(bson.M{"_id": group.Members[0].Id})
+	c.Assert(err, IsNil)
+	c.Assert(first.Provider.Password, Equals, "secret")
+	c.Assert(first.AcceptedResponse, Equals, response.Body.String())
+}
+
+func (s *ControllerSuite) TestRenameAsset(c *C) {
+	ar := s.request(c, persistence.RequestFulfilled)
+	path := "/tasks/" + ar.Id
+	c.Assert(s.serve("PATCH", path, `{"hostName":`, nil).Code, Equals, http.StatusBadRequest)
+	c.Assert(s.serve("PATCH", path, `{}`, nil).Code, Equals, http.StatusBadRequest)
+	c.Assert(s.serve("PATCH", path, `{"hostName": "vcg_2"}`, nil).Code, Equals, http.StatusBadRequest)
+	c.Assert(s.serve("PATCH", "/tasks/unknown", `{"hostName": "vcg2"}`, nil).Code, Equals, http.StatusNotFound)
+
+	// the server s1 is unknown to the cloud, the host name is kept
+	c.Assert(s.serve("PATCH", path, `{"hostName": "vcg2"}`, nil).Code, Equals, http.StatusBadGateway)
+	asset, err := s.conn.Find(bson.M{"_id": ar.Id})
+	c.Assert(err, IsNil)
+	c.Assert(asset.HostName, Equals, "vcg")
+}
+
+func (s *ControllerSuite) TestDeleteAsset(c *C) {
+	c.Assert(s.serve("DELETE", "/tasks/unknown", "", nil).Code, Equals, http.StatusNoContent)
+
+	ar := s.request(c, persistence.RequestFulfilled)
+	response := s.serve("DELETE", "/tasks/"+ar.Id, "", nil)
+	c.Assert(response.Code, Equals, http.StatusAccepted)
+	c.Assert(response.Body.String(), Equals, util.Response{"id": ar.Id, "status": persistence.RequestMarkDeletion}.String())
+	asset, err := s.conn.Find(bson.M{"_id": ar.Id})
+	c.Assert(err, IsNil)
+	c.Assert(asset.Status, Equals, persistence.RequestMarkDeletion)
+
+	// already marked, not queued again
+	c.Assert(s.serve("DELETE", "/tasks/"+ar.Id, "", nil).Code, Equals, http.StatusAccepted)
+	job, err := provisioner.Queue.Claim("test", persistence.JobDelete)
+	c.Assert(err, IsNil)
+	c.Assert(job.AssetId, Equals, ar.Id)
+	job, err = provisioner.Queue.Claim("test", persistence.JobDelete)
+	c.Assert(err, IsNil)
+	c.Assert(job, IsNil)
+
+	// gone meanwhile
+	c.Assert(s.conn.Remove(ar.Id), IsNil)
+	c.Assert(s.serve("DELETE", "/tasks/"+ar.Id, "", nil).Code, Equals, http.StatusNoContent)
+}
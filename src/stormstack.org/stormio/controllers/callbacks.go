@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/util"
+	"strconv"
+)
+
+// The callbacks to Vertex still in the outbox, the dead letters among them
+func initCallbackRoutes(contextPath string, router *mux.Router) {
+	subRouter := router.PathPrefix(contextPath + "/callbacks").Subrouter()
+	subRouter.HandleFunc("", listCallbacks).Methods("GET")
+	subRouter.HandleFunc("/{id}", retrieveCallback).Methods("GET")
+	subRouter.HandleFunc("/{id}/replay", replayCallback).Methods("POST")
+}
+
+type CallbackPage struct {
+	Callbacks []*persistence.Callback `json:"callbacks"`
+	Count     int                     `json:"count"`
+}
+
+/*
+ * Lists the callbacks not delivered yet, oldest first, filtered on status,
+ * DEAD_LETTER unless asked otherwise, kind and asset request.
+ */
+func listCallbacks(response http.ResponseWriter, request *http.Request) {
+	params := request.URL.Query()
+	criteria := bson.M{"status": persistence.CallbackDeadLetter}
+	if status := params.Get("status"); status != "" {
+		criteria["status"] = status
+	}
+	if kind := params.Get("kind"); kind != "" {
+		criteria["kind"] = kind
+	}
+	if assetId := params.Get("asset"); assetId != "" {
+		criteria["assetid"] = assetId
+	}
+	limit := 100
+	if l := params.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			sendErrorResponse(response, http.StatusBadRequest, fmt.Errorf("limit must be a positive number"))
+			return
+		}
+		limit = n
+	}
+	callbacks, err := provisioner.Outbox.List(criteria, limit)
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	page := CallbackPage{Callbacks: callbacks, Count: len(callbacks)}
+	if page.Callbacks == nil {
+		page.Callbacks = []*persistence.Callback{}
+	}
+	sendResponse(util.ToString(page), http.StatusOK, response)
+}
+
+func retrieveCallback(response http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+	cb, err := provisioner.Outbox.Find(id)
+	switch {
+	case err == mgo.ErrNotFound:
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Callback %s not found, delivered or never recorded", id))
+	case err != nil:
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+	default:
+		sendResponse(util.ToString(cb), http.StatusOK, response)
+	}
+}
+
+// Delivers a dead letter again, with a fresh set of attempts
+func replayCallback(response http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+	if dead, err := provisioner.Outbox.Find(id); err == nil && dead.Kind == persistence.CallbackAttach {
+		// the detach of a deleted request may be delivered and gone
+		if ok, err := attachable(dead.AssetId); err != nil {
+			sendErrorResponse(response, http.StatusServiceUnavailable, err)
+			return
+		} else if !ok {
+			sendErrorResponse(response, http.StatusConflict, fmt.Errorf("Asset %s is deleted, its attach isn't replayed", dead.AssetId))
+			return
+		}
+	}
+	cb, err := provisioner.Outbox.Replay(id)
+	switch {
+	case err == mgo.ErrNotFound:
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Callback %s not found, delivered or never recorded", id))
+	case err == persistence.ErrNotDeadLetter, err == persistence.ErrSuperseded:
+		sendErrorResponse(response, http.StatusConflict, err)
+	case err != nil:
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+	default:
+		sendResponse(util.ToString(cb), http.StatusAccepted, response)
+	}
+}
+
+// An attach is only replayed for a request still there and not being deleted
+func attachable(assetId string) (bool, error) {
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	ar, err := conn.Find(bson.M{"_id": assetId})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ar.Status != persistence.RequestMarkDeletion, nil
+}
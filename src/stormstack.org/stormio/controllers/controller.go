@@ -1,40 +1,145 @@
 package controllers
 
 import (
-	"stormstack.org/stormio/persistence"
-	"stormstack.org/stormio/scheduler"
-	"stormstack.org/stormio/util"
-	"crypto/aes"
-	"crypto/cipher"
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"launchpad.net/goose/identity"
+	"net"
 	"net/http"
 	"os"
+	"stormstack.org/stormio/envelope"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/provision"
+	"stormstack.org/stormio/scheduler"
+	"stormstack.org/stormio/tlsconf"
+	"stormstack.org/stormio/util"
+	"time"
 )
 
 // var assetDS = new(persistence.AssetDS)
-var provisioner *scheduler.Provisioner
+var (
+	provisioner    *scheduler.Provisioner
+	keyring        *envelope.Keyring
+	allowPlaintext bool
+)
 
-func StartServer(host string, port string) {
-	contextPath := util.GetString("web-app", "context-path")
-	router := mux.NewRouter()
+// credentialsError is returned when the Authorization header can't be trusted
+type credentialsError struct {
+	err error
+}
 
-	initAssetRoutes(contextPath, router)
-	initResourceMappings(contextPath, router)
-	initAssetProviderMappings(contextPath, router)
-	initSvc()
+func (ce *credentialsError) Error() string {
+	return fmt.Sprintf("Invalid asset provider credentials: %v", ce.err)
+}
+
+var (
+	server   *http.Server
+	certs    *tlsconf.Reloader     // nil when serving plain HTTP
+	stopping = make(chan struct{}) // closed on shutdown, ends the event streams
+)
+
+/*
+ * StartServer binds host:port and serves in the background, over TLS when
+ * [server] has a tls-cert. The error is returned when the TLS files can't be
+ * loaded or the address can't be bound.
+ */
+func StartServer(host string, port string) error {
+	var err error
+	if certs, err = tlsconf.Load(util.Config, "server"); err != nil {
+		return err
+	}
+	contextPath := util.GetString("web-app", "context-path")
+	router := initRoutes(contextPath)
+	if err := initSvc(); err != nil {
+		return err
+	}
 	appName := util.GetString("application", "name")
 	log.Infof("%s running @ %s:%s", appName, host, port)
 	out, _ := os.Create(util.GetString("path", "access-log"))
 	handler := handlers.LoggingHandler(out, router)
-	http.ListenAndServe(host+":"+port, handler)
+	listener, err := net.Listen("tcp", host+":"+port)
+	if err != nil {
+		return err
+	}
+	server = &http.Server{Handler: handler}
+	if certs != nil {
+		server.TLSConfig = certs.Config()
+	}
+	go func() {
+		var err error
+		if certs != nil {
+			log.Infof("Serving over TLS, client certificates %v", server.TLSConfig.ClientAuth)
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			log.Criticalf("%s stopped serving :%v", appName, err)
+		}
+	}()
+	return nil
+}
+
+/*
+ * ReloadTLS reads the certificate, its key and the client CA bundle again,
+ * reloaded is false when the server is not on TLS, there is nothing to.
+ */
+func ReloadTLS() (reloaded bool, err error) {
+	if certs == nil {
+		return false, nil
+	}
+	if err := certs.Reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+ * StopServer stops accepting requests, lets the ones being served finish and
+ * drains the provisioner, all within timeout.
+ */
+func StopServer(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	close(stopping)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("Requests still being served on shutdown :%v", err)
+	}
+	provisioner.Stop(deadline.Sub(time.Now()))
+}
+
+func initSvc() (err error) {
+	if err := persistence.EnsureIndexes(); err != nil {
+		log.Errorf("Unable to create the indexes :%v", err)
+	}
+	if migrated, err := persistence.MigrateReceivedOn(); err != nil {
+		log.Errorf("Unable to migrate the receivedOn of the older requests :%v", err)
+	} else if migrated > 0 {
+		log.Infof("Migrated the receivedOn of %d older requests", migrated)
+	}
+	initKeyring()
+	provisioner, err = scheduler.NewProvisioner()
+	return
 }
 
-func initSvc() {
-	provisioner = scheduler.NewProvisioner()
+func initKeyring() {
+	var err error
+	if keyring, err = envelope.LoadKeyring(util.Config, "encyrption"); err != nil {
+		log.Errorf("Unable to load the encryption keys :%v", err)
+		keyring = envelope.NewKeyring()
+	}
+	allowPlaintext, _ = util.Config.GetBool("encyrption", "allow-plaintext")
+	if keyring.Len() == 0 && !allowPlaintext {
+		log.Warn("No encryption keys configured, asset provider credentials will be rejected")
+	}
 }
 
 /*
@@ -48,9 +153,23 @@ func initDB() {
 }
 */
 
+// Every route stormio serves, the OpenAPI document built from them
+func initRoutes(contextPath string) *mux.Router {
+	router := mux.NewRouter()
+	initAssetRoutes(contextPath, router)
+	initResourceMappings(contextPath, router)
+	initAssetProviderMappings(contextPath, router)
+	initCallbackRoutes(contextPath, router)
+	initReconcileRoutes(contextPath, router)
+	initOpenAPIMapping(contextPath, router)
+	buildOpenAPI(contextPath, router)
+	return router
+}
+
 func initResourceMappings(contextPath string, router *mux.Router) {
 	subRouter := router.PathPrefix(contextPath + "/resource").Subrouter()
 	subRouter.HandleFunc("/{id}/status", resourceStatus).Methods("GET")
+	subRouter.HandleFunc("/{id}/activated", resourceActivated).Methods("PUT")
 }
 
 func initAssetProviderMappings(contextPath string, router *mux.Router) {
@@ -62,7 +181,7 @@ func initAssetProviderMappings(contextPath string, router *mux.Router) {
 	subRouter.HandleFunc("/service/{name}/test", validateProvidersService).Methods("POST")
 }
 
-//Assetprovider information is going to come as AES/ECB/PKCS5Padding
+// Assetprovider information comes sealed in an envelope, see extractAssetProvider
 func listImages(response http.ResponseWriter, request *http.Request) {
 	if prov, err := ValidateAssetProvider(response, request); err == nil {
 		images, err := prov.ListImageNames()
@@ -73,7 +192,7 @@ func listImages(response http.ResponseWriter, request *http.Request) {
 		sendResponse(images.String(), http.StatusOK, response)
 		return
 	} else {
-		sendErrorResponse(response, http.StatusBadGateway, err)
+		sendErrorResponse(response, providerErrorStatus(err), err)
 	}
 }
 
@@ -87,14 +206,14 @@ func listFlavors(response http.ResponseWriter, request *http.Request) {
 		sendResponse(images.String(), http.StatusOK, response)
 		return
 	} else {
-		sendErrorResponse(response, http.StatusBadGateway, err)
+		sendErrorResponse(response, providerErrorStatus(err), err)
 	}
 }
 
 func uploadImage(response http.ResponseWriter, request *http.Request) {
 	assetProvider, err := extractAssetProvider(request.Header.Get("Authorization"))
 	if err != nil {
-		sendResponse("Error in extracting AssetProvider", http.StatusInternalServerError, response)
+		sendErrorResponse(response, providerErrorStatus(err), err)
 		return
 	}
 	log.Info("Uploading Image, delegating to Provisioner")
@@ -103,27 +222,80 @@ func uploadImage(response http.ResponseWriter, request *http.Request) {
 	return
 }
 
+/*
+ * Runs a probe against one of the provider's services (compute, image,
+ * network or object-store) and reports the latency and the error if any.
+ */
 func validateProvidersService(response http.ResponseWriter, request *http.Request) {
-	return
+	service := mux.Vars(request)["name"]
+	if !provision.IsProbeable(service) {
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Unknown service %s", service))
+		return
+	}
+	assetProvider, err := extractAssetProvider(request.Header.Get("Authorization"))
+	if err != nil {
+		sendErrorResponse(response, providerErrorStatus(err), err)
+		return
+	}
+	// not taken from the cache, it only holds providers with a working compute
+	result, err := provision.NewServiceProvision(assetProvider).ProbeService(service)
+	if err != nil {
+		sendErrorResponse(response, http.StatusBadRequest, err)
+		return
+	}
+	sendResponse(util.ToString(result), http.StatusOK, response)
 }
 
-func validateAssetProvider(response http.ResponseWriter, request *http.Request) {
-	return
+type ProviderValidation struct {
+	Valid     bool                            `json:"valid"`
+	ExpiresAt time.Time                       `json:"expiresAt"`
+	Tenant    string                          `json:"tenant"`
+	TenantId  string                          `json:"tenantId"`
+	UserId    string                          `json:"userId"`
+	Regions   map[string]identity.ServiceURLs `json:"regions"`
 }
 
-func resourceStatus(response http.ResponseWriter, request *http.Request) {
-	resourceId := mux.Vars(request)["id"]
-	type Status struct {
-		Installed  bool
-		Configured bool
+/*
+ * Authenticates against keystone with the provider credentials and returns
+ * the token expiry, the tenant and the service catalog per region.
+ */
+func validateAssetProvider(response http.ResponseWriter, request *http.Request) {
+	assetProvider, err := extractAssetProvider(request.Header.Get("Authorization"))
+	if err != nil {
+		sendErrorResponse(response, providerErrorStatus(err), err)
+		return
 	}
-
-	var statusResponse struct {
-		Percentage   int                `json:"percentage"`
-		Status       string             `json:"status"`
-		ModuleStatus map[string]*Status `json:"moduleStatus"`
+	authDetails, err := provisioner.ValidateAssetProvider(assetProvider)
+	if err != nil {
+		log.Debugf("Asset provider %s failed to authenticate :%v", assetProvider.EndPointURL, err)
+		sendErrorResponse(response, http.StatusUnauthorized, err)
+		return
 	}
 
+	var validResponse ProviderValidation
+	validResponse.Valid = true
+	validResponse.ExpiresAt = authDetails.ExpiresAt
+	validResponse.Tenant = assetProvider.Tenant
+	validResponse.TenantId = authDetails.TenantId
+	validResponse.UserId = authDetails.UserId
+	validResponse.Regions = authDetails.RegionServiceURLs
+	sendResponse(util.ToString(validResponse), http.StatusOK, response)
+}
+
+type ModuleState struct {
+	Installed  bool
+	Configured bool
+}
+
+type ResourceStatus struct {
+	Percentage   int                     `json:"percentage"`
+	Status       string                  `json:"status"`
+	ModuleStatus map[string]*ModuleState `json:"moduleStatus"`
+}
+
+func resourceStatus(response http.ResponseWriter, request *http.Request) {
+	resourceId := mux.Vars(request)["id"]
+	var statusResponse ResourceStatus
 	conn, err := persistence.DefaultSession()
 	if err != nil {
 		log.Errorf("Error in getting connection :%v", err)
@@ -139,7 +311,7 @@ func resourceStatus(response http.ResponseWriter, request *http.Request) {
 		sendResponse("Resource not found", http.StatusNotFound, response)
 		return
 	}
-	statusResponse.ModuleStatus = make(map[string]*Status)
+	statusResponse.ModuleStatus = make(map[string]*ModuleState)
 	mpercent := 0
 	mCount := len(ar.Modules)
 	increment := 0
@@ -147,7 +319,7 @@ func resourceStatus(response http.ResponseWriter, request *http.Request) {
 		increment = 30 / mCount
 	}
 	for _, module := range ar.Modules {
-		status := &Status{Installed: module.Installed, Configured: module.Configured}
+		status := &ModuleState{Installed: module.Installed, Configured: module.Configured}
 		statusResponse.ModuleStatus[module.Name] = status
 		if status.Installed {
 			mpercent += increment
@@ -158,7 +330,7 @@ func resourceStatus(response http.ResponseWriter, request *http.Request) {
 	}
 	percent := 0
 	switch ar.Status {
-	case persistence.RequestNew:
+	case persistence.RequestNew, persistence.RequestRemediation:
 		percent = 0
 	case persistence.RequestBuild:
 		percent = 10
@@ -182,6 +354,71 @@ func resourceStatus(response http.ResponseWriter, request *http.Request) {
 	return
 }
 
+type ResourceActivation struct {
+	Id         string `json:"id"`
+	ResourceId string `json:"resourceId"`
+	Status     string `json:"status"`
+}
+
+/*
+ * Vertex calls back once the VCG of a resource is activated. The caller
+ * proves it owns the resource with the asset provider the request was made
+ * with, in the Authorization header. The activation itself is queued as a
+ * job, the request moves to FUL_FILLED once Vertex is told.
+ */
+func resourceActivated(response http.ResponseWriter, request *http.Request) {
+	resourceId := mux.Vars(request)["id"]
+	assetProvider, err := extractAssetProvider(request.Header.Get("Authorization"))
+	if err != nil {
+		sendErrorResponse(response, http.StatusUnauthorized, err)
+		return
+	}
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
+		return
+	}
+	defer conn.Close()
+
+	ar, err := conn.Find(bson.M{"resourceid": resourceId})
+	switch {
+	case err == mgo.ErrNotFound:
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Resource %s not found", resourceId))
+		return
+	case err != nil:
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	if !sameProvider(assetProvider, &ar.Provider) {
+		log.Warnf("[areq %s][res %s] Activation with the credentials of another asset provider", ar.Id, resourceId)
+		sendErrorResponse(response, http.StatusForbidden, fmt.Errorf("Resource %s belongs to another asset provider", resourceId))
+		return
+	}
+	switch {
+	case ar.Status == persistence.RequestFulfilled:
+		sendErrorResponse(response, http.StatusConflict, fmt.Errorf("Resource %s is already activated", resourceId))
+		return
+	case !persistence.CanTransition(ar.Status, persistence.RequestFulfilled):
+		sendErrorResponse(response, http.StatusConflict, fmt.Errorf("Resource %s can't be activated while %s", resourceId, ar.Status))
+		return
+	}
+
+	if err := provisioner.Enqueue(persistence.JobActivate, ar); err != nil {
+		sendQueueError(response, err)
+		return
+	}
+	log.Debugf("[areq %s][res %s] VCG activation queued", ar.Id, resourceId)
+	sendResponse(util.ToString(ResourceActivation{ar.Id, resourceId, ar.Status}), http.StatusAccepted, response)
+}
+
+func sameProvider(given, owner *persistence.AssetProvider) bool {
+	same := func(a, b string) bool {
+		return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+	}
+	return same(given.EndPointURL, owner.EndPointURL) && same(given.Tenant, owner.Tenant) &&
+		same(given.Username, owner.Username) && same(given.Password, owner.Password)
+}
+
 func sendErrorResponse(response http.ResponseWriter, errorCode int, err error) {
 	response.Header().Set("Content-Type", "application/json")
 	response.WriteHeader(errorCode)
@@ -189,6 +426,38 @@ func sendErrorResponse(response http.ResponseWriter, errorCode int, err error) {
 	response.Write([]byte(respMap.String()))
 }
 
+// 503 when the job queue is full, asking the caller to come back later
+func sendQueueError(response http.ResponseWriter, err error) {
+	if err == persistence.ErrQueueFull {
+		response.Header().Set("Retry-After", "30")
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	sendErrorResponse(response, http.StatusInternalServerError, err)
+}
+
+// 412 naming the resources of the tenant the request doesn't fit in
+func sendAdmissionError(response http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case provision.QuotaError:
+		respMap := util.Response{"error": err.Error(), "exhausted": e}
+		sendResponse(respMap.String(), http.StatusPreconditionFailed, response)
+	case provision.UnknownFlavor:
+		sendErrorResponse(response, http.StatusBadRequest, err)
+	default:
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("Unable to check the quota of the tenant: %v", err))
+	}
+}
+
+// Field level errors of a request that didn't pass validation
+func sendValidationError(response http.ResponseWriter, err error) {
+	respMap := util.Response{"error": err.Error()}
+	if errs, ok := err.(persistence.ValidationError); ok {
+		respMap["fields"] = errs
+	}
+	sendResponse(respMap.String(), http.StatusBadRequest, response)
+}
+
 func sendResponse(out string, responseCode int, response http.ResponseWriter) {
 	response.Header().Set("Content-Type", "application/json")
 	response.WriteHeader(responseCode)
@@ -201,25 +470,36 @@ func sendByteResponse(out []byte, responseCode int, response http.ResponseWriter
 	response.Write(out)
 }
 
+/*
+ * The Authorization header carries the asset provider as JSON sealed in an
+ * envelope (see package envelope). Plain base64 JSON is only accepted while
+ * allow-plaintext is set in [encyrption], to let callers migrate.
+ */
 func extractAssetProvider(encoded string) (*persistence.AssetProvider, error) {
-	decoded, _ := base64.StdEncoding.DecodeString(encoded)
-	log.Debugf("Asset Provider:%s", decoded)
-	// if decrypted, err := decryptAESCFB(encrypted); err == nil {
+	var decoded []byte
+	var err error
+	if envelope.IsEnvelope(encoded) {
+		if decoded, err = keyring.Open(encoded); err != nil {
+			log.Warnf("Rejected asset provider envelope :%v", err)
+			return nil, &credentialsError{err}
+		}
+	} else if allowPlaintext {
+		if decoded, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, &credentialsError{err}
+		}
+	} else {
+		return nil, &credentialsError{envelope.ErrMalformed}
+	}
 	assetProvider := new(persistence.AssetProvider)
-	util.ToObject([]byte(decoded), assetProvider)
+	if err := util.ToObject(decoded, assetProvider); err != nil {
+		return nil, &credentialsError{err}
+	}
 	return assetProvider, nil
 }
 
-//AES/ECB/PKCS5Padding
-func decryptAESCFB(src []byte) (string, error) {
-	key := util.GetString("encyrption", "secret")
-	var iv = []byte(key)[:aes.BlockSize] // Using IV same as key is probably bad
-	aesBlockDecrypter, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return "", err
+func providerErrorStatus(err error) int {
+	if _, ok := err.(*credentialsError); ok {
+		return http.StatusUnauthorized
 	}
-	decrypted := make([]byte, 1024)
-	aesDecrypter := cipher.NewCFBDecrypter(aesBlockDecrypter, iv)
-	aesDecrypter.XORKeyStream(decrypted, src)
-	return string(decrypted), nil
+	return http.StatusBadGateway
 }
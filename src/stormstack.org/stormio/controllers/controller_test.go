@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
+	. "launchpad.net/gocheck"
+	"launchpad.net/goose/identity"
+	"launchpad.net/goose/testservices/openstackservice"
+	"net/http"
+	"net/http/httptest"
+	"stormstack.org/stormio/conf"
+	"stormstack.org/stormio/events"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/provision"
+	"stormstack.org/stormio/scheduler"
+	"stormstack.org/stormio/util"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+const testJobs = "JobsControllerTest"
+
+/*
+ * ControllerSuite serves the routes against Mongo on localhost, the jobs
+ * going to a queue of their own, and an OpenStack double for the asset
+ * provider. The tests of every file of the package are its own.
+ */
+type ControllerSuite struct {
+	saved    *conf.ConfigFile
+	session  *mgo.Session
+	cloud    *httptest.Server
+	provider persistence.AssetProvider
+	conn     *persistence.Connection
+	router   *mux.Router
+	created  []string
+}
+
+var _ = Suite(&ControllerSuite{})
+
+func (s *ControllerSuite) SetUpSuite(c *C) {
+	session, err := mgo.DialWithTimeout("localhost:27017", time.Second)
+	if err != nil {
+		c.Skip("no mongo to serve the requests from: " + err.Error())
+	}
+	s.session = session
+	s.saved = util.Config
+	util.Config, _ = conf.ReadConfigBytes([]byte("[database]\nhost=localhost\nport=27017\n" +
+		"[encyrption]\nallow-plaintext=true\n[external]\nvertex-url=http://127.0.0.1:1\n"))
+	initKeyring()
+	queue, err := persistence.OpenQueue(testJobs)
+	c.Assert(err, IsNil)
+	provisioner = &scheduler.Provisioner{Queue: queue, Events: events.NewHub(), States: persistence.NewStateMachine()}
+	c.Assert(persistence.EnsureIndexes(), IsNil)
+	s.conn, err = persistence.DefaultSession()
+	c.Assert(err, IsNil)
+
+	cloud := http.NewServeMux()
+	s.cloud = httptest.NewServer(cloud)
+	creds := &identity.Credentials{URL: s.cloud.URL, User: "fred", Secrets: "secret", Region: "r1", TenantName: "t1"}
+	openstackservice.New(creds).SetupHTTP(cloud)
+	// missing from the nova double, the quota of the tenant is unlimited
+	cloud.HandleFunc("/v2/1/limits", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"limits": {"absolute": {"maxTotalInstances": -1, "maxTotalCores": -1, "maxTotalRAMSize": -1}}}`))
+	})
+	s.provider = persistence.AssetProvider{EndPointURL: s.cloud.URL, Username: "fred", Password: "secret",
+		Tenant: "t1", RegionName: "r1"}
+
+	s.router = mux.NewRouter()
+	initAssetRoutes("", s.router)
+	initResourceMappings("", s.router)
+	initAssetProviderMappings("", s.router)
+}
+
+func (s *ControllerSuite) TearDownSuite(c *C) {
+	if s.session == nil {
+		return
+	}
+	s.cloud.Close()
+	s.conn.Close()
+	provisioner.Queue.Close()
+	provisioner = nil
+	s.session.Close()
+	util.Config = s.saved
+}
+
+func (s *ControllerSuite) SetUpTest(c *C) {
+	s.session.DB(persistence.Database).C(testJobs).DropCollection()
+}
+
+func (s *ControllerSuite) TearDownTest(c *C) {
+	for _, id := range s.created {
+		s.conn.Remove(id)
+	}
+	s.created = nil
+}
+
+// Serves the request, the body as JSON
+func (s *ControllerSuite) serve(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, path, strings.NewReader(body))
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	response := httptest.NewRecorder()
+	s.router.ServeHTTP(response, request)
+	return response
+}
+
+// The Authorization header of the asset provider, plain as allowed
+func authorization(provider persistence.AssetProvider) http.Header {
+	return http.Header{"Authorization": {base64.StdEncoding.EncodeToString([]byte(util.ToString(provider)))}}
+}
+
+// A request of the asset provider of the suite saved in status, removed at the end of the test
+func (s *ControllerSuite) request(c *C, status string) *persistence.AssetRequest {
+	ar := &persistence.AssetRequest{Id: persistence.NewUUID(), ResourceId: persistence.NewUUID(), HostName: "vcg",
+		ServerId: "s1", IpAddress: "10.0.0.7", Provider: s.provider, Status: status, ReceivedOn: persistence.Now(),
+		StatusChangedOn: persistence.Now()}
+	c.Assert(s.conn.Create(ar), IsNil)
+	s.created = append(s.created, ar.Id)
+	return ar
+}
+
+// ProviderSuite checks the asset provider routes against an OpenStack double, no Mongo needed
+type ProviderSuite struct {
+	cloud    *httptest.Server
+	provider persistence.AssetProvider
+	router   *mux.Router
+	plain    bool
+}
+
+var _ = Suite(&ProviderSuite{})
+
+func (s *ProviderSuite) SetUpSuite(c *C) {
+	cloud := http.NewServeMux()
+	s.cloud = httptest.NewServer(cloud)
+	creds := &identity.Credentials{URL: s.cloud.URL, User: "fred", Secrets: "secret", Region: "r1", TenantName: "t1"}
+	openstackservice.New(creds).SetupHTTP(cloud)
+	s.provider = persistence.AssetProvider{EndPointURL: s.cloud.URL, Username: "fred", Password: "secret",
+		Tenant: "t1", RegionName: "r1"}
+	s.router = mux.NewRouter()
+	initAssetProviderMappings("", s.router)
+	s.plain, allowPlaintext = allowPlaintext, true
+}
+
+func (s *ProviderSuite) TearDownSuite(c *C) {
+	allowPlaintext = s.plain
+	s.cloud.Close()
+}
+
+func (s *ProviderSuite) serve(path string, header http.Header) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest("POST", path, nil)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	response := httptest.NewRecorder()
+	s.router.ServeHTTP(response, request)
+	return response
+}
+
+func (s *ProviderSuite) TestValidateAssetProvider(c *C) {
+	response := s.serve("/assetprovider/validate", authorization(s.provider))
+	c.Assert(response.Code, Equals, http.StatusOK)
+	var validation ProviderValidation
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &validation), IsNil)
+	c.Assert(validation.Valid, Equals, true)
+	c.Assert(validation.Tenant, Equals, "t1")
+	c.Assert(validation.TenantId, Not(Equals), "")
+	c.Assert(validation.Regions["r1"]["compute"], Not(Equals), "")
+
+	other := s.provider
+	other.Password = "guessed"
+	c.Assert(s.serve("/assetprovider/validate", authorization(other)).Code, Equals, http.StatusUnauthorized)
+	c.Assert(s.serve("/assetprovider/validate", http.Header{"Authorization": {"not base64"}}).Code,
+		Equals, http.StatusUnauthorized)
+}
+
+func (s *ProviderSuite) TestValidateProvidersService(c *C) {
+	response := s.serve("/assetprovider/service/compute/test", authorization(s.provider))
+	c.Assert(response.Code, Equals, http.StatusOK)
+	var result provision.ProbeResult
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &result), IsNil)
+	c.Assert(result.Ok, Equals, true)
+	c.Assert(result.Service, Equals, "compute")
+
+	// the probe failing is still an answer
+	response = s.serve("/assetprovider/service/image/test", authorization(s.provider))
+	c.Assert(response.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &result), IsNil)
+	c.Assert(result.Ok, Equals, false)
+	c.Assert(result.Error, Not(Equals), "")
+
+	c.Assert(s.serve("/assetprovider/service/dns/test", authorization(s.provider)).Code, Equals, http.StatusNotFound)
+	c.Assert(s.serve("/assetprovider/service/compute/test", nil).Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *ProviderSuite) TestSameProvider(c *C) {
+	owner := persistence.AssetProvider{EndPointURL: "http://keystone:5000/v2.0", Tenant: "t1", Username: "fred",
+		Password: "secret", RegionName: "r1"}
+	given := owner
+	c.Assert(sameProvider(&given, &owner), Equals, true)
+	// the region and the service URLs don't identify the caller
+	given.RegionName, given.Compute = "r2", "http://nova:8774"
+	c.Assert(sameProvider(&given, &owner), Equals, true)
+	for _, change := range []func(*persistence.AssetProvider){
+		func(p *persistence.AssetProvider) { p.EndPointURL = "http://other:5000/v2.0" },
+		func(p *persistence.AssetProvider) { p.Tenant = "t2" },
+		func(p *persistence.AssetProvider) { p.Username = "barney" },
+		func(p *persistence.AssetProvider) { p.Password = "secret2" },
+		func(p *persistence.AssetProvider) { p.Password = "" },
+	} {
+		given := owner
+		change(&given)
+		c.Check(sameProvider(&given, &owner), Equals, false, Commentf("%+v", given))
+	}
+}
+
+func (s *ControllerSuite) TestResourceActivated(c *C) {
+	ar := s.request(c, persistence.RequestHalfFilled)
+	path := "/resource/" + ar.ResourceId + "/activated"
+
+	c.Assert(s.serve("PUT", path, "", nil).Code, Equals, http.StatusUnauthorized)
+	other := s.provider
+	other.Password = "guessed"
+	c.Assert(s.serve("PUT", path, "", authorization(other)).Code, Equals, http.StatusForbidden)
+	c.Assert(s.serve("PUT", "/resource/unknown/activated", "", authorization(s.provider)).Code, Equals, http.StatusNotFound)
+	job, err := provisioner.Queue.Claim("test", persistence.JobActivate)
+	c.Assert(err, IsNil)
+	c.Assert(job, IsNil)
+
+	response := s.serve("PUT", path, "", authorization(s.provider))
+	c.Assert(response.Code, Equals, http.StatusAccepted)
+	var activation ResourceActivation
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &activation), IsNil)
+	c.Assert(activation, DeepEquals, ResourceActivation{ar.Id, ar.ResourceId, persistence.RequestHalfFilled})
+	job, err = provisioner.Queue.Claim("test", persistence.JobActivate)
+	c.Assert(err, IsNil)
+	c.Assert(job.AssetId, Equals, ar.Id)
+	c.Assert(job.ResourceId, Equals, ar.ResourceId)
+
+	ar = s.request(c, persistence.RequestFulfilled)
+	c.Assert(s.serve("PUT", "/resource/"+ar.ResourceId+"/activated", "", authorization(s.provider)).Code,
+		Equals, http.StatusConflict)
+	ar = s.request(c, persistence.RequestMarkDeletion)
+	c.Assert(s.serve("PUT", "/resource/"+ar.ResourceId+"/activated", "", authorization(s.provider)).Code,
+		Equals, http.StatusConflict)
+}
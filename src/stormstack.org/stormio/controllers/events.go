@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"stormstack.org/stormio/events"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/util"
+	"time"
+)
+
+const heartbeatInterval = 15 * time.Second
+
+/*
+ * Streams the status transitions of one asset request as server sent
+ * events. The current status is sent first, so a client connecting late
+ * doesn't have to fetch it separately.
+ */
+func assetEvents(response http.ResponseWriter, request *http.Request) {
+	assetId := mux.Vars(request)["id"]
+	// before reading the status, a transition meanwhile is sent after it
+	sub := provisioner.Events.Subscribe(assetId)
+	defer provisioner.Events.Unsubscribe(sub)
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, fmt.Errorf("DB connection failure"))
+		return
+	}
+	ar, err := conn.Find(bson.M{"_id": assetId})
+	conn.Close()
+	if err != nil {
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("Asset %s not found", assetId))
+		return
+	}
+	streamEvents(response, request, assetId, sub, events.FromAsset(events.TypeStatus, ar))
+}
+
+// Firehose of the transitions of every asset request
+func allEvents(response http.ResponseWriter, request *http.Request) {
+	sub := provisioner.Events.Subscribe("")
+	defer provisioner.Events.Unsubscribe(sub)
+	streamEvents(response, request, "", sub, nil)
+}
+
+// Sends current, if any, then what comes on sub until the client leaves
+func streamEvents(response http.ResponseWriter, request *http.Request, assetId string, sub *events.Subscription,
+	current *events.Event) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		sendErrorResponse(response, http.StatusInternalServerError, fmt.Errorf("Streaming not supported"))
+		return
+	}
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Connection", "keep-alive")
+	response.WriteHeader(http.StatusOK)
+	if current != nil {
+		writeEvent(response, current)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, open := <-sub.C:
+			if !open {
+				return
+			}
+			writeEvent(response, event)
+			// the stream of one request ends with its deletion
+			if assetId != "" && event.Type == events.TypeDeleted {
+				flusher.Flush()
+				return
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(response, ": keep-alive\n\n")
+		case <-request.Context().Done():
+			log.Debugf("[areq %s] Event stream closed by the client, %d events dropped", assetId, sub.Dropped())
+			return
+		case <-stopping:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(response http.ResponseWriter, event *events.Event) {
+	if event.Seq > 0 {
+		fmt.Fprintf(response, "id: %d\n", event.Seq)
+	}
+	fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event.Type, util.ToString(event))
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"stormstack.org/stormio/events"
+	"stormstack.org/stormio/persistence"
+	"strings"
+)
+
+type EventsSuite struct{}
+
+var _ = Suite(&EventsSuite{})
+
+func (s *EventsSuite) TestStreamEvents(c *C) {
+	hub := events.NewHub()
+	sub := hub.Subscribe("a1")
+	defer hub.Unsubscribe(sub)
+	// moved on while the current status was read, then deleted
+	hub.Publish(&events.Event{Type: events.TypeStatus, AssetId: "a1", Status: persistence.RequestBuild})
+	hub.Publish(&events.Event{Type: events.TypeStatus, AssetId: "a2", Status: persistence.RequestFail})
+	hub.Publish(&events.Event{Type: events.TypeDeleted, AssetId: "a1", Status: persistence.RequestMarkDeletion})
+
+	request, _ := http.NewRequest("GET", "/tasks/a1/events", nil)
+	response := httptest.NewRecorder()
+	current := &events.Event{Type: events.TypeStatus, AssetId: "a1", Status: persistence.RequestNew}
+	streamEvents(response, request, "a1", sub, current)
+
+	c.Assert(response.Header().Get("Content-Type"), Equals, "text/event-stream")
+	var statuses []string
+	for _, line := range strings.Split(response.Body.String(), "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			statuses = append(statuses, strings.SplitN(strings.SplitN(line, `"status":"`, 2)[1], `"`, 2)[0])
+		}
+	}
+	c.Assert(statuses, DeepEquals, []string{persistence.RequestNew, persistence.RequestBuild, persistence.RequestMarkDeletion})
+}
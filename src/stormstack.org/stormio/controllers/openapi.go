@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"reflect"
+	"regexp"
+	"stormstack.org/stormio/events"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/provision"
+	"stormstack.org/stormio/scheduler"
+	"stormstack.org/stormio/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The OpenAPI document is generated at start up: the paths come from the
+ * routes registered on the router and the schemas from the Go types, with
+ * the json and valid tags the requests are checked against. apiDocs only
+ * adds what can't be read off the code, keyed by method and path relative
+ * to the context path.
+ */
+
+type apiParam struct {
+	Name        string
+	In          string // query or header
+	Description string
+	Required    bool
+}
+
+type apiOperation struct {
+	Summary  string
+	Request  interface{}
+	Response interface{}
+	Status   int
+	Stream   bool // text/event-stream of Response
+	Params   []apiParam
+}
+
+var (
+	providerAuth = apiParam{"Authorization", "header", "Asset provider sealed in an envelope", true}
+
+	apiDocs = map[string]apiOperation{
+		"POST /createAsset": {Summary: "Create an asset request, with a count above one an AssetGroup of that many, one per resource. 412 names the quotas of the tenant it exceeds",
+			Request: persistence.AssetRequest{}, Response: persistence.AssetRequest{}, Status: http.StatusAccepted,
+			Params: []apiParam{{"Idempotency-Key", "header", "Replays the original answer when the create is retried", false}}},
+		"POST /deleteAsset": {Summary: "Delete an asset request, same as DELETE /tasks/{id}", Request: AssetDestroy{},
+			Status: http.StatusAccepted},
+		"GET /tasks": {Summary: "List asset requests", Response: AssetPage{}, Status: http.StatusOK,
+			Params: []apiParam{
+				{"status", "query", "Comma separated statuses", false},
+				{"resource", "query", "Resource id", false},
+				{"hostName", "query", "Host name", false},
+				{"group", "query", "Group the asset requests are members of", false},
+				{"provider", "query", "Asset provider endpoint", false},
+				{"receivedAfter", "query", "RFC3339 timestamp, inclusive", false},
+				{"receivedBefore", "query", "RFC3339 timestamp, exclusive", false},
+				{"sort", "query", "id, receivedOn, status, hostName or resource, prefixed with - for descending", false},
+				{"limit", "query", "Page size", false},
+				{"cursor", "query", "Cursor returned as next by the previous page", false},
+			}},
+		"GET /tasks/{id}":    {Summary: "Get an asset request", Response: persistence.AssetRequest{}, Status: http.StatusOK},
+		"PATCH /tasks/{id}":  {Summary: "Rename the server of an asset request", Request: AssetRename{}, Response: persistence.AssetRequest{}, Status: http.StatusOK},
+		"DELETE /tasks/{id}": {Summary: "Delete an asset request", Status: http.StatusAccepted},
+		"GET /tasks/{id}/events": {Summary: "Stream the status transitions of an asset request", Response: events.Event{},
+			Status: http.StatusOK, Stream: true},
+		"GET /tasks/{id}/timeline": {Summary: "Steps the server of an asset request went through, with their timings and errors",
+			Response: AssetTimeline{}, Status: http.StatusOK},
+		"POST /tasks/{id}/remediate": {Summary: "Rebuild the server of an asset request keeping its floating ip",
+			Response: AssetRemediation{}, Status: http.StatusAccepted},
+		"PUT /tasks/{id}/priority": {Summary: "Override the priority of the create of an asset request and its retries",
+			Request: AssetPriority{}, Response: persistence.AssetRequest{}, Status: http.StatusOK},
+		"PUT /tasks/{id}/lease": {Summary: "Set or extend the expiry after which an asset request is deleted",
+			Request: AssetLease{}, Response: persistence.AssetRequest{}, Status: http.StatusOK},
+		"GET /groups/{id}":          {Summary: "Get the members of a group and their aggregate status", Response: persistence.AssetGroup{}, Status: http.StatusOK},
+		"DELETE /groups/{id}":       {Summary: "Delete every member of a group", Response: persistence.AssetGroup{}, Status: http.StatusAccepted},
+		"GET /events":               {Summary: "Stream the status transitions of every asset request", Response: events.Event{}, Status: http.StatusOK, Stream: true},
+		"GET /resource/{id}/status": {Summary: "Provisioning progress of a resource", Response: ResourceStatus{}, Status: http.StatusOK},
+		"PUT /resource/{id}/activated": {Summary: "VCG of a resource is activated, fulfils its asset request",
+			Response: ResourceActivation{}, Status: http.StatusAccepted,
+			Params: []apiParam{{"Authorization", "header", "Asset provider the resource was requested with, sealed in an envelope", true}}},
+		"GET /assetprovider/image": {Summary: "Image names by id", Response: map[string]string{}, Status: http.StatusOK,
+			Params: []apiParam{providerAuth}},
+		"GET /assetprovider/flavor": {Summary: "Flavor names by id", Response: map[string]string{}, Status: http.StatusOK,
+			Params: []apiParam{providerAuth}},
+		"POST /assetprovider/image/upload": {Summary: "Upload an image to glance", Status: http.StatusOK,
+			Params: []apiParam{providerAuth}},
+		"POST /assetprovider/validate": {Summary: "Authenticate the asset provider", Response: ProviderValidation{},
+			Status: http.StatusOK, Params: []apiParam{providerAuth}},
+		"POST /assetprovider/service/{name}/test": {Summary: "Probe compute, image, network or object-store",
+			Response: provision.ProbeResult{}, Status: http.StatusOK, Params: []apiParam{providerAuth}},
+		"GET /reconciliation": {Summary: "Orphan servers and ghost asset requests found by the last reconciliation",
+			Response: scheduler.Reconciliation{}, Status: http.StatusOK},
+		"POST /reconciliation": {Summary: "Reconcile the asset requests with the servers now, without fixing",
+			Response: scheduler.Reconciliation{}, Status: http.StatusOK},
+		"GET /callbacks": {Summary: "List the callbacks to the caller not delivered yet", Response: CallbackPage{},
+			Status: http.StatusOK, Params: []apiParam{
+				{"status", "query", "PENDING or DEAD_LETTER, DEAD_LETTER by default", false},
+				{"kind", "query", "attach, detach or activate", false},
+				{"asset", "query", "Asset request id", false},
+				{"limit", "query", "At most that many, 100 by default", false},
+			}},
+		"GET /callbacks/{id}":         {Summary: "Get a callback not delivered yet", Response: persistence.Callback{}, Status: http.StatusOK},
+		"POST /callbacks/{id}/replay": {Summary: "Deliver a dead letter callback again", Response: persistence.Callback{}, Status: http.StatusAccepted},
+		"GET /openapi.json":           {Summary: "This document", Status: http.StatusOK},
+	}
+
+	pathParam = regexp.MustCompile(`{([^}:]+)(:[^}]+)?}`)
+	openAPI   string
+)
+
+func initOpenAPIMapping(contextPath string, router *mux.Router) {
+	router.HandleFunc(contextPath+"/openapi.json", openAPIDocument).Methods("GET")
+}
+
+func openAPIDocument(response http.ResponseWriter, request *http.Request) {
+	sendResponse(openAPI, http.StatusOK, response)
+}
+
+// Called once every route is registered
+func buildOpenAPI(contextPath string, router *mux.Router) {
+	gen := &schemaGen{components: make(util.Response)}
+	paths := make(util.Response)
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := strings.TrimPrefix(template, contextPath)
+		item, ok := paths[pathParam.ReplaceAllString(path, "{$1}")].(util.Response)
+		if !ok {
+			item = make(util.Response)
+			paths[pathParam.ReplaceAllString(path, "{$1}")] = item
+		}
+		for _, method := range methods {
+			item[strings.ToLower(method)] = gen.operation(method, path)
+		}
+		return nil
+	})
+	openAPI = util.Response{
+		"openapi": "3.0.3",
+		"info": util.Response{
+			"title":   util.GetString("application", "name"),
+			"version": "1",
+		},
+		"servers":    []util.Response{{"url": contextPath}},
+		"paths":      paths,
+		"components": util.Response{"schemas": gen.components},
+	}.String()
+}
+
+func (gen *schemaGen) operation(method, path string) util.Response {
+	key := method + " " + pathParam.ReplaceAllString(path, "{$1}")
+	doc, found := apiDocs[key]
+	if !found {
+		doc = apiOperation{Summary: key, Status: http.StatusOK}
+	}
+	op := util.Response{"summary": doc.Summary}
+
+	var params []util.Response
+	for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+		params = append(params, util.Response{"name": match[1], "in": "path", "required": true,
+			"schema": util.Response{"type": "string"}})
+	}
+	for _, param := range doc.Params {
+		params = append(params, util.Response{"name": param.Name, "in": param.In, "required": param.Required,
+			"description": param.Description, "schema": util.Response{"type": "string"}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if doc.Request != nil {
+		op["requestBody"] = util.Response{"required": true, "content": util.Response{
+			"application/json": util.Response{"schema": gen.schema(reflect.TypeOf(doc.Request))}}}
+	}
+
+	success := util.Response{"description": http.StatusText(doc.Status)}
+	if doc.Response != nil {
+		mediaType := "application/json"
+		if doc.Stream {
+			mediaType = "text/event-stream"
+		}
+		success["content"] = util.Response{mediaType: util.Response{"schema": gen.schema(reflect.TypeOf(doc.Response))}}
+	}
+	errorResponse := util.Response{"description": "Error", "content": util.Response{
+		"application/json": util.Response{"schema": gen.schema(reflect.TypeOf(apiError{}))}}}
+	op["responses"] = util.Response{strconv.Itoa(doc.Status): success, "default": errorResponse}
+	return op
+}
+
+// What sendErrorResponse and sendValidationError answer
+type apiError struct {
+	Error  string                      `json:"error"`
+	Fields persistence.ValidationError `json:"fields,omitempty"`
+}
+
+type schemaGen struct {
+	components util.Response
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (gen *schemaGen) schema(t reflect.Type) util.Response {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return util.Response{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, found := gen.components[t.Name()]; !found {
+			gen.components[t.Name()] = util.Response{} // guards recursive types
+			gen.components[t.Name()] = gen.object(t)
+		}
+		return util.Response{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Struct:
+		return gen.object(t)
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return util.Response{"type": "string", "format": "byte"}
+		}
+		return util.Response{"type": "array", "items": gen.schema(t.Elem())}
+	case reflect.Map:
+		return util.Response{"type": "object", "additionalProperties": gen.schema(t.Elem())}
+	case reflect.String:
+		return util.Response{"type": "string"}
+	case reflect.Bool:
+		return util.Response{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return util.Response{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return util.Response{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return util.Response{"type": "number"}
+	}
+	return util.Response{}
+}
+
+func (gen *schemaGen) object(t reflect.Type) util.Response {
+	properties := make(util.Response)
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := persistence.JSONName(field)
+		if name == "" || field.PkgPath != "" {
+			continue
+		}
+		property := gen.schema(field.Type)
+		rules := persistence.Rules(field)
+		if rules["required"] {
+			required = append(required, name)
+		}
+		if rules["url"] {
+			property["format"] = "uri"
+		}
+		if rules["hostname"] {
+			property["format"] = "hostname"
+		}
+		if rules["port"] {
+			port := property
+			if items, ok := property["items"].(util.Response); ok {
+				port = items
+			}
+			port["minimum"], port["maximum"] = 0, 65535
+		}
+		properties[name] = property
+	}
+	object := util.Response{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
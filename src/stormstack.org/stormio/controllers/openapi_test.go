@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"stormstack.org/stormio/conf"
+	"stormstack.org/stormio/util"
+	"strings"
+)
+
+type OpenAPISuite struct {
+	saved *conf.ConfigFile
+}
+
+var _ = Suite(&OpenAPISuite{})
+
+func (s *OpenAPISuite) SetUpSuite(c *C) {
+	s.saved = util.Config
+	util.Config, _ = conf.ReadConfigBytes([]byte("[application]\nname=stormio\n"))
+}
+
+func (s *OpenAPISuite) TearDownSuite(c *C) {
+	util.Config = s.saved
+}
+
+type openAPIDoc struct {
+	Servers []struct {
+		Url string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]map[string]interface{} `json:"schemas"`
+	} `json:"components"`
+}
+
+func (s *OpenAPISuite) TestEveryRouteDocumented(c *C) {
+	router := initRoutes("/stormio")
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/stormio/openapi.json", nil)
+	router.ServeHTTP(response, request)
+	c.Assert(response.Code, Equals, http.StatusOK)
+	var doc openAPIDoc
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &doc), IsNil)
+	c.Assert(doc.Servers, HasLen, 1)
+	c.Assert(doc.Servers[0].Url, Equals, "/stormio")
+
+	routes := make(map[string]bool)
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := pathParam.ReplaceAllString(strings.TrimPrefix(template, "/stormio"), "{$1}")
+		for _, method := range methods {
+			routes[method+" "+path] = true
+			op, found := doc.Paths[path][strings.ToLower(method)]
+			if !c.Check(found, Equals, true, Commentf("%s %s", method, path)) {
+				continue
+			}
+			// a summary of its own, not the route that stands in for a missing one
+			c.Check(op["summary"], Not(Equals), method+" "+path)
+		}
+		return nil
+	})
+	c.Assert(len(routes) > 0, Equals, true)
+	for key := range apiDocs {
+		c.Check(routes[key], Equals, true, Commentf("documented but not served: %s", key))
+	}
+}
+
+func (s *OpenAPISuite) TestSchemaRules(c *C) {
+	initRoutes("")
+	var doc openAPIDoc
+	c.Assert(json.Unmarshal([]byte(openAPI), &doc), IsNil)
+
+	provider := doc.Components.Schemas["AssetProvider"]
+	c.Assert(provider, NotNil)
+	c.Assert(provider["required"], DeepEquals, []interface{}{"username", "password", "endPoint", "tenant"})
+	properties := provider["properties"].(map[string]interface{})
+	c.Assert(properties["endPoint"].(map[string]interface{})["format"], Equals, "uri")
+
+	bolt := doc.Components.Schemas["StormBolt"]["properties"].(map[string]interface{})
+	ports := bolt["allowedPorts"].(map[string]interface{})
+	c.Assert(ports["type"], Equals, "array")
+	items := ports["items"].(map[string]interface{})
+	c.Assert(items["minimum"], Equals, float64(0))
+	c.Assert(items["maximum"], Equals, float64(65535))
+}
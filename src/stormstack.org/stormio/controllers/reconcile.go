@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"stormstack.org/stormio/util"
+)
+
+// The drift between the asset requests and the servers of the asset providers
+func initReconcileRoutes(contextPath string, router *mux.Router) {
+	router.HandleFunc(contextPath+"/reconciliation", retrieveReconciliation).Methods("GET")
+	router.HandleFunc(contextPath+"/reconciliation", reconcile).Methods("POST")
+}
+
+// The report of the last pass of this stormio
+func retrieveReconciliation(response http.ResponseWriter, request *http.Request) {
+	report := provisioner.LastReconciliation()
+	if report == nil {
+		sendErrorResponse(response, http.StatusNotFound, fmt.Errorf("No reconciliation ran yet"))
+		return
+	}
+	sendResponse(util.ToString(report), http.StatusOK, response)
+}
+
+// Reconciles now, reporting only, the fixes are left to the passes of the leader
+func reconcile(response http.ResponseWriter, request *http.Request) {
+	report, err := provisioner.Reconcile(false)
+	if err != nil {
+		sendErrorResponse(response, http.StatusServiceUnavailable, err)
+		return
+	}
+	sendResponse(util.ToString(report), http.StatusOK, response)
+}
@@ -0,0 +1,164 @@
+/*
+ * Package envelope seals and opens the secrets exchanged with Vertex.
+ *
+ * An envelope is "v1.<key id>.<base64url(nonce | ciphertext)>", sealed with
+ * AES-GCM. The version and the key id are authenticated along with the
+ * payload, so neither can be swapped without failing to open. Several keys
+ * can be loaded at once, which lets the sender move to a new key while
+ * envelopes sealed with the old one are still in flight.
+ */
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"stormstack.org/stormio/conf"
+	"strings"
+	"sync"
+)
+
+const (
+	Version   = "v1"
+	keyPrefix = "key."
+)
+
+var (
+	ErrMalformed      = errors.New("envelope: malformed envelope")
+	ErrUnknownKey     = errors.New("envelope: unknown key id")
+	ErrAuthentication = errors.New("envelope: message authentication failed")
+	ErrNoActiveKey    = errors.New("envelope: no active key to seal with")
+)
+
+type Keyring struct {
+	sync.RWMutex
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]cipher.AEAD)}
+}
+
+/*
+ * LoadKeyring reads every key.<id> option of the section, base64 encoded
+ * 16, 24 or 32 byte AES keys, and the active-key option naming the one to
+ * seal with.
+ *
+ *	[encyrption]
+ *	active-key=2014b
+ *	key.2014a=...
+ *	key.2014b=...
+ */
+func LoadKeyring(c *conf.ConfigFile, section string) (*Keyring, error) {
+	options, err := c.GetOptions(section)
+	if err != nil {
+		return nil, err
+	}
+	kr := NewKeyring()
+	for _, option := range options {
+		if !strings.HasPrefix(option, keyPrefix) {
+			continue
+		}
+		value, _ := c.GetString(section, option)
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("envelope: %s is not base64 encoded", option)
+		}
+		if err := kr.Add(strings.TrimPrefix(option, keyPrefix), key); err != nil {
+			return nil, err
+		}
+	}
+	if active, err := c.GetString(section, "active-key"); err == nil {
+		if err := kr.SetActive(active); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) Add(id string, key []byte) error {
+	id = strings.ToLower(id)
+	if id == "" || strings.Contains(id, ".") {
+		return fmt.Errorf("envelope: invalid key id %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("envelope: key %s: %v", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	kr.keys[id] = aead
+	return nil
+}
+
+func (kr *Keyring) SetActive(id string) error {
+	id = strings.ToLower(id)
+	kr.Lock()
+	defer kr.Unlock()
+	if _, ok := kr.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+	kr.active = id
+	return nil
+}
+
+func (kr *Keyring) Len() int {
+	kr.RLock()
+	defer kr.RUnlock()
+	return len(kr.keys)
+}
+
+// Seal encrypts the plaintext with the active key.
+func (kr *Keyring) Seal(plaintext []byte) (string, error) {
+	kr.RLock()
+	id := kr.active
+	aead, ok := kr.keys[id]
+	kr.RUnlock()
+	if !ok {
+		return "", ErrNoActiveKey
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	header := Version + "." + id
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(header))
+	return header + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open authenticates and decrypts an envelope sealed with any loaded key.
+func (kr *Keyring) Open(envelope string) ([]byte, error) {
+	parts := strings.Split(strings.TrimSpace(envelope), ".")
+	if len(parts) != 3 || parts[0] != Version {
+		return nil, ErrMalformed
+	}
+	kr.RLock()
+	aead, ok := kr.keys[strings.ToLower(parts[1])]
+	kr.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil || len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(parts[0]+"."+parts[1]))
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return plaintext, nil
+}
+
+func IsEnvelope(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), Version+".")
+}
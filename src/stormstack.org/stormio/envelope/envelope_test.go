@@ -0,0 +1,86 @@
+package envelope
+
+import (
+	"encoding/base64"
+	. "launchpad.net/gocheck"
+	"stormstack.org/stormio/conf"
+	"strings"
+	"testing"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type EnvelopeSuite struct{}
+
+var _ = Suite(&EnvelopeSuite{})
+
+var (
+	oldKey = []byte("0123456789abcdef0123456789abcdef")
+	newKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func keyring(c *C) *Keyring {
+	kr := NewKeyring()
+	c.Assert(kr.Add("old", oldKey), IsNil)
+	c.Assert(kr.Add("new", newKey), IsNil)
+	c.Assert(kr.SetActive("new"), IsNil)
+	return kr
+}
+
+func (s *EnvelopeSuite) TestSealOpen(c *C) {
+	kr := keyring(c)
+	sealed, err := kr.Seal([]byte(`{"username":"admin"}`))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(sealed, "v1.new."), Equals, true)
+	opened, err := kr.Open(sealed)
+	c.Assert(err, IsNil)
+	c.Assert(string(opened), Equals, `{"username":"admin"}`)
+}
+
+func (s *EnvelopeSuite) TestOpenWithRotatedKey(c *C) {
+	kr := keyring(c)
+	c.Assert(kr.SetActive("old"), IsNil)
+	sealed, err := kr.Seal([]byte("secret"))
+	c.Assert(err, IsNil)
+	c.Assert(kr.SetActive("new"), IsNil)
+	opened, err := kr.Open(sealed)
+	c.Assert(err, IsNil)
+	c.Assert(string(opened), Equals, "secret")
+}
+
+func (s *EnvelopeSuite) TestTamperedEnvelope(c *C) {
+	kr := keyring(c)
+	sealed, _ := kr.Seal([]byte("secret"))
+	parts := strings.Split(sealed, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	payload[len(payload)-1] ^= 1
+	_, err := kr.Open(parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(payload))
+	c.Assert(err, Equals, ErrAuthentication)
+
+	// swapping the key id is caught by the additional data as well
+	_, err = kr.Open("v1.old." + parts[2])
+	c.Assert(err, Equals, ErrAuthentication)
+}
+
+func (s *EnvelopeSuite) TestRejected(c *C) {
+	kr := keyring(c)
+	_, err := kr.Open(base64.StdEncoding.EncodeToString([]byte(`{"password":"plain"}`)))
+	c.Assert(err, Equals, ErrMalformed)
+	_, err = kr.Open("v1.gone.AAAA")
+	c.Assert(err, Equals, ErrUnknownKey)
+	_, err = kr.Open("v1.new.AAAA")
+	c.Assert(err, Equals, ErrMalformed)
+}
+
+func (s *EnvelopeSuite) TestLoadKeyring(c *C) {
+	cfg, err := conf.ReadConfigBytes([]byte("[encyrption]\nactive-key=new\nkey.old=" +
+		base64.StdEncoding.EncodeToString(oldKey) + "\nkey.new=" + base64.StdEncoding.EncodeToString(newKey) + "\n"))
+	c.Assert(err, IsNil)
+	kr, err := LoadKeyring(cfg, "encyrption")
+	c.Assert(err, IsNil)
+	c.Assert(kr.Len(), Equals, 2)
+	sealed, err := kr.Seal([]byte("secret"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(sealed, "v1.new."), Equals, true)
+}
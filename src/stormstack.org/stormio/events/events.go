@@ -0,0 +1,95 @@
+/*
+ * Package events fans the status transitions of asset requests out to
+ * whoever is listening, the server sent event streams of the API.
+ */
+package events
+
+import (
+	"stormstack.org/stormio/persistence"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	TypeStatus  = "status"
+	TypeDeleted = "deleted"
+
+	// events a subscriber may fall behind by before they are dropped
+	SubscriberBuffer = 64
+)
+
+type Event struct {
+	Seq            uint64 `json:"seq"`
+	Type           string `json:"type"`
+	AssetId        string `json:"id"`
+	ResourceId     string `json:"resource"`
+	HostName       string `json:"hostName"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previousStatus,omitempty"`
+	Time           string `json:"time"`
+}
+
+type Subscription struct {
+	dropped uint64 // first, to be 64-bit aligned for atomic
+	C       chan *Event
+	assetId string
+}
+
+// Dropped is the number of events missed because the subscriber was too slow
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+type Hub struct {
+	sync.Mutex
+	seq  uint64
+	subs map[*Subscription]bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]bool)}
+}
+
+func FromAsset(eventType string, ar *persistence.AssetRequest) *Event {
+	return &Event{Type: eventType, AssetId: ar.Id, ResourceId: ar.ResourceId, HostName: ar.HostName,
+		Status: ar.Status, PreviousStatus: ar.PreviousStatus, Time: persistence.Now()}
+}
+
+// Subscribe to the events of one asset request, or all of them when assetId is empty
+func (hub *Hub) Subscribe(assetId string) *Subscription {
+	sub := &Subscription{C: make(chan *Event, SubscriberBuffer), assetId: assetId}
+	hub.Lock()
+	defer hub.Unlock()
+	hub.subs[sub] = true
+	return sub
+}
+
+func (hub *Hub) Unsubscribe(sub *Subscription) {
+	hub.Lock()
+	defer hub.Unlock()
+	if hub.subs[sub] {
+		delete(hub.subs, sub)
+		close(sub.C)
+	}
+}
+
+/*
+ * Publish never blocks the scheduler, a subscriber whose buffer is full
+ * misses the event.
+ */
+func (hub *Hub) Publish(event *Event) {
+	hub.Lock()
+	defer hub.Unlock()
+	hub.seq++
+	event.Seq = hub.seq
+	for sub := range hub.subs {
+		if sub.assetId != "" && sub.assetId != event.AssetId {
+			continue
+		}
+		select {
+		case sub.C <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package events
+
+import (
+	. "launchpad.net/gocheck"
+	"stormstack.org/stormio/persistence"
+	"testing"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type HubSuite struct{}
+
+var _ = Suite(&HubSuite{})
+
+func (s *HubSuite) TestFilterByAsset(c *C) {
+	hub := NewHub()
+	all := hub.Subscribe("")
+	one := hub.Subscribe("a1")
+	defer hub.Unsubscribe(all)
+	defer hub.Unsubscribe(one)
+
+	hub.Publish(FromAsset(TypeStatus, &persistence.AssetRequest{Id: "a1", Status: persistence.RequestBuild}))
+	hub.Publish(FromAsset(TypeStatus, &persistence.AssetRequest{Id: "a2", Status: persistence.RequestBuild}))
+
+	c.Assert(len(all.C), Equals, 2)
+	c.Assert(len(one.C), Equals, 1)
+	event := <-one.C
+	c.Assert(event.AssetId, Equals, "a1")
+	c.Assert(event.Seq, Equals, uint64(1))
+}
+
+func (s *HubSuite) TestSlowSubscriber(c *C) {
+	hub := NewHub()
+	sub := hub.Subscribe("")
+	for i := 0; i < SubscriberBuffer+3; i++ {
+		hub.Publish(&Event{AssetId: "a1"})
+	}
+	c.Assert(len(sub.C), Equals, SubscriberBuffer)
+	c.Assert(sub.Dropped(), Equals, uint64(3))
+
+	hub.Unsubscribe(sub)
+	hub.Unsubscribe(sub)
+	_, open := <-sub.C
+	for open {
+		_, open = <-sub.C
+	}
+}
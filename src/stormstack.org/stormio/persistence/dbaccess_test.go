@@ -11,7 +11,7 @@ func DisableTestCreate(t *testing.T) {
 	assetDS := &AssetDS{}
 	err := assetDS.InitDatabase("mysql", "stormio", "stormio", "password", "localhost", "3306")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 		return
 	}
 	assetDS.GetConnection()
@@ -19,7 +19,7 @@ func DisableTestCreate(t *testing.T) {
 	assetRequest := &AssetRequest{}
 	u4, _ := uuid.NewV4()
 	assetRequest.Id = u4.String()
-	assetRequest.AssetProviderId = "self"
+	assetRequest.Provider.Id = "self"
 	assetRequest.ResourceId = "No callback"
 	assetRequest.ReceivedOn = time.Now().String()
 	assetDS.Create(assetDS.conn, assetRequest)
@@ -30,14 +30,14 @@ func DisableTestUpate(t *testing.T) {
 	assetDS := &AssetDS{}
 	err := assetDS.InitDatabase("mysql", "stormio", "stormio", "password", "localhost", "3306")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
 	assetDS.GetConnection()
 	defer assetDS.Close()
 	assetRequest := &AssetRequest{}
 	u4, _ := uuid.NewV4()
 	assetRequest.Id = u4.String()
-	assetRequest.AssetProviderId = "self"
+	assetRequest.Provider.Id = "self"
 	assetRequest.ResourceId = "No callback"
 	assetRequest.ReceivedOn = time.Now().String()
 	assetDS.Create(assetDS.conn, assetRequest)
@@ -50,14 +50,14 @@ func DisableTestRemove(t *testing.T) {
 	assetDS := &AssetDS{}
 	err := assetDS.InitDatabase("mysql", "stormio", "stormio", "password", "localhost", "3306")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
 	assetDS.GetConnection()
 	defer assetDS.Close()
 	assetRequest := &AssetRequest{}
 	u4, _ := uuid.NewV4()
 	assetRequest.Id = u4.String()
-	assetRequest.AssetProviderId = "self"
+	assetRequest.Provider.Id = "self"
 	assetRequest.ResourceId = "No callback"
 	assetRequest.ReceivedOn = time.Now().String()
 	assetDS.Create(assetDS.conn, assetRequest)
@@ -69,14 +69,14 @@ func DisableTestFind(t *testing.T) {
 	assetDS := &AssetDS{}
 	err := assetDS.InitDatabase("mysql", "stormio", "stormio", "password", "localhost", "3306")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
 	assetDS.GetConnection()
 	defer assetDS.Close()
 	assetRequest := &AssetRequest{}
 	u4, _ := uuid.NewV4()
 	assetRequest.Id = u4.String()
-	assetRequest.AssetProviderId = "self"
+	assetRequest.Provider.Id = "self"
 	assetRequest.ResourceId = "No callback"
 	assetRequest.ReceivedOn = time.Now().String()
 	assetDS.Create(assetDS.conn, assetRequest)
@@ -0,0 +1,96 @@
+package persistence
+
+import (
+	"fmt"
+	"labix.org/v2/mgo/bson"
+)
+
+// Statuses of a group on top of the ones its members share
+const (
+	GroupInProgress = "IN_PROGRESS"
+	GroupPartial    = "PARTIALLY_FULFILLED"
+)
+
+/*
+ * AssetGroup is the servers of an asset request created with a count above
+ * one. Each member is an asset request of its own, provisioned, notified and
+ * deleted like any other; the group only sums up where they are.
+ */
+type AssetGroup struct {
+	Id       string          `json:"id"`
+	Count    int             `json:"count"`
+	Status   string          `json:"status"`
+	Statuses map[string]int  `json:"statuses"`
+	Members  []*AssetRequest `json:"members"`
+}
+
+/*
+ * Members splits the request into its Count members, each on its own of the
+ * Resources Vertex issued, which it is attached and activated on. The host
+ * name and the agent of a member are the ones of the request suffixed with
+ * its index, so each gets a server, a floating ip and a storm agent of its
+ * own.
+ */
+func (ar *AssetRequest) Members(groupId string) []*AssetRequest {
+	members := make([]*AssetRequest, ar.Count)
+	for i := range members {
+		member := *ar
+		member.Id = NewUUID()
+		member.Count, member.GroupId, member.Index = 0, groupId, i+1
+		member.HostName = fmt.Sprintf("%s-%d", ar.HostName, member.Index)
+		member.ResourceId, member.Resources = ar.Resources[i], nil
+		if ar.AgentId != "" {
+			member.AgentId = fmt.Sprintf("%s-%d", ar.AgentId, member.Index)
+		}
+		member.IdempotencyKey, member.RequestHash, member.AcceptedResponse = "", "", ""
+		members[i] = &member
+	}
+	return members
+}
+
+func NewAssetGroup(id string, members []*AssetRequest) *AssetGroup {
+	group := &AssetGroup{Id: id, Count: len(members), Statuses: make(map[string]int), Members: members}
+	for _, member := range members {
+		group.Statuses[member.Status]++
+	}
+	group.Status = groupStatus(group.Statuses)
+	return group
+}
+
+// Members that won't move on by themselves
+func settled(status string) bool {
+	switch status {
+	case RequestFulfilled, RequestFail, RequestNotifyFail, RequestMarkDeletion:
+		return true
+	}
+	return false
+}
+
+/*
+ * The status the members share, else IN_PROGRESS while some are on their
+ * way, PARTIALLY_FULFILLED once they all got where they are going with some
+ * fulfilled, FAIL with none.
+ */
+func groupStatus(statuses map[string]int) string {
+	if len(statuses) == 1 {
+		for status := range statuses {
+			return status
+		}
+	}
+	for status := range statuses {
+		if !settled(status) {
+			return GroupInProgress
+		}
+	}
+	if statuses[RequestFulfilled] > 0 {
+		return GroupPartial
+	}
+	return RequestFail
+}
+
+// FindGroup is the members of the group by index, none when there is no such group.
+func (conn *Connection) FindGroup(groupId string) ([]*AssetRequest, error) {
+	var members []*AssetRequest
+	err := conn.collection.Find(bson.M{"groupid": groupId}).Sort("index").All(&members)
+	return members, err
+}
@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type GroupsSuite struct{}
+
+var _ = Suite(&GroupsSuite{})
+
+func (gs *GroupsSuite) TestMembers(c *C) {
+	ar := &AssetRequest{Id: "g1", HostName: "vcg", AgentId: "ag", Count: 3, Resources: []string{"r1", "r2", "r3"},
+		Status: RequestNew, IdempotencyKey: "k1"}
+	members := ar.Members(ar.Id)
+	c.Assert(members, HasLen, 3)
+	seen := make(map[string]bool)
+	for i, member := range members {
+		c.Assert(member.GroupId, Equals, "g1")
+		c.Assert(member.Index, Equals, i+1)
+		c.Assert(member.Count, Equals, 0)
+		c.Assert(member.IdempotencyKey, Equals, "")
+		c.Assert(seen[member.Id], Equals, false)
+		seen[member.Id] = true
+	}
+	c.Assert(members[2].HostName, Equals, "vcg-3")
+	c.Assert(members[2].ResourceId, Equals, "r3")
+	c.Assert(members[2].Resources, IsNil)
+	c.Assert(members[2].AgentId, Equals, "ag-3")
+	c.Assert(ar.HostName, Equals, "vcg")
+}
+
+func (gs *GroupsSuite) TestStatus(c *C) {
+	group := func(statuses ...string) string {
+		var members []*AssetRequest
+		for _, status := range statuses {
+			members = append(members, &AssetRequest{Status: status})
+		}
+		return NewAssetGroup("g1", members).Status
+	}
+	c.Assert(group(RequestBuild, RequestBuild), Equals, RequestBuild)
+	c.Assert(group(RequestFulfilled, RequestRetry), Equals, GroupInProgress)
+	c.Assert(group(RequestFulfilled, RequestFail), Equals, GroupPartial)
+	c.Assert(group(RequestFail, RequestNotifyFail), Equals, RequestFail)
+
+	g := NewAssetGroup("g1", []*AssetRequest{{Status: RequestNew}, {Status: RequestNew}, {Status: RequestBuild}})
+	c.Assert(g.Count, Equals, 3)
+	c.Assert(g.Statuses, DeepEquals, map[string]int{RequestNew: 2, RequestBuild: 1})
+}
+
+func (gs *GroupsSuite) TestGroupStatus(c *C) {
+	for _, t := range []struct {
+		statuses map[string]int
+		status   string
+	}{
+		{map[string]int{RequestNew: 3}, RequestNew},
+		{map[string]int{RequestFulfilled: 3}, RequestFulfilled},
+		{map[string]int{RequestFulfilled: 1, RequestBuild: 1, RequestNew: 1}, GroupInProgress},
+		{map[string]int{RequestFail: 1, RequestRetry: 2}, GroupInProgress},
+		{map[string]int{RequestFulfilled: 2, RequestFail: 1}, GroupPartial},
+		{map[string]int{RequestFulfilled: 1, RequestNotifyFail: 1, RequestMarkDeletion: 1}, GroupPartial},
+		{map[string]int{RequestFail: 2, RequestNotifyFail: 1}, RequestFail},
+		{map[string]int{RequestFail: 1, RequestMarkDeletion: 2}, RequestFail},
+	} {
+		c.Assert(groupStatus(t.statuses), Equals, t.status, Commentf("%v", t.statuses))
+	}
+}
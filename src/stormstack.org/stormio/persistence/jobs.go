@@ -0,0 +1,277 @@
+package persistence
+
+import (
+	"errors"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"stormstack.org/stormio/util"
+	"time"
+)
+
+const (
+	JobCollection = "Jobs"
+
+	JobCreate    = "create"
+	JobRemediate = "remediate"
+	JobDelete    = "delete"
+	JobActivate  = "activate"
+)
+
+/*
+ * Priority classes of the jobs, the higher claimed first. Creates, retries
+ * and remediations share their workers; deletes and activations have their
+ * own, PriorityDelete only orders them among a Claim of several kinds.
+ */
+const (
+	PriorityRetry     = 10
+	PriorityCreate    = 20
+	PriorityRemediate = 30
+	PriorityDelete    = 40
+	MaxPriority       = 100
+
+	AgingStep = 5 // gained by a job for every Aging it waits
+)
+
+var (
+	ErrQueueFull = errors.New("Job queue is full")
+	ErrLeaseLost = errors.New("Job lease expired and was claimed again")
+)
+
+/*
+ * Job is a unit of provisioning work kept in Mongo until a worker is done
+ * with it. A claimed job is leased: it stays invisible to the other workers
+ * until VisibleAt, and is claimed again once that passes without an Ack, as
+ * happens when stormio dies half way.
+ */
+type Job struct {
+	Id         string `json:"id" bson:"_id"`
+	Kind       string `json:"kind"`
+	AssetId    string `json:"assetId"`
+	ResourceId string `json:"resourceId,omitempty"`
+	Provider   string `json:"provider,omitempty"` // the asset provider it is run against
+	Attempts   int    `json:"attempts"`
+	Owner      string `json:"owner,omitempty"`
+	VisibleAt  string `json:"visibleAt"`
+	EnqueuedOn string `json:"enqueuedOn"`
+	LastError  string `json:"lastError,omitempty"`
+	Priority   int    `json:"priority"`
+	AgedAt     string `json:"-"` // when it last gained AgingStep, or became visible
+}
+
+// ClassPriority is the priority of the jobs of the kind, unless told otherwise
+func ClassPriority(kind string) int {
+	switch kind {
+	case JobDelete, JobActivate:
+		return PriorityDelete
+	case JobRemediate:
+		return PriorityRemediate
+	}
+	return PriorityCreate
+}
+
+type Queue struct {
+	session     *mgo.Session
+	name        string
+	MaxDepth    int           // Enqueue fails with ErrQueueFull past it, 0 for no limit
+	MaxAttempts int           // Retry gives up past it, 0 for no limit
+	Lease       time.Duration // how long a claimed job stays invisible
+	Aging       time.Duration // a job waiting that long gains AgingStep, 0 for never
+}
+
+// OpenQueue opens the queue kept in the given collection of the CloudIO db.
+func OpenQueue(name string) (*Queue, error) {
+	session, err := mgo.Dial(util.GetString("database", "host") + ":" + util.GetString("database", "port"))
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{session: session, name: name, Lease: 2 * time.Minute}
+	if err := q.ensureIndexes(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Every call runs on its own copy of the session, the queue is shared by the workers
+func (q *Queue) jobs() (*mgo.Session, *mgo.Collection) {
+	s := q.session.Copy()
+	return s, s.DB(Database).C(q.name)
+}
+
+func (q *Queue) ensureIndexes() error {
+	s, jobs := q.jobs()
+	defer s.Close()
+	if err := jobs.EnsureIndex(mgo.Index{Key: []string{"kind", "visibleat"}}); err != nil {
+		return err
+	}
+	if err := jobs.EnsureIndex(mgo.Index{Key: []string{"kind", "agedat"}}); err != nil {
+		return err
+	}
+	return jobs.EnsureIndex(mgo.Index{Key: []string{"kind", "-priority", "visibleat"}})
+}
+
+func (q *Queue) Close() {
+	q.session.Close()
+}
+
+/*
+ * Enqueue adds the job, visible right away unless VisibleAt says otherwise,
+ * with the priority of its class unless it has one. There is one job of a
+ * kind per asset request, enqueueing it again while it is pending is a
+ * no-op. MaxDepth holds back creates only, the rest is always taken.
+ */
+func (q *Queue) Enqueue(job *Job) error {
+	s, jobs := q.jobs()
+	defer s.Close()
+	if q.MaxDepth > 0 && job.Kind == JobCreate {
+		depth, err := jobs.Count()
+		if err != nil {
+			return err
+		}
+		if depth >= q.MaxDepth {
+			return ErrQueueFull
+		}
+	}
+	if job.Id == "" {
+		job.Id = job.Kind + ":" + job.AssetId
+	}
+	job.EnqueuedOn = Now()
+	if job.Priority == 0 {
+		job.Priority = ClassPriority(job.Kind)
+	}
+	if job.VisibleAt == "" {
+		job.VisibleAt = job.EnqueuedOn
+	}
+	job.AgedAt = job.VisibleAt
+	if err := jobs.Insert(job); err != nil && !mgo.IsDup(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+ * Claim leases a visible job of the given kinds to owner, nil when there is
+ * none: the one of highest priority, the oldest among those. The jobs left
+ * waiting gain AgingStep every Aging, so none starves however many come in
+ * ahead, while the classes still hold between the jobs of similar age.
+ */
+func (q *Queue) Claim(owner string, kinds ...string) (*Job, error) {
+	return q.ClaimExcept(owner, nil, kinds...)
+}
+
+// ClaimExcept is Claim leaving alone the jobs of the given providers.
+func (q *Queue) ClaimExcept(owner string, providers []string, kinds ...string) (*Job, error) {
+	s, jobs := q.jobs()
+	defer s.Close()
+	job := new(Job)
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"owner": owner, "visibleat": FormatTime(time.Now().Add(q.Lease))},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}
+	query := bson.M{"kind": bson.M{"$in": kinds}}
+	if len(providers) > 0 {
+		query["provider"] = bson.M{"$nin": providers}
+	}
+	now := Now()
+	query["visibleat"] = bson.M{"$lte": now}
+	if q.Aging > 0 {
+		aged := bson.M{"kind": query["kind"], "visibleat": query["visibleat"],
+			"agedat": bson.M{"$lte": FormatTime(time.Now().Add(-q.Aging))}}
+		if _, err := jobs.UpdateAll(aged, bson.M{"$inc": bson.M{"priority": AgingStep},
+			"$set": bson.M{"agedat": now}}); err != nil {
+			return nil, err
+		}
+	}
+	_, err := jobs.Find(query).Sort("-priority", "visibleat").Apply(change, job)
+	return claimed(job, err)
+}
+
+func claimed(job *Job, err error) (*Job, error) {
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Extend renews the lease of a job still being worked on.
+func (q *Queue) Extend(job *Job) error {
+	return q.update(job, bson.M{"$set": bson.M{"visibleat": FormatTime(time.Now().Add(q.Lease))}})
+}
+
+// Ack removes a job that is done with.
+func (q *Queue) Ack(job *Job) error {
+	s, jobs := q.jobs()
+	defer s.Close()
+	err := jobs.Remove(bson.M{"_id": job.Id, "owner": job.Owner})
+	if err == mgo.ErrNotFound {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+/*
+ * Retry hands the job back, to be claimed again after delay. Once the job
+ * has been attempted MaxAttempts times it is removed instead and true is
+ * returned.
+ */
+func (q *Queue) Retry(job *Job, delay time.Duration, cause error) (bool, error) {
+	if q.MaxAttempts > 0 && job.Attempts >= q.MaxAttempts {
+		return true, q.Ack(job)
+	}
+	job.LastError = cause.Error()
+	visibleAt := FormatTime(time.Now().Add(delay))
+	return false, q.update(job, bson.M{"$set": bson.M{
+		"owner":     "",
+		"visibleat": visibleAt,
+		"agedat":    visibleAt,
+		"lasterror": job.LastError,
+		"priority":  job.Priority,
+	}})
+}
+
+// Defer hands the job back to be claimed after delay, as a fresh one: the
+// attempts so far don't count against MaxAttempts.
+func (q *Queue) Defer(job *Job, delay time.Duration) error {
+	visibleAt := FormatTime(time.Now().Add(delay))
+	return q.update(job, bson.M{"$set": bson.M{
+		"owner":     "",
+		"visibleat": visibleAt,
+		"agedat":    visibleAt,
+		"attempts":  0,
+		"priority":  job.Priority,
+	}})
+}
+
+// Reprioritize changes the priority of the job pending for the asset request, if any.
+func (q *Queue) Reprioritize(kind, assetId string, priority int) error {
+	s, jobs := q.jobs()
+	defer s.Close()
+	err := jobs.UpdateId(kind+":"+assetId, bson.M{"$set": bson.M{"priority": priority}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (q *Queue) update(job *Job, change bson.M) error {
+	s, jobs := q.jobs()
+	defer s.Close()
+	err := jobs.Update(bson.M{"_id": job.Id, "owner": job.Owner}, change)
+	if err == mgo.ErrNotFound {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// Depth counts the jobs in the queue, claimed or not.
+func (q *Queue) Depth() (int, error) {
+	s, jobs := q.jobs()
+	defer s.Close()
+	return jobs.Count()
+}
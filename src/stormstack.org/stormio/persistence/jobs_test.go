@@ -0,0 +1,153 @@
+package persistence
+
+import (
+	"labix.org/v2/mgo"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type QueueSuite struct {
+	queue *Queue
+}
+
+var _ = Suite(&QueueSuite{})
+
+func (qs *QueueSuite) SetUpSuite(c *C) {
+	session, err := mgo.DialWithTimeout("localhost:27017", time.Second)
+	if err != nil {
+		c.Skip("no mongo to run the queue against: " + err.Error())
+	}
+	qs.queue = &Queue{session: session, name: "JobsTest", Lease: time.Minute, MaxDepth: 2, MaxAttempts: 2}
+	c.Assert(qs.queue.ensureIndexes(), IsNil)
+}
+
+func (qs *QueueSuite) SetUpTest(c *C) {
+	s, jobs := qs.queue.jobs()
+	defer s.Close()
+	jobs.DropCollection()
+}
+
+func (qs *QueueSuite) TearDownSuite(c *C) {
+	if qs.queue != nil {
+		qs.queue.Close()
+	}
+}
+
+func (qs *QueueSuite) TestClaimAck(c *C) {
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a1"}), IsNil)
+	// queued once per kind and asset request
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a1"}), IsNil)
+	depth, _ := qs.queue.Depth()
+	c.Assert(depth, Equals, 1)
+
+	job, err := qs.queue.Claim("w1", JobDelete)
+	c.Assert(err, IsNil)
+	c.Assert(job, IsNil)
+	job, err = qs.queue.Claim("w1", JobCreate)
+	c.Assert(err, IsNil)
+	c.Assert(job.AssetId, Equals, "a1")
+	c.Assert(job.Attempts, Equals, 1)
+
+	// leased, the other workers don't see it
+	other, err := qs.queue.Claim("w2", JobCreate)
+	c.Assert(err, IsNil)
+	c.Assert(other, IsNil)
+
+	c.Assert(qs.queue.Extend(job), IsNil)
+	c.Assert(qs.queue.Ack(job), IsNil)
+	depth, _ = qs.queue.Depth()
+	c.Assert(depth, Equals, 0)
+}
+
+func (qs *QueueSuite) TestClaimExcept(c *C) {
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a1", Provider: "busy"}), IsNil)
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a2", Provider: "idle"}), IsNil)
+	job, err := qs.queue.ClaimExcept("w1", []string{"busy"}, JobCreate)
+	c.Assert(err, IsNil)
+	c.Assert(job.AssetId, Equals, "a2")
+	job, err = qs.queue.ClaimExcept("w1", []string{"busy"}, JobCreate)
+	c.Assert(err, IsNil)
+	c.Assert(job, IsNil)
+}
+
+func (qs *QueueSuite) TestExpiredLease(c *C) {
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a1"}), IsNil)
+	qs.queue.Lease = -time.Second
+	defer func() { qs.queue.Lease = time.Minute }()
+	first, _ := qs.queue.Claim("w1", JobCreate)
+	second, err := qs.queue.Claim("w2", JobCreate)
+	c.Assert(err, IsNil)
+	c.Assert(second.Attempts, Equals, 2)
+	c.Assert(qs.queue.Ack(first), Equals, ErrLeaseLost)
+	c.Assert(qs.queue.Ack(second), IsNil)
+}
+
+func (qs *QueueSuite) TestRetry(c *C) {
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobActivate, AssetId: "a1"}), IsNil)
+	job, _ := qs.queue.Claim("w1", JobActivate)
+	exhausted, err := qs.queue.Retry(job, 0, ErrQueueFull)
+	c.Assert(err, IsNil)
+	c.Assert(exhausted, Equals, false)
+
+	job, _ = qs.queue.Claim("w1", JobActivate)
+	c.Assert(job.LastError, Equals, ErrQueueFull.Error())
+	exhausted, err = qs.queue.Retry(job, 0, ErrQueueFull)
+	c.Assert(err, IsNil)
+	c.Assert(exhausted, Equals, true)
+	depth, _ := qs.queue.Depth()
+	c.Assert(depth, Equals, 0)
+}
+
+func (qs *QueueSuite) TestFull(c *C) {
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a1"}), IsNil)
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a2"}), IsNil)
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a3"}), Equals, ErrQueueFull)
+}
+
+func (qs *QueueSuite) TestPriority(c *C) {
+	past := FormatTime(time.Now().Add(-time.Minute))
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a1", VisibleAt: past, Priority: PriorityRetry}), IsNil)
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a2", VisibleAt: past}), IsNil)
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobRemediate, AssetId: "a3"}), IsNil)
+	// full of creates, the rest is still taken
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobDelete, AssetId: "a4"}), IsNil)
+
+	var order []string
+	for {
+		job, err := qs.queue.Claim("w1", JobCreate, JobRemediate, JobDelete)
+		c.Assert(err, IsNil)
+		if job == nil {
+			break
+		}
+		order = append(order, job.AssetId)
+	}
+	c.Assert(order, DeepEquals, []string{"a4", "a3", "a2", "a1"})
+
+	c.Assert(qs.queue.Reprioritize(JobCreate, "a1", 90), IsNil)
+	c.Assert(qs.queue.Reprioritize(JobCreate, "gone", 90), IsNil)
+}
+
+func (qs *QueueSuite) TestAging(c *C) {
+	qs.queue.Aging = time.Minute
+	defer func() { qs.queue.Aging = 0 }()
+	old := FormatTime(time.Now().Add(-90 * time.Second))
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a1", VisibleAt: old}), IsNil)
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a2", VisibleAt: old, Priority: PriorityRetry}), IsNil)
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobRemediate, AssetId: "a3"}), IsNil)
+	c.Assert(qs.queue.Enqueue(&Job{Kind: JobCreate, AssetId: "a4"}), IsNil)
+
+	// aged once, the creates still make way for a new remediation
+	job, _ := qs.queue.Claim("w1", JobCreate, JobRemediate)
+	c.Assert(job.AssetId, Equals, "a3")
+	job, _ = qs.queue.Claim("w1", JobCreate, JobRemediate)
+	c.Assert(job.AssetId, Equals, "a1")
+	c.Assert(job.Priority, Equals, PriorityCreate+AgingStep)
+
+	// aged twice, the retry catches up with the new create and goes first
+	s, jobs := qs.queue.jobs()
+	defer s.Close()
+	c.Assert(jobs.UpdateId("create:a2", map[string]interface{}{"$set": map[string]interface{}{"agedat": old}}), IsNil)
+	job, _ = qs.queue.Claim("w1", JobCreate, JobRemediate)
+	c.Assert(job.AssetId, Equals, "a2")
+	c.Assert(job.Priority, Equals, PriorityRetry+2*AgingStep)
+}
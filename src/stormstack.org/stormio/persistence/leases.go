@@ -0,0 +1,87 @@
+package persistence
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"stormstack.org/stormio/util"
+	"time"
+)
+
+const LeaseCollection = "Leases"
+
+/*
+ * Lease is a lock shared by the stormio instances on one db: held by Owner
+ * until ExpiresAt, unless renewed before. An owner that dies without
+ * releasing it loses it once it expires, so the clocks of the instances
+ * mustn't be further apart than the ttl it is taken for.
+ */
+type Lease struct {
+	Id        string `json:"id" bson:"_id"`
+	Owner     string `json:"owner"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+type Leases struct {
+	session *mgo.Session
+	name    string
+}
+
+// OpenLeases opens the leases kept in the given collection of the CloudIO db.
+func OpenLeases(name string) (*Leases, error) {
+	session, err := mgo.Dial(util.GetString("database", "host") + ":" + util.GetString("database", "port"))
+	if err != nil {
+		return nil, err
+	}
+	return &Leases{session: session, name: name}, nil
+}
+
+func (l *Leases) leases() (*mgo.Session, *mgo.Collection) {
+	s := l.session.Copy()
+	return s, s.DB(Database).C(l.name)
+}
+
+func (l *Leases) Close() {
+	l.session.Close()
+}
+
+/*
+ * Acquire takes the lease id for owner, or renews it when owner holds it
+ * already, until ttl from now. It is false while another owner holds it.
+ */
+func (l *Leases) Acquire(id, owner string, ttl time.Duration) (bool, error) {
+	s, leases := l.leases()
+	defer s.Close()
+	free := bson.M{"_id": id, "$or": []bson.M{{"owner": owner}, {"expiresat": bson.M{"$lte": Now()}}}}
+	_, err := leases.Upsert(free, bson.M{"$set": bson.M{"owner": owner, "expiresat": FormatTime(time.Now().Add(ttl))}})
+	if mgo.IsDup(err) {
+		// held by another, the upsert tried to insert it again
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release gives up the lease if owner holds it.
+func (l *Leases) Release(id, owner string) error {
+	s, leases := l.leases()
+	defer s.Close()
+	err := leases.Remove(bson.M{"_id": id, "owner": owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Holder is the lease id as it stands, nil when nobody holds it.
+func (l *Leases) Holder(id string) (*Lease, error) {
+	s, leases := l.leases()
+	defer s.Close()
+	lease := new(Lease)
+	err := leases.Find(bson.M{"_id": id, "expiresat": bson.M{"$gt": Now()}}).One(lease)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"labix.org/v2/mgo"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type LeasesSuite struct {
+	leases *Leases
+}
+
+var _ = Suite(&LeasesSuite{})
+
+func (ls *LeasesSuite) SetUpSuite(c *C) {
+	session, err := mgo.DialWithTimeout("localhost:27017", time.Second)
+	if err != nil {
+		c.Skip("no mongo to run the leases against: " + err.Error())
+	}
+	ls.leases = &Leases{session: session, name: "LeasesTest"}
+}
+
+func (ls *LeasesSuite) SetUpTest(c *C) {
+	s, leases := ls.leases.leases()
+	defer s.Close()
+	leases.DropCollection()
+}
+
+func (ls *LeasesSuite) TearDownSuite(c *C) {
+	if ls.leases != nil {
+		ls.leases.Close()
+	}
+}
+
+func (ls *LeasesSuite) TestAcquire(c *C) {
+	ok, err := ls.leases.Acquire("leader", "s1", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	// renewed by its owner, refused to the others
+	ok, _ = ls.leases.Acquire("leader", "s1", time.Minute)
+	c.Assert(ok, Equals, true)
+	ok, err = ls.leases.Acquire("leader", "s2", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+	lease, _ := ls.leases.Holder("leader")
+	c.Assert(lease.Owner, Equals, "s1")
+
+	// only its owner releases it
+	c.Assert(ls.leases.Release("leader", "s2"), IsNil)
+	ok, _ = ls.leases.Acquire("leader", "s2", time.Minute)
+	c.Assert(ok, Equals, false)
+	c.Assert(ls.leases.Release("leader", "s1"), IsNil)
+	lease, _ = ls.leases.Holder("leader")
+	c.Assert(lease, IsNil)
+	ok, _ = ls.leases.Acquire("leader", "s2", time.Minute)
+	c.Assert(ok, Equals, true)
+}
+
+func (ls *LeasesSuite) TestExpired(c *C) {
+	ok, _ := ls.leases.Acquire("areq:a1", "s1", -time.Second)
+	c.Assert(ok, Equals, true)
+	lease, _ := ls.leases.Holder("areq:a1")
+	c.Assert(lease, IsNil)
+	ok, _ = ls.leases.Acquire("areq:a1", "s2", time.Minute)
+	c.Assert(ok, Equals, true)
+}
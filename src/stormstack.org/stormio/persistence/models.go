@@ -8,36 +8,36 @@ import (
 
 type AssetProvider struct {
 	Id             string `json:"id" bson:"_id"`
-	Username       string `json:"username"`
-	Password       string `json:"password"`
-	EndPointURL    string `json:"endPoint"`
-	Tenant         string `json:"tenant"`
+	Username       string `json:"username" valid:"required"`
+	Password       string `json:"password" valid:"required"`
+	EndPointURL    string `json:"endPoint" valid:"required,url"`
+	Tenant         string `json:"tenant" valid:"required"`
 	RegionName     string `json:"regionName"`
 	DefaultNetName string `json:"defaultNetName,omitempty"`
 	NetworkName    string `json:"networkName,omitempty"`
 	RouterId       string `json:"routerId,omitempty"`
 	NetworkId      string `json:"networkId,omitempty"`
-	Image          string `json:"image,omitempty"`
-	Compute        string `json:"compute,omitempty"`
-	Storage        string `json:"storage,omitempty"`
-	Neutron        string `json:"neutron,omitempty"`
-	Identity       string `json:"identity,omitempty"`
+	Image          string `json:"image,omitempty" valid:"url"`
+	Compute        string `json:"compute,omitempty" valid:"url"`
+	Storage        string `json:"storage,omitempty" valid:"url"`
+	Neutron        string `json:"neutron,omitempty" valid:"url"`
+	Identity       string `json:"identity,omitempty" valid:"url"`
 }
 
 type AssetModel struct {
 	Id     string `json:"id" bson:"_id"`
 	Name   string `json:"name"`
-	Flavor string `json:"flavor"`
-	Image  string `json:"image"`
+	Flavor string `json:"flavor" valid:"required"`
+	Image  string `json:"image" valid:"required"`
 }
 
 type StormBolt struct {
 	Uplinks        []string `json:"uplinks"`
 	UplinkStrategy string   `json:"uplinkStrategy"`
 	AllowRelay     bool     `json:"allowRelay"`
-	RelayPort      int      `json:"relayPort"`
-	AllowedPorts   []int    `json:"allowedPorts"`
-	ListenPort     int      `json:"listenPort"`
+	RelayPort      int      `json:"relayPort" valid:"port"`
+	AllowedPorts   []int    `json:"allowedPorts" valid:"port"`
+	ListenPort     int      `json:"listenPort" valid:"port"`
 	BeaconInterval int      `json:"beaconInterval"`
 	BeaconRetry    int      `json:"beaconRetry"`
 	BeaconValidty  int      `json:"beaconValidity"`
@@ -50,12 +50,12 @@ type StormAgent struct {
 	StormBolt StormBolt `json:"bolt"`
 }
 
-//Control Provider
+// Control Provider
 type ControlProvider struct {
 	Id              string    `json:"id" bson:"_id"`
-	StormtrackerURL string    `json:"stormtracker"`
-	StormlightURL   string    `json:"stormlight"`
-	StormkeeperURL  string    `json:"stormkeeper"`
+	StormtrackerURL string    `json:"stormtracker" valid:"url"`
+	StormlightURL   string    `json:"stormlight" valid:"url"`
+	StormkeeperURL  string    `json:"stormkeeper" valid:"url"`
 	Name            string    `json:"name"`
 	Description     string    `json:"description"`
 	Bolt            StormBolt `json:"bolt"`
@@ -78,15 +78,15 @@ const (
 )
 
 type NotifyCaller struct {
-	Url   string `json:"url"`
+	Url   string `json:"url" valid:"required,url"`
 	Token string
 }
 
 // Entity AssetRequest
 type AssetRequest struct {
 	Id              string        `json:"id,omitempty" bson:"_id"` // qbs:"pk"`
-	HostName        string        `json:"hostName"`
-	ResourceId      string        `json:"resource"`
+	HostName        string        `json:"hostName" valid:"hostname"`
+	ResourceId      string        `json:"resource" valid:"required"`
 	ServerId        string        `json:"serverId"`
 	IpAddress       string        `json:"ipAddress"`
 	ReceivedOn      string        `json:"receivedOn"`
@@ -94,17 +94,41 @@ type AssetRequest struct {
 	Provider        AssetProvider `json:"assetProvider"`
 	Status          string        `json:"status"`
 	PreviousStatus  string
+	StatusChangedOn string `json:"statusChangedOn"`
 	Remediation     bool
+	Remediations    int `json:"remediations"`
+	// Failed provisioning attempts so far, why the last one failed and when
+	// the next one is due
+	Attempts        int            `json:"attempts"`
+	FailureReason   string         `json:"failureReason,omitempty"`
+	NextAttemptOn   string         `json:"nextAttemptOn,omitempty"`
 	Model           AssetModel     `json:"assetModel"`
 	Modules         []ModuleStatus `json:"-" bson:"-"`
 	ModuleInitFlag  bool           `json:"-" bson:"-"`
-	Logs            []Log          `json:"logs"`
+	Logs            []Log          `json:"logs,omitempty" bson:"-"` // from the Timeline, see Connection.Timeline
 	ActivationInfo  ActivationInfo
 	ControlTokenId  string          `json:"stormTokenId"`
 	SerialKey       string          `json:"serialkey"`
-	AgentId         string          `json:"agentId"`
+	AgentId         string          `json:"agentId" valid:"required"`
 	ControlProvider ControlProvider `json:"controlProvider"`
 	Notify          NotifyCaller
+	// Set from the Idempotency-Key header of the create, along with what
+	// it was answered so a retry gets the same answer
+	IdempotencyKey   string `json:"-" bson:"idempotencykey,omitempty"`
+	RequestHash      string `json:"-" bson:"requesthash,omitempty"`
+	AcceptedResponse string `json:"-" bson:"acceptedresponse,omitempty"`
+	// Count of servers asked for on the create, each provisioned as a member
+	// of the group GroupId at Index, from 1, on its own of the Resources
+	Count     int      `json:"count,omitempty" bson:"count,omitempty"`
+	Resources []string `json:"resources,omitempty" bson:"-"`
+	GroupId   string   `json:"groupId,omitempty" bson:"groupid,omitempty"`
+	Index     int      `json:"index,omitempty" bson:"index,omitempty"`
+	// The server isn't created before NotBefore and is deleted at ExpiresAt,
+	// RFC3339 timestamps on the create
+	NotBefore string `json:"notBefore,omitempty" bson:"notbefore,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty" bson:"expiresat,omitempty"`
+	// Overrides the priority class of its create and retries, 1 to 100
+	Priority int `json:"priority,omitempty" bson:"priority,omitempty"`
 }
 
 type ActivationInfo struct {
@@ -112,9 +136,15 @@ type ActivationInfo struct {
 	Status     string
 }
 
+// A step of the timeline of a request, Type LogInfo or LogError
 type Log struct {
-	Msg  string
-	Type string
+	AssetId  string `json:"-" bson:"assetid"`
+	Step     string `json:"step"`
+	Type     string `json:"type"`
+	At       string `json:"at"`
+	Duration int64  `json:"durationMs,omitempty"` // from the start of the step
+	Msg      string `json:"message,omitempty"`
+	Error    string `json:"error,omitempty"`
 }
 
 type ModuleStatus struct {
@@ -1,8 +1,9 @@
 package persistence
 
 import (
-	"stormstack.org/stormio/util"
 	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"stormstack.org/stormio/util"
 )
 
 type Connection struct {
@@ -32,6 +33,25 @@ func NewConnection(dbName, collName string) (conn *Connection, err error) {
 	return
 }
 
+// EnsureIndexes creates the indexes the Assets and Timeline collections rely on
+func EnsureIndexes() error {
+	conn, err := DefaultSession()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.collection.EnsureIndex(mgo.Index{Key: []string{"idempotencykey"}, Unique: true, Sparse: true}); err != nil {
+		return err
+	}
+	if err := conn.collection.EnsureIndex(mgo.Index{Key: []string{"groupid", "index"}, Sparse: true}); err != nil {
+		return err
+	}
+	if err := conn.collection.EnsureIndex(mgo.Index{Key: []string{"expiresat"}, Sparse: true}); err != nil {
+		return err
+	}
+	return conn.timeline().EnsureIndex(mgo.Index{Key: []string{"assetid", "at"}})
+}
+
 func (conn *Connection) GetCollection() (collection *mgo.Collection) {
 	collection = conn.collection
 	return
@@ -46,13 +66,31 @@ func (conn *Connection) Create(assetReq *AssetRequest) (err error) {
 	return conn.collection.Insert(assetReq)
 }
 
+// Update saves a request still in the status it was read with, ErrGone once
+// it is deleted. Status changes go through StateMachine.Transition instead.
 func (conn *Connection) Update(assetReq *AssetRequest) (err error) {
-	conn.collection.UpsertId(assetReq.Id, assetReq)
-	return err
+	return conn.save(assetReq, assetReq.Status)
 }
 
+/*
+ * Set sets the fields of the request matching criteria and nothing else,
+ * handing back the request as it is then, mgo.ErrNotFound when none does.
+ */
+func (conn *Connection) Set(criteria, fields bson.M) (*AssetRequest, error) {
+	ar := new(AssetRequest)
+	change := mgo.Change{Update: bson.M{"$set": fields}, ReturnNew: true}
+	if _, err := conn.collection.Find(criteria).Apply(change, ar); err != nil {
+		return nil, err
+	}
+	return ar, nil
+}
+
+// Remove deletes the request along with its timeline
 func (conn *Connection) Remove(id string) error {
 	err := conn.collection.RemoveId(id)
+	if err == nil {
+		err = conn.removeTimeline(id)
+	}
 	return err
 }
 
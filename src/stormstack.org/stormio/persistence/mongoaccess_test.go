@@ -1,12 +1,13 @@
 package persistence
 
 import (
-	"stormstack.org/stormio/util"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/nu7hatch/gouuid"
+	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	. "launchpad.net/gocheck"
+	"stormstack.org/stormio/util"
 	"testing"
 	"time"
 )
@@ -23,6 +24,11 @@ type MongoSuite struct {
 var _ = Suite(&MongoSuite{})
 
 func (ms *MongoSuite) SetUpSuite(c *C) {
+	session, err := mgo.DialWithTimeout("localhost:27017", time.Second)
+	if err != nil {
+		c.Skip("no mongo to run the assets against: " + err.Error())
+	}
+	session.Close()
 	util.LoadProperties()
 	defer log.Flush()
 	seelogconfig := util.GetString("default", "log-conf")
@@ -42,7 +48,7 @@ func (ms *MongoSuite) TestCreate(c *C) {
 	ms.id = u4.String()
 	u5, _ := uuid.NewV4()
 	assetRequest.Id = u4.String()
-	assetRequest.AssetProviderId = "self"
+	assetRequest.Provider.Id = "self"
 	assetRequest.ResourceId = u4.String()
 	assetRequest.ReceivedOn = time.Now().String()
 	assetRequest.Status = RequestRetry
@@ -104,8 +110,12 @@ func (ms *MongoSuite) TestUpdate(c *C) {
 		return
 	}
 	defer conn.Close()
-	asset, _ := conn.Find(bson.M{"_id": ms.id})
-	asset.Modules[0].Name = "Renamed from Sample"
+	asset, err := conn.Find(bson.M{"_id": ms.id})
+	if err != nil {
+		c.Errorf(err.Error())
+		return
+	}
+	asset.HostName = "Renamed from Sample"
 	conn.Update(asset)
 	fmt.Println(asset)
 	fmt.Println("Test Update success")
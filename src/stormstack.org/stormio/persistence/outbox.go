@@ -0,0 +1,248 @@
+package persistence
+
+import (
+	"errors"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"stormstack.org/stormio/util"
+	"time"
+)
+
+const (
+	OutboxCollection = "Outbox"
+
+	CallbackAttach   = "attach"
+	CallbackDetach   = "detach"
+	CallbackActivate = "activate"
+
+	CallbackPending    = "PENDING"
+	CallbackDeadLetter = "DEAD_LETTER"
+)
+
+var (
+	ErrNotDeadLetter = errors.New("Only dead letter callbacks can be replayed")
+	ErrSuperseded    = errors.New("A later callback of the asset request was recorded, replaying would undo it")
+)
+
+/*
+ * Callback is a call to Vertex recorded before the change it tells about is
+ * saved, and kept until Vertex acknowledged it. A callback the delivery gave
+ * up on stays as a DEAD_LETTER until it is replayed.
+ */
+type Callback struct {
+	Id            string `json:"id" bson:"_id"`
+	Kind          string `json:"kind"`
+	AssetId       string `json:"assetId"`
+	ResourceId    string `json:"resourceId,omitempty"`
+	Method        string `json:"method"`
+	Url           string `json:"url"`
+	Token         string `json:"-"` // V-Auth-Token, stored but never shown
+	Body          string `json:"body,omitempty"`
+	Expected      []int  `json:"expected"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	Owner         string `json:"owner,omitempty"`
+	NextAttemptOn string `json:"nextAttemptOn"`
+	CreatedOn     string `json:"createdOn"`
+	LastError     string `json:"lastError,omitempty"`
+}
+
+type Outbox struct {
+	session *mgo.Session
+	name    string
+	Lease   time.Duration // how long a callback being delivered stays invisible
+}
+
+// OpenOutbox opens the outbox kept in the given collection of the CloudIO db.
+func OpenOutbox(name string) (*Outbox, error) {
+	session, err := mgo.Dial(util.GetString("database", "host") + ":" + util.GetString("database", "port"))
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbox{session: session, name: name, Lease: time.Minute}
+	if err := o.ensureIndexes(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Outbox) callbacks() (*mgo.Session, *mgo.Collection) {
+	s := o.session.Copy()
+	return s, s.DB(Database).C(o.name)
+}
+
+func (o *Outbox) ensureIndexes() error {
+	s, callbacks := o.callbacks()
+	defer s.Close()
+	if err := callbacks.EnsureIndex(mgo.Index{Key: []string{"status", "nextattempton"}}); err != nil {
+		return err
+	}
+	return callbacks.EnsureIndex(mgo.Index{Key: []string{"assetid", "createdon"}})
+}
+
+func (o *Outbox) Close() {
+	o.session.Close()
+}
+
+// Record adds the callback, to be delivered right away. One recorded
+// already under the id of cb is left as it is.
+func (o *Outbox) Record(cb *Callback) error {
+	s, callbacks := o.callbacks()
+	defer s.Close()
+	if cb.Id == "" {
+		cb.Id = NewUUID()
+	}
+	cb.Status, cb.Attempts, cb.Owner = CallbackPending, 0, ""
+	cb.CreatedOn = Now()
+	cb.NextAttemptOn = cb.CreatedOn
+	if err := callbacks.Insert(cb); !mgo.IsDup(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+ * Claim leases the next pending callback due to owner, nil when there is
+ * none. The callbacks of an asset request are delivered in the order they
+ * were recorded: one with an older callback still pending is left alone.
+ */
+func (o *Outbox) Claim(owner string) (*Callback, error) {
+	s, callbacks := o.callbacks()
+	defer s.Close()
+	var due []Callback
+	err := callbacks.Find(bson.M{"status": CallbackPending, "nextattempton": bson.M{"$lte": Now()}}).
+		Sort("nextattempton").Limit(20).All(&due)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range due {
+		older, err := callbacks.Find(bson.M{"assetid": candidate.AssetId, "status": CallbackPending,
+			"createdon": bson.M{"$lt": candidate.CreatedOn}}).Count()
+		if err != nil {
+			return nil, err
+		}
+		if older > 0 {
+			continue
+		}
+		cb := new(Callback)
+		change := mgo.Change{
+			Update: bson.M{
+				"$set": bson.M{"owner": owner, "nextattempton": FormatTime(time.Now().Add(o.Lease))},
+				"$inc": bson.M{"attempts": 1},
+			},
+			ReturnNew: true,
+		}
+		_, err = callbacks.Find(bson.M{"_id": candidate.Id, "status": CallbackPending,
+			"nextattempton": candidate.NextAttemptOn}).Apply(change, cb)
+		if err == mgo.ErrNotFound {
+			// claimed by another meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return cb, nil
+	}
+	return nil, nil
+}
+
+// Delivered removes a callback Vertex acknowledged.
+func (o *Outbox) Delivered(cb *Callback) error {
+	s, callbacks := o.callbacks()
+	defer s.Close()
+	err := callbacks.Remove(bson.M{"_id": cb.Id, "owner": cb.Owner})
+	if err == mgo.ErrNotFound {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// Retry hands the callback back to be delivered after delay.
+func (o *Outbox) Retry(cb *Callback, delay time.Duration, cause error) error {
+	cb.LastError = cause.Error()
+	return o.update(cb, bson.M{"$set": bson.M{
+		"owner":         "",
+		"nextattempton": FormatTime(time.Now().Add(delay)),
+		"lasterror":     cb.LastError,
+	}})
+}
+
+// DeadLetter gives up delivering the callback, it stays until replayed.
+func (o *Outbox) DeadLetter(cb *Callback, cause error) error {
+	cb.LastError, cb.Status = cause.Error(), CallbackDeadLetter
+	return o.update(cb, bson.M{"$set": bson.M{
+		"owner":     "",
+		"status":    CallbackDeadLetter,
+		"lasterror": cb.LastError,
+	}})
+}
+
+func (o *Outbox) update(cb *Callback, change bson.M) error {
+	s, callbacks := o.callbacks()
+	defer s.Close()
+	err := callbacks.Update(bson.M{"_id": cb.Id, "owner": cb.Owner}, change)
+	if err == mgo.ErrNotFound {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+/*
+ * Replay delivers a dead letter again, from the first attempt. It goes
+ * after the callbacks of its asset request recorded before it that are
+ * still pending, as it would have. One recorded after it, a detach after
+ * an attach, has the last word and the dead letter isn't replayed.
+ */
+func (o *Outbox) Replay(id string) (*Callback, error) {
+	s, callbacks := o.callbacks()
+	defer s.Close()
+	if dead, err := o.Find(id); err == nil && dead.Status == CallbackDeadLetter {
+		later, err := callbacks.Find(bson.M{"assetid": dead.AssetId, "_id": bson.M{"$ne": dead.Id},
+			"createdon": bson.M{"$gt": dead.CreatedOn}}).Count()
+		if err != nil {
+			return nil, err
+		}
+		if later > 0 {
+			return nil, ErrSuperseded
+		}
+	}
+	cb := new(Callback)
+	change := mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"status":        CallbackPending,
+			"attempts":      0,
+			"owner":         "",
+			"nextattempton": Now(),
+		}},
+		ReturnNew: true,
+	}
+	_, err := callbacks.Find(bson.M{"_id": id, "status": CallbackDeadLetter}).Apply(change, cb)
+	if err != mgo.ErrNotFound {
+		return cb, err
+	}
+	if _, err := o.Find(id); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotDeadLetter
+}
+
+// Find is the callback by id, mgo.ErrNotFound once it is delivered.
+func (o *Outbox) Find(id string) (*Callback, error) {
+	s, callbacks := o.callbacks()
+	defer s.Close()
+	cb := new(Callback)
+	if err := callbacks.FindId(id).One(cb); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// List is the callbacks matching the criteria, oldest first.
+func (o *Outbox) List(criteria bson.M, limit int) ([]*Callback, error) {
+	s, callbacks := o.callbacks()
+	defer s.Close()
+	var cbs []*Callback
+	err := callbacks.Find(criteria).Sort("createdon").Limit(limit).All(&cbs)
+	return cbs, err
+}
@@ -0,0 +1,107 @@
+package persistence
+
+import (
+	"fmt"
+	"labix.org/v2/mgo"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type OutboxSuite struct {
+	outbox *Outbox
+}
+
+var _ = Suite(&OutboxSuite{})
+
+func (ob *OutboxSuite) SetUpSuite(c *C) {
+	session, err := mgo.DialWithTimeout("localhost:27017", time.Second)
+	if err != nil {
+		c.Skip("no mongo to run the outbox against: " + err.Error())
+	}
+	ob.outbox = &Outbox{session: session, name: "OutboxTest", Lease: time.Minute}
+	c.Assert(ob.outbox.ensureIndexes(), IsNil)
+}
+
+func (ob *OutboxSuite) SetUpTest(c *C) {
+	s, callbacks := ob.outbox.callbacks()
+	defer s.Close()
+	callbacks.DropCollection()
+	ob.outbox.ensureIndexes()
+}
+
+func (ob *OutboxSuite) TearDownSuite(c *C) {
+	if ob.outbox != nil {
+		ob.outbox.Close()
+	}
+}
+
+func (ob *OutboxSuite) TestInOrder(c *C) {
+	detach := &Callback{Kind: CallbackDetach, AssetId: "a1", Method: "DELETE", Url: "http://vertex/assets/a1"}
+	attach := &Callback{Kind: CallbackAttach, AssetId: "a1", Method: "POST", Url: "http://vertex/assets"}
+	other := &Callback{Kind: CallbackAttach, AssetId: "a2", Method: "POST", Url: "http://vertex/assets"}
+	for _, cb := range []*Callback{detach, attach, other} {
+		c.Assert(ob.outbox.Record(cb), IsNil)
+	}
+
+	first, err := ob.outbox.Claim("w1")
+	c.Assert(err, IsNil)
+	c.Assert(first.Id, Equals, detach.Id)
+	c.Assert(first.Attempts, Equals, 1)
+	// the attach of a1 waits for its detach, a2 doesn't
+	second, _ := ob.outbox.Claim("w2")
+	c.Assert(second.Id, Equals, other.Id)
+	none, _ := ob.outbox.Claim("w2")
+	c.Assert(none, IsNil)
+
+	c.Assert(ob.outbox.Delivered(first), IsNil)
+	third, _ := ob.outbox.Claim("w2")
+	c.Assert(third.Id, Equals, attach.Id)
+}
+
+func (ob *OutboxSuite) TestDeadLetterReplay(c *C) {
+	cb := &Callback{Kind: CallbackActivate, AssetId: "a1", Method: "PUT", Url: "http://vertex/resource/r1/activated"}
+	c.Assert(ob.outbox.Record(cb), IsNil)
+	_, err := ob.outbox.Replay(cb.Id)
+	c.Assert(err, Equals, ErrNotDeadLetter)
+
+	claimed, _ := ob.outbox.Claim("w1")
+	c.Assert(ob.outbox.Retry(claimed, -time.Second, fmt.Errorf("502")), IsNil)
+	claimed, _ = ob.outbox.Claim("w1")
+	c.Assert(claimed.Attempts, Equals, 2)
+	c.Assert(ob.outbox.DeadLetter(claimed, fmt.Errorf("503")), IsNil)
+	none, _ := ob.outbox.Claim("w1")
+	c.Assert(none, IsNil)
+
+	dead, err := ob.outbox.List(map[string]interface{}{"status": CallbackDeadLetter}, 10)
+	c.Assert(err, IsNil)
+	c.Assert(dead, HasLen, 1)
+	c.Assert(dead[0].LastError, Equals, "503")
+
+	replayed, err := ob.outbox.Replay(cb.Id)
+	c.Assert(err, IsNil)
+	c.Assert(replayed.Status, Equals, CallbackPending)
+	c.Assert(replayed.Attempts, Equals, 0)
+	claimed, _ = ob.outbox.Claim("w1")
+	c.Assert(claimed.Id, Equals, cb.Id)
+	c.Assert(ob.outbox.Delivered(claimed), IsNil)
+	_, err = ob.outbox.Replay(cb.Id)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
+
+func (ob *OutboxSuite) TestReplaySuperseded(c *C) {
+	attach := &Callback{Kind: CallbackAttach, AssetId: "a1", Method: "POST", Url: "http://vertex/assets"}
+	c.Assert(ob.outbox.Record(attach), IsNil)
+	claimed, _ := ob.outbox.Claim("w1")
+	c.Assert(ob.outbox.DeadLetter(claimed, fmt.Errorf("503")), IsNil)
+
+	time.Sleep(time.Millisecond)
+	detach := &Callback{Id: "detach:a1", Kind: CallbackDetach, AssetId: "a1", Method: "DELETE", Url: "http://vertex/assets/a1"}
+	c.Assert(ob.outbox.Record(detach), IsNil)
+	// recorded once, however often the delete is retried
+	c.Assert(ob.outbox.Record(&Callback{Id: "detach:a1", Kind: CallbackDetach, AssetId: "a1"}), IsNil)
+	pending, _ := ob.outbox.List(map[string]interface{}{"assetid": "a1", "status": CallbackPending}, 10)
+	c.Assert(pending, HasLen, 1)
+
+	_, err := ob.outbox.Replay(attach.Id)
+	c.Assert(err, Equals, ErrSuperseded)
+}
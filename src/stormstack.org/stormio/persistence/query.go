@@ -0,0 +1,214 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"strings"
+	"time"
+)
+
+const (
+	// TimeLayout is a fixed width UTC layout, stored timestamps sort
+	// lexicographically in the same order as chronologically.
+	TimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+	// Layout of the times stored before TimeLayout, time.Time.String()
+	legacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// Fields the asset request listing can be sorted on, keyed by their json name.
+var sortFields = map[string]string{
+	"id":         "_id",
+	"receivedOn": "receivedon",
+	"status":     "status",
+	"hostName":   "hostname",
+	"resource":   "resourceid",
+}
+
+// Page describes one page of a cursor paginated asset request listing.
+type Page struct {
+	Criteria bson.M
+	SortBy   string // json name of the sort field, defaults to receivedOn
+	Desc     bool
+	Limit    int
+	Cursor   string // opaque cursor returned with the previous page
+}
+
+// QueryError is a page FindPage can't list as asked, the caller's to fix.
+type QueryError struct {
+	Reason string
+}
+
+func (qe *QueryError) Error() string {
+	return qe.Reason
+}
+
+type cursor struct {
+	Value string `json:"v"`
+	Id    string `json:"id"`
+}
+
+func Now() string {
+	return FormatTime(time.Now())
+}
+
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeLayout)
+}
+
+// ParseTime reads an RFC3339 timestamp in the layout times are stored in
+func ParseTime(value string) (string, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("must be an RFC3339 timestamp")
+	}
+	return FormatTime(t), nil
+}
+
+func IsSortField(name string) bool {
+	_, ok := sortFields[name]
+	return ok
+}
+
+func sortValue(ar *AssetRequest, name string) string {
+	switch name {
+	case "receivedOn":
+		return ar.ReceivedOn
+	case "status":
+		return ar.Status
+	case "hostName":
+		return ar.HostName
+	case "resource":
+		return ar.ResourceId
+	}
+	return ar.Id
+}
+
+func encodeCursor(c *cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &QueryError{"Invalid cursor"}
+	}
+	c := new(cursor)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, &QueryError{"Invalid cursor"}
+	}
+	return c, nil
+}
+
+/*
+ * The receivedOn of a request stored before TimeLayout in TimeLayout, false
+ * when it already is or can't be read.
+ */
+func legacyTime(value string) (string, bool) {
+	// the monotonic clock reading time.Time.String() may end with
+	value = strings.SplitN(value, " m=", 2)[0]
+	t, err := time.Parse(legacyTimeLayout, value)
+	if err != nil {
+		return "", false
+	}
+	return FormatTime(t), true
+}
+
+/*
+ * MigrateReceivedOn rewrites the receivedOn of the requests stored before
+ * TimeLayout, which would otherwise sort and filter apart from the others in
+ * the listing. Those it can't read are left as they are.
+ */
+func MigrateReceivedOn() (migrated int, err error) {
+	conn, err := DefaultSession()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var legacy []struct {
+		Id         string `bson:"_id"`
+		ReceivedOn string `bson:"receivedon"`
+	}
+	criteria := bson.M{"receivedon": bson.M{"$gt": "", "$not": bson.RegEx{Pattern: `^\d{4}-\d{2}-\d{2}T`}}}
+	if err = conn.collection.Find(criteria).Select(bson.M{"receivedon": 1}).All(&legacy); err != nil {
+		return 0, err
+	}
+	for _, ar := range legacy {
+		receivedOn, ok := legacyTime(ar.ReceivedOn)
+		if !ok {
+			continue
+		}
+		err = conn.collection.Update(bson.M{"_id": ar.Id, "receivedon": ar.ReceivedOn}, bson.M{"$set": bson.M{"receivedon": receivedOn}})
+		if err != nil && err != mgo.ErrNotFound {
+			return migrated, err
+		}
+		if err == nil {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+/*
+ * FindPage lists the asset requests matching the page criteria. Ties on the
+ * sort field are broken on _id, so the returned cursor stays stable while
+ * requests are being added.
+ */
+func (conn *Connection) FindPage(page *Page) (assets []*AssetRequest, next string, err error) {
+	if page.SortBy == "" {
+		page.SortBy = "receivedOn"
+	}
+	field, ok := sortFields[page.SortBy]
+	if !ok {
+		return nil, "", &QueryError{fmt.Sprintf("Can't sort on %s", page.SortBy)}
+	}
+	if page.Limit <= 0 {
+		page.Limit = DefaultPageSize
+	}
+	if page.Limit > MaxPageSize {
+		page.Limit = MaxPageSize
+	}
+
+	criteria := bson.M{}
+	for k, v := range page.Criteria {
+		criteria[k] = v
+	}
+	op, order := "$gt", ""
+	if page.Desc {
+		op, order = "$lt", "-"
+	}
+	if page.Cursor != "" {
+		c, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after := []bson.M{{"_id": bson.M{op: c.Id}}}
+		if field != "_id" {
+			after = []bson.M{{field: bson.M{op: c.Value}}, {field: c.Value, "_id": bson.M{op: c.Id}}}
+		}
+		criteria = bson.M{"$and": []bson.M{criteria, {"$or": after}}}
+	}
+
+	sort := []string{order + field}
+	if field != "_id" {
+		sort = append(sort, order+"_id")
+	}
+	// one more than asked for, tells whether there is a next page
+	err = conn.collection.Find(criteria).Sort(sort...).Limit(page.Limit + 1).All(&assets)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(assets) > page.Limit {
+		assets = assets[:page.Limit]
+		last := assets[len(assets)-1]
+		next = encodeCursor(&cursor{Value: sortValue(last, page.SortBy), Id: last.Id})
+	}
+	return
+}
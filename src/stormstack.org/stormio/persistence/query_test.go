@@ -0,0 +1,52 @@
+package persistence
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type QuerySuite struct{}
+
+var _ = Suite(&QuerySuite{})
+
+func (qs *QuerySuite) TestCursor(c *C) {
+	encoded := encodeCursor(&cursor{Value: "2026-03-01T08:00:00.000000000Z", Id: "a1"})
+	decoded, err := decodeCursor(encoded)
+	c.Assert(err, IsNil)
+	c.Assert(*decoded, Equals, cursor{Value: "2026-03-01T08:00:00.000000000Z", Id: "a1"})
+
+	for _, bad := range []string{"not base64!", "bm90IGpzb24=", "%%"} {
+		_, err := decodeCursor(bad)
+		qe, ok := err.(*QueryError)
+		c.Assert(ok, Equals, true, Commentf(bad))
+		c.Assert(qe.Error(), Equals, "Invalid cursor")
+	}
+}
+
+func (qs *QuerySuite) TestSortValue(c *C) {
+	ar := &AssetRequest{Id: "a1", ReceivedOn: "r", Status: RequestNew, HostName: "vcg", ResourceId: "res"}
+	for name, value := range map[string]string{"id": "a1", "receivedOn": "r", "status": RequestNew, "hostName": "vcg", "resource": "res"} {
+		c.Assert(IsSortField(name), Equals, true)
+		c.Assert(sortValue(ar, name), Equals, value)
+	}
+	c.Assert(IsSortField("password"), Equals, false)
+}
+
+func (qs *QuerySuite) TestLegacyTime(c *C) {
+	at := time.Date(2014, 3, 1, 10, 0, 0, 500, time.FixedZone("PST", -8*3600))
+	migrated, ok := legacyTime(at.String())
+	c.Assert(ok, Equals, true)
+	c.Assert(migrated, Equals, FormatTime(at))
+	c.Assert(migrated, Equals, "2014-03-01T18:00:00.000000500Z")
+
+	// with the monotonic clock reading
+	now := time.Now()
+	migrated, ok = legacyTime(now.String())
+	c.Assert(ok, Equals, true)
+	c.Assert(migrated, Equals, FormatTime(now))
+
+	_, ok = legacyTime(Now())
+	c.Assert(ok, Equals, false)
+	_, ok = legacyTime("yesterday")
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,185 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// AnyStatus registers a hook run on entering every status
+const AnyStatus = "*"
+
+var ErrGone = errors.New("Asset request no longer exists")
+
+/*
+ * The statuses an asset request can move to from each status. Deletion is
+ * the end of the line: a request MARKED_FOR_DELETION is only ever removed,
+ * it can't be picked up again by a retry.
+ */
+var transitions = map[string][]string{
+	RequestNew:                {RequestBuild, RequestFail, RequestMarkDeletion, RequestRemediation},
+	RequestBuild:              {RequestHalfFilled, RequestRetry, RequestFail, RequestMarkDeletion},
+	RequestRetry:              {RequestBuild, RequestFail, RequestMarkDeletion, RequestRemediation},
+	RequestHalfFilled:         {RequestProvision, RequestRetryModuleInstall, RequestRetryModuleConfig, RequestFulfilled, RequestNotifyFail, RequestRetry, RequestFail, RequestMarkDeletion, RequestRemediation},
+	RequestProvision:          {RequestRetryModuleInstall, RequestRetryModuleConfig, RequestFulfilled, RequestNotifyFail, RequestRetry, RequestFail, RequestMarkDeletion, RequestRemediation},
+	RequestRetryModuleInstall: {RequestProvision, RequestRetryModuleConfig, RequestFulfilled, RequestRetry, RequestFail, RequestMarkDeletion, RequestRemediation},
+	RequestRetryModuleConfig:  {RequestProvision, RequestRetryModuleInstall, RequestFulfilled, RequestRetry, RequestFail, RequestMarkDeletion, RequestRemediation},
+	RequestNotifyFail:         {RequestHalfFilled, RequestFulfilled, RequestRetry, RequestFail, RequestMarkDeletion, RequestRemediation},
+	RequestFulfilled:          {RequestMarkDeletion, RequestRemediation},
+	RequestFail:               {RequestMarkDeletion, RequestRemediation},
+	RequestRemediation:        {RequestBuild, RequestFail, RequestMarkDeletion},
+	RequestMarkDeletion:       {},
+}
+
+// TransitionError is returned for a move the state machine doesn't allow,
+// or when the request moved on since it was read.
+type TransitionError struct {
+	Id, From, To string
+	Stale        bool // the status was From when the move was tried, not the one read
+}
+
+func (te *TransitionError) Error() string {
+	if te.Stale {
+		return fmt.Sprintf("Asset request %s is now %s, can't move it to %s", te.Id, te.From, te.To)
+	}
+	return fmt.Sprintf("Asset request %s can't move from %s to %s", te.Id, te.From, te.To)
+}
+
+// IsStatusConflict tells whether err means the request is no longer in a
+// status where the work that was about to be done makes sense.
+func IsStatusConflict(err error) bool {
+	_, ok := err.(*TransitionError)
+	return ok || err == ErrGone
+}
+
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Hook is run once a request entered a status, from the one it left.
+type Hook func(ar *AssetRequest, from string)
+
+type StateMachine struct {
+	sync.RWMutex
+	hooks map[string][]Hook
+}
+
+func NewStateMachine() *StateMachine {
+	return &StateMachine{hooks: make(map[string][]Hook)}
+}
+
+// OnEnter registers a hook run after a request is saved in status, or in any status with AnyStatus.
+func (sm *StateMachine) OnEnter(status string, hook Hook) {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.hooks[status] = append(sm.hooks[status], hook)
+}
+
+/*
+ * Transition saves the request in status to, along with the rest of its
+ * fields. The save only goes through while the stored request is still in
+ * the status ar was read with, a request deleted or moved on meanwhile is
+ * left alone. Saving a request in the status it is in doesn't run the hooks.
+ */
+func (sm *StateMachine) Transition(conn *Connection, ar *AssetRequest, to string) error {
+	from := ar.Status
+	if from == to {
+		return conn.save(ar, from)
+	}
+	if !CanTransition(from, to) {
+		return &TransitionError{Id: ar.Id, From: from, To: to}
+	}
+
+	previous, changedOn := ar.PreviousStatus, ar.StatusChangedOn
+	ar.Status, ar.PreviousStatus, ar.StatusChangedOn = to, from, Now()
+	if err := conn.save(ar, from); err != nil {
+		ar.Status, ar.PreviousStatus, ar.StatusChangedOn = from, previous, changedOn
+		if te, ok := err.(*TransitionError); ok {
+			te.To = to
+		}
+		return err
+	}
+
+	sm.RLock()
+	hooks := append(append([]Hook{}, sm.hooks[to]...), sm.hooks[AnyStatus]...)
+	sm.RUnlock()
+	for _, hook := range hooks {
+		hook(ar, from)
+	}
+	return nil
+}
+
+/*
+ * The fields the API sets on their own, with Connection.Set, while a build
+ * may hold an older copy of the request. A save leaves them as stored.
+ */
+var ownFields = []string{"expiresat", "priority"}
+
+// The fields left out of the document when empty, unset when saved so
+var omitEmpty = func() (keys []string) {
+	t := reflect.TypeOf(AssetRequest{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("bson"), ",")
+		if len(tag) < 2 || tag[1] != "omitempty" {
+			continue
+		}
+		if tag[0] == "" {
+			tag[0] = strings.ToLower(t.Field(i).Name)
+		}
+		keys = append(keys, tag[0])
+	}
+	return
+}()
+
+// Saves ar as long as the stored request is in status from
+func (conn *Connection) save(ar *AssetRequest, from string) error {
+	update, err := changes(ar)
+	if err != nil {
+		return err
+	}
+	err = conn.collection.Update(bson.M{"_id": ar.Id, "status": from}, update)
+	if err != mgo.ErrNotFound {
+		return err
+	}
+	current, err := conn.Find(bson.M{"_id": ar.Id})
+	if err != nil {
+		return ErrGone
+	}
+	return &TransitionError{Id: ar.Id, From: current.Status, To: ar.Status, Stale: true}
+}
+
+// The update setting the fields of ar, but for its own fields
+func changes(ar *AssetRequest) (bson.M, error) {
+	raw, err := bson.Marshal(ar)
+	if err != nil {
+		return nil, err
+	}
+	set, unset := bson.M{}, bson.M{}
+	if err := bson.Unmarshal(raw, set); err != nil {
+		return nil, err
+	}
+	delete(set, "_id")
+	for _, key := range omitEmpty {
+		if _, found := set[key]; !found {
+			unset[key] = ""
+		}
+	}
+	for _, key := range ownFields {
+		delete(set, key)
+		delete(unset, key)
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, nil
+}
@@ -0,0 +1,87 @@
+package persistence
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type StatesSuite struct {
+	conn *Connection
+}
+
+var _ = Suite(&StatesSuite{})
+
+func (ss *StatesSuite) TestTransitions(c *C) {
+	c.Assert(CanTransition(RequestNew, RequestBuild), Equals, true)
+	c.Assert(CanTransition(RequestBuild, RequestHalfFilled), Equals, true)
+	c.Assert(CanTransition(RequestHalfFilled, RequestFulfilled), Equals, true)
+	c.Assert(CanTransition(RequestFulfilled, RequestBuild), Equals, false)
+	// deleted requests are never picked up again
+	for status := range transitions {
+		c.Assert(CanTransition(RequestMarkDeletion, status), Equals, false)
+		if status != RequestMarkDeletion {
+			c.Assert(CanTransition(status, RequestMarkDeletion), Equals, true, Commentf("from %s", status))
+		}
+	}
+}
+
+func (ss *StatesSuite) setUpConn(c *C) {
+	session, err := mgo.DialWithTimeout("localhost:27017", time.Second)
+	if err != nil {
+		c.Skip("no mongo to run the state machine against: " + err.Error())
+	}
+	ss.conn = &Connection{session: session, collection: session.DB(Database).C("AssetsTest")}
+	ss.conn.collection.DropCollection()
+}
+
+func (ss *StatesSuite) TestTransition(c *C) {
+	ss.setUpConn(c)
+	defer ss.conn.Close()
+	sm := NewStateMachine()
+	var entered []string
+	sm.OnEnter(RequestBuild, func(ar *AssetRequest, from string) { entered = append(entered, from+">"+ar.Status) })
+	sm.OnEnter(AnyStatus, func(ar *AssetRequest, from string) { entered = append(entered, "*"+ar.Status) })
+
+	ar := &AssetRequest{Id: NewUUID(), Status: RequestNew}
+	c.Assert(ss.conn.Create(ar), IsNil)
+	c.Assert(sm.Transition(ss.conn, ar, RequestBuild), IsNil)
+	c.Assert(ar.PreviousStatus, Equals, RequestNew)
+	c.Assert(ar.StatusChangedOn, Not(Equals), "")
+	c.Assert(entered, DeepEquals, []string{"NEW>BUILD", "*BUILD"})
+
+	err := sm.Transition(ss.conn, ar, RequestFulfilled)
+	c.Assert(err, FitsTypeOf, &TransitionError{})
+	c.Assert(ar.Status, Equals, RequestBuild)
+
+	// deleted meanwhile, a stale copy can't bring it back
+	stale := *ar
+	c.Assert(sm.Transition(ss.conn, ar, RequestMarkDeletion), IsNil)
+	c.Assert(sm.Transition(ss.conn, &stale, RequestRetry), ErrorMatches, ".* is now MARKED_FOR_DELETION, can't move it to RETRY")
+	c.Assert(ss.conn.Remove(ar.Id), IsNil)
+	c.Assert(sm.Transition(ss.conn, &stale, RequestRetry), Equals, ErrGone)
+	c.Assert(ss.conn.Update(&stale), Equals, ErrGone)
+	_, err = ss.conn.Find(map[string]string{"_id": ar.Id})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
+
+func (ss *StatesSuite) TestChanges(c *C) {
+	update, err := changes(&AssetRequest{Id: "a1", Status: RequestBuild, ExpiresAt: "stale", Priority: 5, Count: 2})
+	c.Assert(err, IsNil)
+	set, unset := update["$set"].(bson.M), update["$unset"].(bson.M)
+	c.Assert(set["status"], Equals, RequestBuild)
+	c.Assert(set["count"], Equals, 2)
+	// set on their own, left as stored
+	_, found := set["expiresat"]
+	c.Assert(found, Equals, false)
+	_, found = unset["expiresat"]
+	c.Assert(found, Equals, false)
+	_, found = set["priority"]
+	c.Assert(found, Equals, false)
+	_, found = set["_id"]
+	c.Assert(found, Equals, false)
+	// emptied since read
+	_, found = unset["groupid"]
+	c.Assert(found, Equals, true)
+}
@@ -0,0 +1,71 @@
+package persistence
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+/*
+ * The timeline of a request is the steps its server went through, recorded
+ * as they happen by whichever stormio takes them. It is kept apart from the
+ * request, whose saves replace it whole, and goes with it once deleted.
+ */
+
+const (
+	TimelineCollection = "Timeline"
+
+	LogInfo  = "INFO"
+	LogError = "ERROR"
+)
+
+// The steps of a timeline
+const (
+	StepRunServer  = "run-server"
+	StepActive     = "active"
+	StepFloatingIP = "floating-ip"
+	StepRegister   = "agent-registered"
+	StepNotify     = "notify"
+	StepRetry      = "retry"
+	StepFail       = "fail"
+)
+
+/*
+ * NewLog is the step begun at started, its duration up to now, or an
+ * instant one when started is zero. The step is an error when err is set.
+ */
+func NewLog(step string, started time.Time, err error, msg string) Log {
+	entry := Log{Step: step, Type: LogInfo, At: Now(), Msg: msg}
+	if !started.IsZero() {
+		entry.Duration = int64(time.Since(started) / time.Millisecond)
+	}
+	if err != nil {
+		entry.Type, entry.Error = LogError, err.Error()
+	}
+	return entry
+}
+
+func (conn *Connection) timeline() *mgo.Collection {
+	return conn.collection.Database.C(TimelineCollection)
+}
+
+// Record adds the entry to the timeline of the request
+func (conn *Connection) Record(assetId string, entry Log) error {
+	entry.AssetId = assetId
+	if entry.At == "" {
+		entry.At = Now()
+	}
+	return conn.timeline().Insert(&entry)
+}
+
+// Timeline is the steps of the request, oldest first
+func (conn *Connection) Timeline(assetId string) (entries []Log, err error) {
+	entries = []Log{}
+	err = conn.timeline().Find(bson.M{"assetid": assetId}).Sort("at", "_id").All(&entries)
+	return
+}
+
+func (conn *Connection) removeTimeline(assetId string) error {
+	_, err := conn.timeline().RemoveAll(bson.M{"assetid": assetId})
+	return err
+}
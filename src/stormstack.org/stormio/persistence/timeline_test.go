@@ -0,0 +1,24 @@
+package persistence
+
+import (
+	"errors"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type TimelineSuite struct{}
+
+var _ = Suite(&TimelineSuite{})
+
+func (ts *TimelineSuite) TestNewLog(c *C) {
+	entry := NewLog(StepActive, time.Now().Add(-1500*time.Millisecond), nil, "ACTIVE after 2 polls")
+	c.Assert(entry.Type, Equals, LogInfo)
+	c.Assert(entry.Error, Equals, "")
+	c.Assert(entry.Duration >= 1500, Equals, true)
+	c.Assert(entry.At <= Now(), Equals, true)
+
+	entry = NewLog(StepRetry, time.Time{}, errors.New("quota exceeded"), "")
+	c.Assert(entry.Type, Equals, LogError)
+	c.Assert(entry.Error, Equals, "quota exceeded")
+	c.Assert(entry.Duration, Equals, int64(0))
+}
@@ -0,0 +1,207 @@
+package persistence
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+/*
+ * Fields are checked against the rules in their `valid` tag:
+ *
+ *	required  must not be empty
+ *	url       an absolute http or https URL
+ *	hostname  an RFC 1123 host name
+ *	port      between 0 and 65535, each element for a slice
+ *
+ * Nested structs are walked, field names are reported with their json path.
+ */
+const validTag = "valid"
+
+var hostLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationError []FieldError
+
+func (ve ValidationError) Error() string {
+	msgs := make([]string, len(ve))
+	for i, fe := range ve {
+		msgs[i] = fe.Field + " " + fe.Message
+	}
+	return "Invalid request: " + strings.Join(msgs, ", ")
+}
+
+func (ve *ValidationError) add(field, format string, args ...interface{}) {
+	*ve = append(*ve, FieldError{field, fmt.Sprintf(format, args...)})
+}
+
+func (ve ValidationError) without(field string) (rest ValidationError) {
+	for _, fe := range ve {
+		if fe.Field != field {
+			rest = append(rest, fe)
+		}
+	}
+	return
+}
+
+// Validate checks the struct against the rules of its valid tags
+func Validate(v interface{}) ValidationError {
+	var errs ValidationError
+	validateStruct(reflect.Indirect(reflect.ValueOf(v)), "", &errs)
+	return errs
+}
+
+func (ar *AssetRequest) Validate() error {
+	errs := Validate(ar)
+	// storm agents are registered only when a tracker is given, that needs
+	// the stormlight domain to add the agent to
+	if cp := ar.ControlProvider; cp.StormtrackerURL != "" {
+		if cp.StormlightURL == "" {
+			errs.add("controlProvider.stormlight", "is required with a stormtracker")
+		}
+		if cp.DefaultDomainId == "" {
+			errs.add("controlProvider.domain", "is required with a stormtracker")
+		}
+	}
+	if ar.Count < 0 {
+		errs.add("count", "can't be negative")
+	}
+	// a group is on the resources of its members
+	if ar.Count > 1 {
+		errs = errs.without("resource")
+		if len(ar.Resources) != ar.Count {
+			errs.add("resources", "must list a resource for each of the %d members", ar.Count)
+		}
+		seen := make(map[string]bool)
+		for _, resource := range ar.Resources {
+			if resource == "" || seen[resource] {
+				errs.add("resources", "must be distinct and not empty")
+				break
+			}
+			seen[resource] = true
+		}
+	} else if len(ar.Resources) > 0 {
+		errs.add("resources", "is only for a count above one, resource is the one of the request")
+	}
+	if ar.Priority < 0 || ar.Priority > MaxPriority {
+		errs.add("priority", "must be between 0 and %d", MaxPriority)
+	}
+	notBefore, expiresAt := ar.NotBefore, ar.ExpiresAt
+	for field, value := range map[string]*string{"notBefore": &notBefore, "expiresAt": &expiresAt} {
+		if *value == "" {
+			continue
+		}
+		var err error
+		if *value, err = ParseTime(*value); err != nil {
+			errs.add(field, "%v", err)
+		}
+	}
+	if expiresAt != "" && (expiresAt <= Now() || expiresAt <= notBefore) {
+		errs.add("expiresAt", "must be after now and notBefore")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func ValidHostName(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if !hostLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+func ValidURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// JSONName is the name encoding/json uses for the field, "" when it is skipped
+func JSONName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+func Rules(field reflect.StructField) map[string]bool {
+	rules := make(map[string]bool)
+	for _, rule := range strings.Split(field.Tag.Get(validTag), ",") {
+		if rule != "" {
+			rules[rule] = true
+		}
+	}
+	return rules
+}
+
+func validateStruct(v reflect.Value, path string, errs *ValidationError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := JSONName(field)
+		if name == "" || field.PkgPath != "" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+		value := v.Field(i)
+		rules := Rules(field)
+		if value.Kind() == reflect.Struct {
+			validateStruct(value, name, errs)
+			continue
+		}
+		if rules["required"] && isEmpty(value) {
+			errs.add(name, "is required")
+			continue
+		}
+		if value.Kind() == reflect.String && value.String() != "" {
+			if rules["url"] && !ValidURL(value.String()) {
+				errs.add(name, "must be an absolute http(s) URL")
+			}
+			if rules["hostname"] && !ValidHostName(value.String()) {
+				errs.add(name, "must be a valid host name")
+			}
+		}
+		if rules["port"] {
+			validatePorts(value, name, errs)
+		}
+	}
+}
+
+func validatePorts(value reflect.Value, name string, errs *ValidationError) {
+	switch value.Kind() {
+	case reflect.Int:
+		if value.Int() < 0 || value.Int() > 65535 {
+			errs.add(name, "must be a port between 0 and 65535")
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			validatePorts(value.Index(i), fmt.Sprintf("%s[%d]", name, i), errs)
+		}
+	}
+}
+
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	}
+	return false
+}
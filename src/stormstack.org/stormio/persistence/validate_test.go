@@ -0,0 +1,113 @@
+package persistence
+
+import (
+	. "launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+type ValidateSuite struct{}
+
+var _ = Suite(&ValidateSuite{})
+
+// The errors reported on the field, the request being otherwise incomplete
+func fieldErrors(ar *AssetRequest, field string) (msgs []string) {
+	if errs, ok := ar.Validate().(ValidationError); ok {
+		for _, fe := range errs {
+			if fe.Field == field {
+				msgs = append(msgs, fe.Message)
+			}
+		}
+	}
+	return
+}
+
+func (vs *ValidateSuite) TestParseTime(c *C) {
+	t, err := ParseTime("2026-03-01T10:00:00+02:00")
+	c.Assert(err, IsNil)
+	c.Assert(t, Equals, FormatTime(time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)))
+	_, err = ParseTime("tomorrow")
+	c.Assert(err, NotNil)
+}
+
+func (vs *ValidateSuite) TestSchedule(c *C) {
+	now := time.Now()
+	soon, later := now.Add(time.Hour).Format(time.RFC3339), now.Add(2*time.Hour).Format(time.RFC3339)
+
+	c.Assert(fieldErrors(&AssetRequest{NotBefore: soon, ExpiresAt: later}, "expiresAt"), HasLen, 0)
+	c.Assert(fieldErrors(&AssetRequest{NotBefore: soon, ExpiresAt: later}, "notBefore"), HasLen, 0)
+	c.Assert(fieldErrors(&AssetRequest{NotBefore: "noon"}, "notBefore"), HasLen, 1)
+	c.Assert(fieldErrors(&AssetRequest{NotBefore: later, ExpiresAt: soon}, "expiresAt"), HasLen, 1)
+	past := now.Add(-time.Minute).Format(time.RFC3339)
+	c.Assert(fieldErrors(&AssetRequest{ExpiresAt: past}, "expiresAt"), HasLen, 1)
+}
+
+func (vs *ValidateSuite) TestPriority(c *C) {
+	c.Assert(fieldErrors(&AssetRequest{Priority: 50}, "priority"), HasLen, 0)
+	// the default, as for a request given none
+	c.Assert(fieldErrors(&AssetRequest{Priority: 0}, "priority"), HasLen, 0)
+	c.Assert(fieldErrors(&AssetRequest{Priority: MaxPriority + 1}, "priority"), DeepEquals, []string{"must be between 0 and 100"})
+	c.Assert(fieldErrors(&AssetRequest{Priority: -1}, "priority"), HasLen, 1)
+}
+
+func (vs *ValidateSuite) TestResources(c *C) {
+	c.Assert(fieldErrors(&AssetRequest{Count: 2, Resources: []string{"r1", "r2"}}, "resources"), HasLen, 0)
+	c.Assert(fieldErrors(&AssetRequest{Count: 2, Resources: []string{"r1", "r2"}}, "resource"), HasLen, 0)
+	c.Assert(fieldErrors(&AssetRequest{Count: 2, ResourceId: "r1"}, "resources"), HasLen, 1)
+	c.Assert(fieldErrors(&AssetRequest{Count: 2, Resources: []string{"r1", "r1"}}, "resources"), HasLen, 1)
+	c.Assert(fieldErrors(&AssetRequest{Resources: []string{"r1"}}, "resources"), HasLen, 1)
+	c.Assert(fieldErrors(&AssetRequest{}, "resource"), HasLen, 1)
+}
+
+type ruled struct {
+	Name   string `json:"name" valid:"required"`
+	Host   string `json:"host" valid:"hostname"`
+	Link   string `json:"link" valid:"url"`
+	Port   int    `json:"port" valid:"port"`
+	Ports  []int  `json:"ports" valid:"port"`
+	Nested struct {
+		Tags []string `json:"tags" valid:"required"`
+	} `json:"nested"`
+}
+
+func (vs *ValidateSuite) TestRules(c *C) {
+	valid := func() ruled {
+		r := ruled{Name: "n", Host: "vm-1.example.com", Link: "https://example.com/x", Port: 443, Ports: []int{0, 65535}}
+		r.Nested.Tags = []string{"t"}
+		return r
+	}
+	for i, t := range []struct {
+		change func(*ruled)
+		field  string
+	}{
+		{func(r *ruled) {}, ""},
+		{func(r *ruled) { r.Name = "" }, "name"},
+		{func(r *ruled) { r.Nested.Tags = nil }, "nested.tags"},
+		{func(r *ruled) { r.Host = "" }, ""},
+		{func(r *ruled) { r.Host = "vm_1" }, "host"},
+		{func(r *ruled) { r.Host = "-vm" }, "host"},
+		{func(r *ruled) { r.Host = "vm..example" }, "host"},
+		{func(r *ruled) { r.Host = strings.Repeat("a", 64) }, "host"},
+		{func(r *ruled) { r.Host = "example.com." }, ""},
+		{func(r *ruled) { r.Link = "" }, ""},
+		{func(r *ruled) { r.Link = "http://example.com" }, ""},
+		{func(r *ruled) { r.Link = "ftp://example.com" }, "link"},
+		{func(r *ruled) { r.Link = "/relative" }, "link"},
+		{func(r *ruled) { r.Link = "https://" }, "link"},
+		{func(r *ruled) { r.Port = 0 }, ""},
+		{func(r *ruled) { r.Port = 65536 }, "port"},
+		{func(r *ruled) { r.Port = -1 }, "port"},
+		{func(r *ruled) { r.Ports = []int{22, 70000} }, "ports[1]"},
+	} {
+		r := valid()
+		t.change(&r)
+		errs := Validate(&r)
+		if t.field == "" {
+			c.Check(errs, HasLen, 0, Commentf("case %d", i))
+			continue
+		}
+		if c.Check(errs, HasLen, 1, Commentf("case %d", i)) {
+			c.Check(errs[0].Field, Equals, t.field, Commentf("case %d", i))
+		}
+	}
+}
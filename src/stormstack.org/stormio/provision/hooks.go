@@ -0,0 +1,238 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goose/nova"
+	"net/http"
+	"stormstack.org/stormio/conf"
+	"stormstack.org/stormio/persistence"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Hooks are HTTP calls made at the phases of a server, for other systems,
+ * an IPAM or a CMDB, to have a say or take note. A phase lists its hooks,
+ * called in that order, and the options of a hook are prefixed with its name:
+ *
+ *	[hooks]
+ *	before-run-server=ipam
+ *	after-fip=ipam,cmdb
+ *	ipam.url=https://ipam.example.com/stormio
+ *	ipam.timeout=5
+ *	cmdb.url=https://cmdb.example.com/servers
+ *	cmdb.fail-open=true
+ *	cmdb.token=secret
+ *
+ * A hook is POSTed a HookEvent and answers 2xx, with a HookResult or an
+ * empty body. One failing, by its answer or its timeout, fails the phase
+ * unless it is fail-open. What the hooks before RunServer hand back goes
+ * into the options of the server.
+ */
+
+const (
+	PhaseBeforeRunServer = "before-run-server"
+	PhaseAfterActive     = "after-active"
+	PhaseAfterFIP        = "after-fip"
+	PhaseBeforeDelete    = "before-delete"
+	PhaseAfterDelete     = "after-delete"
+)
+
+var phases = map[string]bool{PhaseBeforeRunServer: true, PhaseAfterActive: true, PhaseAfterFIP: true,
+	PhaseBeforeDelete: true, PhaseAfterDelete: true}
+
+type Hook struct {
+	Name     string
+	URL      string
+	Timeout  time.Duration
+	FailOpen bool   // a failure is logged, the phase goes on
+	Token    string // sent as a bearer token when set
+}
+
+// What a hook is told of the server
+type HookEvent struct {
+	Phase      string `json:"phase"`
+	AssetId    string `json:"assetId"`
+	ResourceId string `json:"resourceId"`
+	GroupId    string `json:"groupId,omitempty"`
+	HostName   string `json:"hostName"`
+	Flavor     string `json:"flavor"`
+	Image      string `json:"image"`
+	ServerId   string `json:"serverId,omitempty"`
+	IpAddress  string `json:"ipAddress,omitempty"`
+}
+
+// What a hook may hand back, heeded before RunServer only
+type HookResult struct {
+	HostName string            `json:"hostName,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type HookError struct {
+	Hook  string
+	Phase string
+	Err   error
+}
+
+func (he *HookError) Error() string {
+	return fmt.Sprintf("Hook %s %s failed: %v", he.Hook, he.Phase, he.Err)
+}
+
+type Hooks struct {
+	phases map[string][]*Hook
+	client *http.Client
+}
+
+func NewHookEvent(phase string, ar *persistence.AssetRequest) *HookEvent {
+	return &HookEvent{Phase: phase, AssetId: ar.Id, ResourceId: ar.ResourceId, GroupId: ar.GroupId,
+		HostName: ar.HostName, Flavor: ar.Model.Flavor, Image: ar.Model.Image, ServerId: ar.ServerId,
+		IpAddress: ar.IpAddress}
+}
+
+// LoadHooks reads the hooks of every phase from the section, none without it.
+func LoadHooks(c *conf.ConfigFile, section string) (*Hooks, error) {
+	h := &Hooks{phases: make(map[string][]*Hook), client: &http.Client{}}
+	if !c.HasSection(section) {
+		return h, nil
+	}
+	options, err := c.GetOptions(section)
+	if err != nil {
+		return nil, err
+	}
+	hooks := make(map[string]*Hook)
+	for _, option := range options {
+		value, _ := c.GetString(section, option)
+		dot := strings.Index(option, ".")
+		if dot < 0 {
+			if !phases[option] {
+				return nil, fmt.Errorf("[%s] %s: unknown phase", section, option)
+			}
+			continue
+		}
+		name := option[:dot]
+		hook, found := hooks[name]
+		if !found {
+			hook = &Hook{Name: name, Timeout: 10 * time.Second}
+			hooks[name] = hook
+		}
+		switch option[dot+1:] {
+		case "url":
+			hook.URL = value
+		case "timeout":
+			hook.Timeout, err = seconds(value)
+		case "fail-open":
+			hook.FailOpen, err = strconv.ParseBool(value)
+		case "token":
+			hook.Token = value
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %s=%s: %v", section, option, value, err)
+		}
+	}
+	for phase := range phases {
+		value, err := c.GetString(section, phase)
+		if err != nil || value == "" {
+			continue
+		}
+		for _, name := range strings.Split(value, ",") {
+			hook, found := hooks[strings.TrimSpace(name)]
+			if !found || hook.URL == "" {
+				return nil, fmt.Errorf("[%s] %s: hook %s has no url", section, phase, strings.TrimSpace(name))
+			}
+			h.phases[phase] = append(h.phases[phase], hook)
+		}
+	}
+	return h, nil
+}
+
+/*
+ * Run calls the hooks of the phase of the event, in order, each seeing the
+ * host name handed back by the ones before. The results are merged, the
+ * later hooks having the last word.
+ */
+func (h *Hooks) Run(ctx context.Context, event *HookEvent) (*HookResult, error) {
+	if h == nil || len(h.phases[event.Phase]) == 0 {
+		return nil, nil
+	}
+	merged := &HookResult{Metadata: make(map[string]string)}
+	for _, hook := range h.phases[event.Phase] {
+		result, err := hook.call(ctx, h.client, event)
+		if err != nil {
+			if hook.FailOpen && ctx.Err() == nil {
+				log.Warnf("[areq %s] Hook %s %s failed, going on :%v", event.AssetId, hook.Name, event.Phase, err)
+				continue
+			}
+			log.Errorf("[areq %s] Hook %s %s failed :%v", event.AssetId, hook.Name, event.Phase, err)
+			return nil, &HookError{hook.Name, event.Phase, err}
+		}
+		if result.HostName != "" {
+			merged.HostName, event.HostName = result.HostName, result.HostName
+		}
+		for key, value := range result.Metadata {
+			merged.Metadata[key] = value
+		}
+	}
+	return merged, nil
+}
+
+func (hook *Hook) call(ctx context.Context, client *http.Client, event *HookEvent) (*HookResult, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+hook.Token)
+	}
+	log.Debugf("[areq %s] Calling hook %s %s at %s", event.AssetId, hook.Name, event.Phase, hook.URL)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	result := &HookResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unreadable answer: %v", err)
+	}
+	return result, nil
+}
+
+/*
+ * apply puts what the hooks handed back into the options of the server.
+ * The metadata stormio tells its servers by isn't theirs to change.
+ */
+func (result *HookResult) apply(opts *nova.RunServerOpts, asset *persistence.AssetRequest) {
+	if result == nil {
+		return
+	}
+	if result.HostName != "" {
+		log.Infof("[areq %s] Hooks named the server %s", asset.Id, result.HostName)
+		opts.Name, asset.HostName = result.HostName, result.HostName
+	}
+	for key, value := range result.Metadata {
+		if key == ManagedKey || key == AssetKey || key == EnvironmentKey {
+			continue
+		}
+		opts.Metadata[key] = value
+	}
+}
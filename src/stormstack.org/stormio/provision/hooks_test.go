@@ -0,0 +1,86 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"launchpad.net/goose/nova"
+	"net/http"
+	"net/http/httptest"
+	"stormstack.org/stormio/conf"
+	"stormstack.org/stormio/persistence"
+	"time"
+)
+
+type HooksSuite struct{}
+
+var _ = Suite(&HooksSuite{})
+
+func (s *HooksSuite) TestLoad(c *C) {
+	cfg, _ := conf.ReadConfigBytes([]byte("[hooks]\nbefore-run-server=ipam, cmdb\nipam.url=http://ipam\nipam.timeout=2.5\n" +
+		"cmdb.url=http://cmdb\ncmdb.fail-open=true\n"))
+	h, err := LoadHooks(cfg, "hooks")
+	c.Assert(err, IsNil)
+	hooks := h.phases[PhaseBeforeRunServer]
+	c.Assert(hooks, HasLen, 2)
+	c.Assert(hooks[0].Name, Equals, "ipam")
+	c.Assert(hooks[0].Timeout, Equals, 2500*time.Millisecond)
+	c.Assert(hooks[1].FailOpen, Equals, true)
+	c.Assert(hooks[1].Timeout, Equals, 10*time.Second)
+
+	for _, bad := range []string{"before-create=ipam", "after-fip=cmdb", "ipam.url=http://ipam\nipam.retries=2",
+		"ipam.url=http://ipam\nipam.fail-open=maybe"} {
+		cfg, _ := conf.ReadConfigBytes([]byte("[hooks]\n" + bad + "\n"))
+		_, err := LoadHooks(cfg, "hooks")
+		c.Assert(err, NotNil, Commentf(bad))
+	}
+}
+
+func (s *HooksSuite) TestRun(c *C) {
+	var seen []HookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event HookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		seen = append(seen, event)
+		switch r.URL.Path {
+		case "/ipam":
+			w.Write([]byte(`{"hostName": "vcg-042", "metadata": {"subnet": "10.1.0.0/24", "stormtracker": "x"}}`))
+		case "/cmdb":
+			w.WriteHeader(http.StatusNoContent)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			http.Error(w, "no", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	hook := func(name string, failOpen bool) *Hook {
+		return &Hook{Name: name, URL: server.URL + "/" + name, Timeout: 50 * time.Millisecond, FailOpen: failOpen}
+	}
+	h := &Hooks{client: &http.Client{}, phases: map[string][]*Hook{
+		PhaseBeforeRunServer: {hook("ipam", false), hook("slow", true), hook("cmdb", false)},
+		PhaseAfterFIP:        {hook("broken", false)},
+	}}
+	ar := &persistence.AssetRequest{Id: "a1", HostName: "vcg"}
+
+	result, err := h.Run(context.Background(), NewHookEvent(PhaseBeforeRunServer, ar))
+	c.Assert(err, IsNil)
+	c.Assert(seen, HasLen, 3)
+	// the ones after ipam see the name it gave
+	c.Assert(seen[2].HostName, Equals, "vcg-042")
+	opts := &nova.RunServerOpts{Name: "vcg", Metadata: map[string]string{ManagedKey: "tracker"}}
+	result.apply(opts, ar)
+	c.Assert(opts.Name, Equals, "vcg-042")
+	c.Assert(ar.HostName, Equals, "vcg-042")
+	c.Assert(opts.Metadata, DeepEquals, map[string]string{ManagedKey: "tracker", "subnet": "10.1.0.0/24"})
+
+	_, err = h.Run(context.Background(), NewHookEvent(PhaseAfterFIP, ar))
+	he, ok := err.(*HookError)
+	c.Assert(ok, Equals, true)
+	c.Assert(he.Hook, Equals, "broken")
+
+	var none *Hooks
+	result, err = none.Run(context.Background(), NewHookEvent(PhaseAfterDelete, ar))
+	c.Assert(result, IsNil)
+	c.Assert(err, IsNil)
+}
@@ -9,7 +9,8 @@ import (
 func ValidateAssetProvider(ap *dba.AssetProvider) (authDetails *identity.AuthDetails,err error) {
 	log.Debugf("Validating asset provider details :%v", ap)
     userpass:=&identity.UserPass{}
-	creds := &identity.Credentials{URL: ap.EndPointURL,
+	// the tokens of the endpoint, as the goose client authenticating the provisioning does
+	creds := &identity.Credentials{URL: ap.EndPointURL + "/tokens",
 		User:       ap.Username,
 		Secrets:    ap.Password,
 		Region:     ap.RegionName,
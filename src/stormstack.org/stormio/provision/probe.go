@@ -0,0 +1,66 @@
+package provision
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+	"time"
+)
+
+// Keystone service types which can be probed
+const (
+	ServiceCompute     = "compute"
+	ServiceImage       = "image"
+	ServiceNetwork     = "network"
+	ServiceObjectStore = "object-store"
+)
+
+type ProbeResult struct {
+	Service  string `json:"service"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Ok       bool   `json:"ok"`
+	Latency  int64  `json:"latencyMs"`
+	Error    string `json:"error,omitempty"`
+}
+
+func IsProbeable(service string) bool {
+	switch service {
+	case ServiceCompute, ServiceImage, ServiceNetwork, ServiceObjectStore:
+		return true
+	}
+	return false
+}
+
+/*
+ * ProbeService makes one cheap read only call against the given service
+ * and reports how long it took. The error is returned in the result, only
+ * an unknown service is an error to the caller.
+ */
+func (svc *ServiceProvision) ProbeService(service string) (*ProbeResult, error) {
+	if !IsProbeable(service) {
+		return nil, fmt.Errorf("Unknown service %s", service)
+	}
+	result := &ProbeResult{Service: service}
+	start := time.Now()
+	var err error
+	switch service {
+	case ServiceCompute:
+		_, err = svc.nova.ListFlavors()
+	case ServiceImage:
+		_, err = svc.glance.ListImages()
+	case ServiceNetwork:
+		_, err = svc.neutron.ListNetworks()
+	case ServiceObjectStore:
+		_, err = svc.swift.List("", "", "", "", 1)
+	}
+	result.Latency = int64(time.Since(start) / time.Millisecond)
+	if endpoint, uerr := svc.client.MakeServiceURL(service, nil); uerr == nil {
+		result.Endpoint = endpoint
+	}
+	if err != nil {
+		log.Debugf("Probing %s failed after %dms :%v", service, result.Latency, err)
+		result.Error = err.Error()
+		return result, nil
+	}
+	result.Ok = true
+	return result, nil
+}
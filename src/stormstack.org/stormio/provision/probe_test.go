@@ -0,0 +1,74 @@
+package provision
+
+import (
+	. "launchpad.net/gocheck"
+	"launchpad.net/goose/identity"
+	"launchpad.net/goose/testservices/openstackservice"
+	"net/http"
+	"net/http/httptest"
+	"stormstack.org/stormio/persistence"
+)
+
+/*
+ * ProbeSuite probes an OpenStack double, keystone and nova, the service
+ * URLs given by the provider, its network endpoint always failing.
+ */
+type ProbeSuite struct {
+	cloud    *httptest.Server
+	broken   *httptest.Server
+	provider *persistence.AssetProvider
+}
+
+var _ = Suite(&ProbeSuite{})
+
+func (s *ProbeSuite) SetUpSuite(c *C) {
+	cloud := http.NewServeMux()
+	s.cloud = httptest.NewServer(cloud)
+	creds := &identity.Credentials{URL: s.cloud.URL, User: "fred", Secrets: "secret", Region: "r1", TenantName: "t1"}
+	openstackservice.New(creds).SetupHTTP(cloud)
+	s.broken = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	s.provider = &persistence.AssetProvider{EndPointURL: s.cloud.URL, Username: "fred", Password: "secret",
+		Tenant: "t1", RegionName: "r1", Compute: s.cloud.URL + "/v2/1", Neutron: s.broken.URL}
+}
+
+func (s *ProbeSuite) TearDownSuite(c *C) {
+	s.cloud.Close()
+	s.broken.Close()
+}
+
+func (s *ProbeSuite) TestProbeCompute(c *C) {
+	result, err := NewServiceProvision(s.provider).ProbeService(ServiceCompute)
+	c.Assert(err, IsNil)
+	c.Assert(result.Ok, Equals, true)
+	c.Assert(result.Service, Equals, ServiceCompute)
+	c.Assert(result.Error, Equals, "")
+	c.Assert(result.Endpoint, Equals, s.provider.Compute)
+	c.Assert(result.Latency >= 0, Equals, true)
+}
+
+func (s *ProbeSuite) TestProbeFailure(c *C) {
+	result, err := NewServiceProvision(s.provider).ProbeService(ServiceNetwork)
+	c.Assert(err, IsNil)
+	c.Assert(result.Ok, Equals, false)
+	c.Assert(result.Service, Equals, ServiceNetwork)
+	c.Assert(result.Endpoint, Equals, s.broken.URL)
+	c.Assert(result.Error, Not(Equals), "")
+}
+
+func (s *ProbeSuite) TestProbeUnauthorized(c *C) {
+	provider := *s.provider
+	provider.Password = "guessed"
+	result, err := NewServiceProvision(&provider).ProbeService(ServiceCompute)
+	c.Assert(err, IsNil)
+	c.Assert(result.Ok, Equals, false)
+	c.Assert(result.Error, Not(Equals), "")
+}
+
+func (s *ProbeSuite) TestProbeUnknown(c *C) {
+	c.Assert(IsProbeable("dns"), Equals, false)
+	result, err := NewServiceProvision(s.provider).ProbeService("dns")
+	c.Assert(err, ErrorMatches, "Unknown service dns")
+	c.Assert(result, IsNil)
+}
@@ -0,0 +1,180 @@
+package provision
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+	"launchpad.net/goose/nova"
+	"stormstack.org/stormio/util"
+	"strings"
+)
+
+// The resources of the tenant a request is admitted on
+const (
+	ResourceInstances   = "instances"
+	ResourceCores       = "cores"
+	ResourceRAM         = "ram" // in MB
+	ResourceFloatingIPs = "floatingIps"
+)
+
+var resources = []string{ResourceInstances, ResourceCores, ResourceRAM, ResourceFloatingIPs}
+
+/*
+ * Quota is what the tenant may have of each resource and what it has, as
+ * Nova reports it in its absolute limits, the floating ips as the floating
+ * ip service does. A negative limit is no limit.
+ */
+type Quota struct {
+	Limit map[string]int `json:"limit"`
+	Used  map[string]int `json:"used"`
+}
+
+// Available is what is left of the resource, -1 when it isn't limited
+func (q *Quota) Available(resource string) int {
+	limit := q.Limit[resource]
+	if limit < 0 {
+		return -1
+	}
+	if left := limit - q.Used[resource]; left > 0 {
+		return left
+	}
+	return 0
+}
+
+type Shortage struct {
+	Resource  string `json:"resource"`
+	Needed    int    `json:"needed"`
+	Available int    `json:"available"`
+}
+
+// QuotaError lists the resources of the tenant a request doesn't fit in
+type QuotaError []Shortage
+
+func (qe QuotaError) Error() string {
+	msgs := make([]string, len(qe))
+	for i, s := range qe {
+		msgs[i] = fmt.Sprintf("%s (%d needed, %d available)", s.Resource, s.Needed, s.Available)
+	}
+	return "Quota exhausted: " + strings.Join(msgs, ", ")
+}
+
+// Admit checks the needs against what is left, a QuotaError when some don't fit
+func (q *Quota) Admit(needed map[string]int) error {
+	var qe QuotaError
+	for _, resource := range resources {
+		available := q.Available(resource)
+		if available >= 0 && needed[resource] > available {
+			qe = append(qe, Shortage{resource, needed[resource], available})
+		}
+	}
+	if len(qe) > 0 {
+		return qe
+	}
+	return nil
+}
+
+// UnknownFlavor is the flavor of a model the provider doesn't have
+type UnknownFlavor string
+
+func (uf UnknownFlavor) Error() string {
+	return fmt.Sprintf("No such flavor %s", string(uf))
+}
+
+// Quota reads the limits of the tenant and its usage of them
+func (svc *ServiceProvision) Quota() (*Quota, error) {
+	limits, err := svc.nova.GetLimits()
+	if err != nil {
+		return nil, err
+	}
+	abs := limits.Absolute
+	quota := &Quota{
+		Limit: map[string]int{ResourceInstances: abs.MaxTotalInstances, ResourceCores: abs.MaxTotalCores, ResourceRAM: abs.MaxTotalRAMSize},
+		Used:  map[string]int{ResourceInstances: abs.TotalInstancesUsed, ResourceCores: abs.TotalCoresUsed, ResourceRAM: abs.TotalRAMUsed},
+	}
+	if quota.Limit[ResourceFloatingIPs], quota.Used[ResourceFloatingIPs], err = svc.floatingSvc.Quota(&abs); err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+/*
+ * Admit checks that count servers of the flavor fit in what is left of the
+ * quota of the tenant: instances, the vCPUs and RAM of the flavor, and a
+ * floating ip each.
+ */
+func (svc *ServiceProvision) Admit(flavor string, count int) error {
+	detail, err := svc.findFlavor(flavor)
+	if err != nil {
+		return err
+	}
+	quota, err := svc.Quota()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Admitting %d servers of flavor %s on quota %v", count, flavor, quota)
+	return quota.Admit(map[string]int{
+		ResourceInstances:   count,
+		ResourceCores:       count * detail.VCPUs,
+		ResourceRAM:         count * detail.RAM,
+		ResourceFloatingIPs: count,
+	})
+}
+
+// The flavor by id, or by name
+func (svc *ServiceProvision) findFlavor(flavor string) (*nova.FlavorDetail, error) {
+	flavors, err := svc.nova.ListFlavorsDetail()
+	if err != nil {
+		return nil, err
+	}
+	for i := range flavors {
+		if flavors[i].Id == flavor || flavors[i].Name == flavor {
+			return &flavors[i], nil
+		}
+	}
+	return nil, UnknownFlavor(flavor)
+}
+
+/*
+ * The floating ips in use are those associated to a server, the others get
+ * released when one is needed.
+ */
+func (fpno *FIPWithNova) Quota(limits *nova.AbsoluteLimits) (limit, used int, err error) {
+	limit = capFIP(limits.MaxTotalFloatingIps)
+	ips, err := fpno.nova.ListFloatingIPs(nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, ip := range ips {
+		if ip.InstanceId != nil {
+			used++
+		}
+	}
+	return limit, used, nil
+}
+
+// The limit is the floatingip quota of the tenant in Neutron
+func (fipne *FIPWithNeutron) Quota(_ *nova.AbsoluteLimits) (limit, used int, err error) {
+	quota, err := fipne.neutron.GetQuota(fipne.tenantId)
+	if err != nil {
+		return 0, 0, err
+	}
+	filter := util.NewFilter()
+	filter.Set("tenant_id", fipne.tenantId)
+	fips, err := fipne.neutron.ListFloatingIPs(&filter.Params)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, fip := range fips {
+		if fip.PortId != "" {
+			used++
+		}
+	}
+	return capFIP(quota.FloatingIP), used, nil
+}
+
+// [openstack] maximum-fip caps the limit the cloud reports, -1 being none
+func capFIP(limit int) int {
+	if max := util.GetIntDefault("openstack", "maximum-fip", 0); max > 0 && (limit < 0 || max < limit) {
+		return max
+	}
+	return limit
+}
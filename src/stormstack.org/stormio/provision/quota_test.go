@@ -0,0 +1,47 @@
+package provision
+
+import (
+	. "launchpad.net/gocheck"
+	"stormstack.org/stormio/conf"
+	"stormstack.org/stormio/util"
+)
+
+type QuotaSuite struct{}
+
+var _ = Suite(&QuotaSuite{})
+
+func (s *QuotaSuite) TestAdmit(c *C) {
+	quota := &Quota{
+		Limit: map[string]int{ResourceInstances: 10, ResourceCores: 20, ResourceRAM: 32768, ResourceFloatingIPs: -1},
+		Used:  map[string]int{ResourceInstances: 4, ResourceCores: 18, ResourceRAM: 8192, ResourceFloatingIPs: 100},
+	}
+	c.Assert(quota.Available(ResourceCores), Equals, 2)
+	c.Assert(quota.Available(ResourceFloatingIPs), Equals, -1)
+
+	c.Assert(quota.Admit(map[string]int{ResourceInstances: 1, ResourceCores: 2, ResourceRAM: 4096, ResourceFloatingIPs: 1}), IsNil)
+
+	err := quota.Admit(map[string]int{ResourceInstances: 2, ResourceCores: 4, ResourceRAM: 32768, ResourceFloatingIPs: 2})
+	qe, ok := err.(QuotaError)
+	c.Assert(ok, Equals, true)
+	c.Assert(qe, DeepEquals, QuotaError{{ResourceCores, 4, 2}, {ResourceRAM, 32768, 24576}})
+	c.Assert(err.Error(), Equals, "Quota exhausted: cores (4 needed, 2 available), ram (32768 needed, 24576 available)")
+}
+
+func (s *QuotaSuite) TestOverused(c *C) {
+	quota := &Quota{Limit: map[string]int{ResourceInstances: 2}, Used: map[string]int{ResourceInstances: 3}}
+	c.Assert(quota.Available(ResourceInstances), Equals, 0)
+	c.Assert(quota.Admit(map[string]int{ResourceInstances: 1}), DeepEquals, QuotaError{{ResourceInstances, 1, 0}})
+}
+
+func (s *QuotaSuite) TestCapFIP(c *C) {
+	saved := util.Config
+	defer func() { util.Config = saved }()
+	util.Config, _ = conf.ReadConfigBytes([]byte("[openstack]\nmaximum-fip=5\n"))
+	c.Assert(capFIP(-1), Equals, 5)
+	c.Assert(capFIP(10), Equals, 5)
+	c.Assert(capFIP(3), Equals, 3)
+
+	util.Config, _ = conf.ReadConfigBytes([]byte("[openstack]\n"))
+	c.Assert(capFIP(-1), Equals, -1)
+	c.Assert(capFIP(10), Equals, 10)
+}
@@ -0,0 +1,179 @@
+package provision
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"stormstack.org/stormio/conf"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * RetryPolicy says how often and how soon a failed provisioning is tried
+ * again. The n-th retry waits Initial * Multiplier^(n-1), capped to Max, give
+ * or take Jitter of it so requests failing together don't come back together.
+ */
+type RetryPolicy struct {
+	MaxAttempts int
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64 // 0 to 1
+	Terminal    bool    // the error won't go away by trying again
+}
+
+// Exhausted tells whether a request attempted that many times is given up.
+func (p *RetryPolicy) Exhausted(attempts int) bool {
+	return p.Terminal || attempts >= p.MaxAttempts
+}
+
+// Backoff is the wait before the next attempt, after that many failed ones.
+func (p *RetryPolicy) Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := float64(p.Initial) * math.Pow(p.Multiplier, float64(attempts-1))
+	if delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+	delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(delay)
+}
+
+// Names of the ProvisionError codes in the [retry] section
+var errorNames = map[string]int{
+	"server-create":    ErrorServerCreate,
+	"associate-ip":     ErrorAssociateIP,
+	"setting-hostname": ErrorSettingHostName,
+	"find-flavor":      ErrorFindFlavor,
+	"find-image":       ErrorFindImage,
+	"server-detail":    ErrorServerDetail,
+	"storm-register":   ErrorStormRegister,
+	"hook":             ErrorHook,
+}
+
+type RetryPolicies struct {
+	Default RetryPolicy
+	codes   map[int]*RetryPolicy
+}
+
+// DefaultRetryPolicies retries every error 5 times from 10s up to 5min,
+// except a missing flavor or image.
+func DefaultRetryPolicies() *RetryPolicies {
+	rp := &RetryPolicies{
+		Default: RetryPolicy{MaxAttempts: 5, Initial: 10 * time.Second, Max: 5 * time.Minute, Multiplier: 2, Jitter: 0.2},
+		codes:   make(map[int]*RetryPolicy),
+	}
+	for _, code := range []int{ErrorFindFlavor, ErrorFindImage} {
+		terminal := rp.Default
+		terminal.Terminal = true
+		rp.codes[code] = &terminal
+	}
+	return rp
+}
+
+/*
+ * LoadRetryPolicies reads the defaults from the section, and the policy of
+ * an error code from the options prefixed with its name, falling back to the
+ * defaults for what isn't set.
+ *
+ *	[retry]
+ *	max-attempts=5
+ *	initial-backoff=10
+ *	max-backoff=300
+ *	multiplier=2
+ *	jitter=0.2
+ *	associate-ip.max-attempts=10
+ *	find-image.terminal=true
+ */
+func LoadRetryPolicies(c *conf.ConfigFile, section string) (*RetryPolicies, error) {
+	rp := DefaultRetryPolicies()
+	options, err := c.GetOptions(section)
+	if err != nil {
+		return rp, nil
+	}
+	for _, option := range options {
+		if dot := strings.Index(option, "."); dot > 0 {
+			if _, found := errorNames[option[:dot]]; !found {
+				return nil, fmt.Errorf("[%s] %s: unknown error code %s", section, option, option[:dot])
+			}
+		}
+	}
+	if err := readPolicy(c, section, "", &rp.Default); err != nil {
+		return nil, err
+	}
+	for name, code := range errorNames {
+		policy := rp.Default
+		policy.Terminal = rp.For(&ProvisionError{Code: code}).Terminal
+		if err := readPolicy(c, section, name+".", &policy); err != nil {
+			return nil, err
+		}
+		rp.codes[code] = &policy
+	}
+	return rp, nil
+}
+
+// LoadRetryPolicy reads a single policy from the section, over the given defaults.
+func LoadRetryPolicy(c *conf.ConfigFile, section string, defaults RetryPolicy) (*RetryPolicy, error) {
+	p := defaults
+	if !c.HasSection(section) {
+		return &p, nil
+	}
+	if err := readPolicy(c, section, "", &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func readPolicy(c *conf.ConfigFile, section, prefix string, p *RetryPolicy) error {
+	options, err := c.GetOptions(section)
+	if err != nil {
+		return err
+	}
+	for _, option := range options {
+		if !strings.HasPrefix(option, prefix) || strings.Contains(option[len(prefix):], ".") {
+			continue
+		}
+		value, _ := c.GetString(section, option)
+		switch name := option[len(prefix):]; name {
+		case "max-attempts":
+			p.MaxAttempts, err = strconv.Atoi(value)
+		case "initial-backoff":
+			p.Initial, err = seconds(value)
+		case "max-backoff":
+			p.Max, err = seconds(value)
+		case "multiplier":
+			p.Multiplier, err = strconv.ParseFloat(value, 64)
+		case "jitter":
+			p.Jitter, err = strconv.ParseFloat(value, 64)
+			if err == nil && (p.Jitter < 0 || p.Jitter > 1) {
+				err = fmt.Errorf("not between 0 and 1")
+			}
+		case "terminal":
+			p.Terminal, err = strconv.ParseBool(value)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return fmt.Errorf("[%s] %s=%s: %v", section, option, value, err)
+		}
+	}
+	return nil
+}
+
+func seconds(value string) (time.Duration, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	return time.Duration(n * float64(time.Second)), err
+}
+
+// For is the policy of the error, the default one unless it is a ProvisionError with its own.
+func (rp *RetryPolicies) For(err error) *RetryPolicy {
+	if perr, ok := err.(*ProvisionError); ok {
+		if policy, found := rp.codes[perr.Code]; found {
+			return policy
+		}
+	}
+	return &rp.Default
+}
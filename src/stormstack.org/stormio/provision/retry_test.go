@@ -0,0 +1,75 @@
+package provision
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"stormstack.org/stormio/conf"
+	"time"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+func (s *RetrySuite) TestBackoff(c *C) {
+	p := &RetryPolicy{MaxAttempts: 4, Initial: 10 * time.Second, Max: time.Minute, Multiplier: 2}
+	c.Assert(p.Backoff(1), Equals, 10*time.Second)
+	c.Assert(p.Backoff(3), Equals, 40*time.Second)
+	c.Assert(p.Backoff(5), Equals, time.Minute)
+	c.Assert(p.Exhausted(3), Equals, false)
+	c.Assert(p.Exhausted(4), Equals, true)
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := p.Backoff(1)
+		c.Assert(delay >= 5*time.Second && delay <= 15*time.Second, Equals, true, Commentf("%v", delay))
+	}
+}
+
+func (s *RetrySuite) TestDefaults(c *C) {
+	rp := DefaultRetryPolicies()
+	c.Assert(rp.For(&ProvisionError{ErrorFindImage, nil}).Exhausted(1), Equals, true)
+	c.Assert(rp.For(&ProvisionError{ErrorServerCreate, nil}).Exhausted(1), Equals, false)
+	c.Assert(rp.For(fmt.Errorf("no credentials")), Equals, &rp.Default)
+}
+
+func (s *RetrySuite) TestLoad(c *C) {
+	cfg, err := conf.ReadConfigBytes([]byte("[retry]\nmax-attempts=3\ninitial-backoff=1.5\n" +
+		"associate-ip.max-attempts=10\nassociate-ip.multiplier=3\nfind-flavor.terminal=false\n"))
+	c.Assert(err, IsNil)
+	rp, err := LoadRetryPolicies(cfg, "retry")
+	c.Assert(err, IsNil)
+	c.Assert(rp.Default.MaxAttempts, Equals, 3)
+	c.Assert(rp.Default.Initial, Equals, 1500*time.Millisecond)
+
+	ip := rp.For(&ProvisionError{ErrorAssociateIP, nil})
+	c.Assert(ip.MaxAttempts, Equals, 10)
+	c.Assert(ip.Multiplier, Equals, 3.0)
+	c.Assert(ip.Initial, Equals, 1500*time.Millisecond)
+	c.Assert(rp.For(&ProvisionError{ErrorFindFlavor, nil}).Terminal, Equals, false)
+	c.Assert(rp.For(&ProvisionError{ErrorFindImage, nil}).Terminal, Equals, true)
+
+	for _, bad := range []string{"retries=3", "find-imag.terminal=true", "jitter=2", "server-create.max-attempts=many"} {
+		cfg, _ := conf.ReadConfigBytes([]byte("[retry]\n" + bad + "\n"))
+		_, err := LoadRetryPolicies(cfg, "retry")
+		c.Assert(err, NotNil, Commentf(bad))
+	}
+}
+
+func (s *RetrySuite) TestLoadPolicy(c *C) {
+	defaults := RetryPolicy{MaxAttempts: 10, Initial: time.Second, Max: time.Minute, Multiplier: 2}
+	cfg, _ := conf.ReadConfigBytes([]byte("[outbox]\nmax-attempts=3\n"))
+	p, err := LoadRetryPolicy(cfg, "outbox", defaults)
+	c.Assert(err, IsNil)
+	c.Assert(p.MaxAttempts, Equals, 3)
+	c.Assert(p.Max, Equals, time.Minute)
+	p, err = LoadRetryPolicy(cfg, "missing", defaults)
+	c.Assert(err, IsNil)
+	c.Assert(*p, Equals, defaults)
+}
+
+func (s *RetrySuite) TestCreateErrorCode(c *C) {
+	c.Assert(createErrorCode(fmt.Errorf("failed to run a server: Can not find requested image")), Equals, ErrorFindImage)
+	c.Assert(createErrorCode(fmt.Errorf("Flavor 42 could not be found")), Equals, ErrorFindFlavor)
+	c.Assert(createErrorCode(fmt.Errorf("Quota exceeded for instances")), Equals, ErrorServerCreate)
+}
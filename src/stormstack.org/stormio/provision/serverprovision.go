@@ -1,6 +1,7 @@
 package provision
 
 import (
+	"context"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"launchpad.net/goose/client"
@@ -8,10 +9,12 @@ import (
 	"launchpad.net/goose/identity"
 	"launchpad.net/goose/neutron"
 	"launchpad.net/goose/nova"
+	"launchpad.net/goose/swift"
 	"net"
 	persistence "stormstack.org/stormio/persistence"
 	"stormstack.org/stormio/stormstack"
 	"stormstack.org/stormio/util"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,12 +25,17 @@ type FloatingIPService interface {
 	Dettach(floatingIp string) (err error)
 	Retain(serverId, fip string) (ip string, err error)
 	Track(fip string)
+	Delete(fip string)
+	// the limit and the ips in use, for admission
+	Quota(limits *nova.AbsoluteLimits) (limit, used int, err error)
 }
 
 type ServiceProvision struct {
+	client      client.AuthenticatingClient
 	nova        *nova.Client
 	glance      *glance.Client
 	neutron     *neutron.Client
+	swift       *swift.Client
 	floatingSvc FloatingIPService
 }
 
@@ -39,6 +47,7 @@ const (
 	ErrorFindImage
 	ErrorServerDetail
 	ErrorStormRegister
+	ErrorHook
 )
 
 type RemediationList struct {
@@ -54,6 +63,25 @@ type FIPWithNova struct {
 type FIPWithNeutron struct {
 	neutron *neutron.Client
 	*RemediationList
+	tenantId string // the quota is looked up by
+}
+
+// Metadata set on every server stormio creates, to tell them apart from the others of the tenant
+const (
+	ManagedKey     = "stormtracker"
+	AssetKey       = "stormioAssetId"
+	EnvironmentKey = "stormioEnvironment" // [application] environment of the stormio
+)
+
+// A server created by stormio, as Nova has it
+type Server struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Status      string   `json:"status"`
+	AssetId     string   `json:"assetId,omitempty"`
+	Environment string   `json:"environment,omitempty"`
+	Created     string   `json:"created"`
+	Addresses   []string `json:"addresses,omitempty"`
 }
 
 type ProvisionError struct {
@@ -76,10 +104,10 @@ func NewServiceProvision(provider *persistence.AssetProvider) *ServiceProvision
 	glance := glance.New(client)
 	neutron := neutron.New(client)
 	//check network capabilities
-	svp := &ServiceProvision{nova: nova, glance: glance, neutron: neutron}
+	svp := &ServiceProvision{client: client, nova: nova, glance: glance, neutron: neutron, swift: swift.New(client)}
 	rmdtrk := &RemediationList{remediationList: make(map[string]string)}
 	if networks, _ := neutron.ListNetworks(); len(networks) > 0 {
-		svp.floatingSvc = &FIPWithNeutron{neutron, rmdtrk}
+		svp.floatingSvc = &FIPWithNeutron{neutron, rmdtrk, client.TenantId()}
 	} else {
 		svp.floatingSvc = &FIPWithNova{nova, rmdtrk}
 	}
@@ -124,7 +152,15 @@ func (svc *ServiceProvision) Ping() error {
 	return nil
 }
 
-func (svc *ServiceProvision) ProvisionInstance(asset *persistence.AssetRequest) (entityId string, fip string, err error) {
+/*
+ * ProvisionInstance builds the server of the asset request, calling the
+ * hooks of the phases on the way. Once ctx is cancelled it stops at the next
+ * step and returns ctx.Err(), along with the server and floating ip it got
+ * that far, for the caller to roll back. The steps are handed to record for
+ * the timeline of the request as they are done.
+ */
+func (svc *ServiceProvision) ProvisionInstance(ctx context.Context, asset *persistence.AssetRequest, hooks *Hooks,
+	record func(persistence.Log)) (entityId string, fip string, err error) {
 	log.Debugf("[areq %s][res %s] Inside ProvisionInstance", asset.Id, asset.ResourceId)
 	model := asset.Model
 
@@ -133,35 +169,66 @@ func (svc *ServiceProvision) ProvisionInstance(asset *persistence.AssetRequest)
 	metadata["nexusUrl"] = util.GetString("meta-data", "nexus-url")
 	// Set the metadata with token
 	stormdata := stormstack.BuildStormData(asset)
-	metadata["stormtracker"] = stormdata
+	metadata[ManagedKey] = stormdata
+	metadata[AssetKey] = asset.Id
+	if env := util.GetString("application", "environment"); env != "" {
+		metadata[EnvironmentKey] = env
+	}
 
 	serverOpts := &nova.RunServerOpts{Name: asset.HostName, FlavorId: model.Flavor, ImageId: model.Image,
 		MinCount: 1, MaxCount: 1, Metadata: metadata}
+	result, err := hooks.Run(ctx, NewHookEvent(PhaseBeforeRunServer, asset))
+	if err != nil {
+		err = &ProvisionError{ErrorHook, err}
+		return
+	}
+	result.apply(serverOpts, asset)
 	log.Debugf("[areq %s][res %s] Creating the server with options %v", asset.Id, asset.ResourceId, serverOpts)
+	started := time.Now()
 	entity, err := svc.createInstance(serverOpts)
 	if err != nil {
 		log.Errorf("[areq %s][res %s] Unable to create the server %v", asset.Id, asset.ResourceId, err)
-		err = &ProvisionError{ErrorServerCreate, err}
+		record(persistence.NewLog(persistence.StepRunServer, started, err, "RunServer "+serverOpts.Name))
+		err = &ProvisionError{createErrorCode(err), err}
 		return
 	}
 	entityId = entity.Id
+	record(persistence.NewLog(persistence.StepRunServer, started, nil, "RunServer "+serverOpts.Name+", server "+entityId))
 
-	delayedUnit := 0
-	if delayedUnit, err = svc.waitServerToStart(entity.Id); err != nil {
-		err = &ProvisionError{ErrorServerCreate, err}
+	started = time.Now()
+	delayedUnit, err := svc.waitServerToStart(ctx, entity.Id)
+	if err != nil {
+		record(persistence.NewLog(persistence.StepActive, started, err, fmt.Sprintf("Not ACTIVE after %d polls", delayedUnit)))
+		if ctx.Err() == nil {
+			err = &ProvisionError{ErrorServerCreate, err}
+		}
+		return
+	}
+	record(persistence.NewLog(persistence.StepActive, started, nil, fmt.Sprintf("ACTIVE after %d polls", delayedUnit)))
+	event := NewHookEvent(PhaseAfterActive, asset)
+	event.ServerId = entityId
+	if _, err = hooks.Run(ctx, event); err != nil {
+		err = &ProvisionError{ErrorHook, err}
 		return
 	}
 
-	time.Sleep(time.Duration(guessDelay(delayedUnit)) * time.Second)
+	if err = sleep(ctx, time.Duration(guessDelay(delayedUnit))*time.Second); err != nil {
+		return
+	}
+	started = time.Now()
 	if asset.Remediation {
 		fip, err = svc.floatingSvc.Retain(entity.Id, asset.IpAddress)
 	} else {
 		fip, err = svc.floatingSvc.Attach(entity.Id)
 	}
+	record(persistence.NewLog(persistence.StepFloatingIP, started, err, fip))
 	if err != nil {
 		err = &ProvisionError{ErrorAssociateIP, err}
 		return
 	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	address, err := net.LookupAddr(fip)
 	if err != nil && len(address) > 0 {
 		for _, address := range address {
@@ -204,11 +271,21 @@ func (svc *ServiceProvision) ProvisionInstance(asset *persistence.AssetRequest)
 		err = &ProvisionError{ErrorAssociateIP, fmt.Errorf("Unable to allocate floating ip")}
 		return
 	}
+	event.Phase, event.IpAddress = PhaseAfterFIP, fip
+	if _, err = hooks.Run(ctx, event); err != nil {
+		err = &ProvisionError{ErrorHook, err}
+		return
+	}
 
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	// Register a new agent with StormTracker
 	log.Debugf("[areq %s][res %s] About to register with stormtracker", asset.Id, asset.ResourceId)
 	if stormdata != "" {
+		started = time.Now()
 		err = stormstack.RegisterStormAgent(asset, entityId)
+		record(persistence.NewLog(persistence.StepRegister, started, err, "Agent "+asset.AgentId))
 		if err != nil {
 			log.Debugf("[areq %s][res %s] Unable to register Storm Agent %v", asset.Id, asset.ResourceId, err)
 			err = &ProvisionError{ErrorStormRegister, err}
@@ -217,6 +294,32 @@ func (svc *ServiceProvision) ProvisionInstance(asset *persistence.AssetRequest)
 	return
 }
 
+// Nova refuses the server with a 400 naming the image or flavor it can't find
+func createErrorCode(err error) int {
+	msg := strings.ToLower(err.Error())
+	if !strings.Contains(msg, "not found") && !strings.Contains(msg, "can not find") &&
+		!strings.Contains(msg, "could not be found") && !strings.Contains(msg, "invalid") {
+		return ErrorServerCreate
+	}
+	switch {
+	case strings.Contains(msg, "image"):
+		return ErrorFindImage
+	case strings.Contains(msg, "flavor"):
+		return ErrorFindFlavor
+	}
+	return ErrorServerCreate
+}
+
+// Sleeps for d, ctx.Err() when it is cancelled meanwhile
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func guessDelay(delayedUnit int) int {
 	delayTime := util.GetInt("module-option", "delay-between-os-calls")
 	if delayedUnit == 1 {
@@ -301,13 +404,14 @@ func (svc *ServiceProvision) findFlavorId(flavorName string) (string, error) {
 	return flavorId, nil
 }
 
-//Terminate this instance with this Asset request
+// Terminate this instance with this Asset request
 func (svc *ServiceProvision) DeprovisionInstance(ar *persistence.AssetRequest) error {
 	/*Also delete the floating IP, the IP will be release from the pool.
 	If this is the remediation request, don't release back to the pool.
 	*/
 	if ar.Remediation {
-		svc.floatingSvc.Dettach(ar.IpAddress)
+		// deleting the server lets go of its floating ip, which stays with
+		// the tenant for the rebuilt one as long as nobody releases it
 		svc.floatingSvc.Track(ar.IpAddress)
 	}
 	err := svc.nova.DeleteServer(ar.ServerId)
@@ -318,6 +422,62 @@ func (svc *ServiceProvision) DeprovisionInstance(ar *persistence.AssetRequest) e
 	return err
 }
 
+/*
+ * Servers lists the servers stormio created on the provider, the ones
+ * carrying the stormtracker metadata. AssetId is empty on the servers
+ * created before the asset request was put in the metadata as well.
+ */
+func (svc *ServiceProvision) Servers() ([]Server, error) {
+	details, err := svc.nova.ListServersDetail(nova.NewFilter())
+	if err != nil {
+		return nil, err
+	}
+	var servers []Server
+	for _, detail := range details {
+		if _, ok := detail.Metadata[ManagedKey]; !ok {
+			continue
+		}
+		server := Server{Id: detail.Id, Name: detail.Name, Status: detail.Status,
+			AssetId: detail.Metadata[AssetKey], Environment: detail.Metadata[EnvironmentKey], Created: detail.Created}
+		for _, addresses := range detail.Addresses {
+			for _, address := range addresses {
+				if address.Version == 4 {
+					server.Addresses = append(server.Addresses, address.Address)
+				}
+			}
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+/*
+ * DeleteServer deletes a server no asset request knows of and releases its
+ * floating ips, the fixed addresses aren't found among them.
+ */
+func (svc *ServiceProvision) DeleteServer(server *Server) error {
+	if err := svc.nova.DeleteServer(server.Id); err != nil {
+		return err
+	}
+	for _, ip := range server.Addresses {
+		if err := svc.floatingSvc.Dettach(ip); err != nil {
+			log.Debugf("%s of server %s not released :%v", ip, server.Id, err)
+		}
+	}
+	return nil
+}
+
+// TrackFloatingIP keeps the ip from being released while its server is rebuilt
+func (svc *ServiceProvision) TrackFloatingIP(ip string) {
+	svc.floatingSvc.Track(ip)
+}
+
+// ReleaseFloatingIP gives the ip back to the pool, retained for a rebuild or not
+func (svc *ServiceProvision) ReleaseFloatingIP(ip string) error {
+	svc.floatingSvc.Delete(ip)
+	return svc.floatingSvc.Dettach(ip)
+}
+
 func (svc *ServiceProvision) RenameServer(serverId, newName string) (err error) {
 	_, err = svc.nova.RenameServer(serverId, newName)
 	return
@@ -482,6 +642,10 @@ func (fipne *FIPWithNeutron) Attach(serverId string) (string, error) {
 		log.Debugf("Floating IP allocation failed, trying to release the floatings from the pool")
 		if fips, err := fipne.neutron.ListFloatingIPs(&filter.Params); err == nil {
 			for _, fip := range fips {
+				if fipne.Find(fip.FloatingIPAddress) {
+					//don't delete, there remediation requests going on
+					continue
+				}
 				if fip.PortId == "" {
 					log.Debugf("Releasing FIP:%v Port:%v", fip, _port)
 					// _fip := &neutron.FloatingIP{PortId: _port.Id}
@@ -541,7 +705,7 @@ func (svc *ServiceProvision) CheckAvailability() (count int, err error) {
 	return svc.floatingSvc.CheckAvailability()
 }
 
-func (svc *ServiceProvision) waitServerToStart(serverId string) (delayedUnit int, err error) {
+func (svc *ServiceProvision) waitServerToStart(ctx context.Context, serverId string) (delayedUnit int, err error) {
 	delayedUnit = 1
 	// Wait until the  server is actually running
 	log.Infof("waiting the server %s to start...", serverId)
@@ -549,20 +713,22 @@ func (svc *ServiceProvision) waitServerToStart(serverId string) (delayedUnit int
 		server, err := svc.nova.GetServer(serverId)
 		if err != nil {
 			log.Errorf("Unable to get server details %v", err)
-			break
+			return delayedUnit, err
 		}
 
 		if server.Status == nova.StatusActive {
-			err = nil
 			break
 		}
 
 		if server.Status == nova.StatusError {
-			break
+			return delayedUnit, fmt.Errorf("Server %s is in status %s", serverId, server.Status)
 		}
 		// We dont' want to flood the connection while polling the server waiting for it to start.
 		log.Debugf("server has status %s, waiting 10 seconds before polling again...", server.Status)
-		time.Sleep(10 * time.Second)
+		if err := sleep(ctx, 10*time.Second); err != nil {
+			log.Infof("stopped waiting for the server %s :%v", serverId, err)
+			return delayedUnit, err
+		}
 		delayedUnit += 1
 	}
 	log.Info("started")
@@ -1,11 +1,16 @@
 package provision
 
 import (
-	"stormstack.org/stormio/persistence"
-	"stormstack.org/stormio/util"
+	"context"
 	"fmt"
 	log "github.com/cihub/seelog"
 	. "launchpad.net/gocheck"
+	"launchpad.net/goose/client"
+	"launchpad.net/goose/nova"
+	"net/http"
+	"net/http/httptest"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/util"
 	"testing"
 	"time"
 )
@@ -35,9 +40,9 @@ func (hp *HPSuite) _TestServerCreateHP(c *C) {
 		EndPointURL: "https://region-a.geo-1.identity.hpcloudsvc.com:35357/v2.0/", RegionName: "region-b.geo-1"}
 	assetModel := &persistence.AssetModel{Name: "kvm", Flavor: "standard.xsmall", Image: "ClearPath_Cloudnode_3.8.0_20131208", Id: persistence.NewUUID()}
 	assetReq := persistence.AssetRequest{HostName: "Testing Host", ResourceId: persistence.NewUUID(),
-		ReceivedOn: time.Now().String(), Provider: assetProvider, Model: assetModel}
+		ReceivedOn: time.Now().String(), Provider: *assetProvider, Model: *assetModel}
 	nsp := NewServiceProvision(assetProvider)
-	eId, fip, err := nsp.ProvisionInstance(&assetReq)
+	eId, fip, err := nsp.ProvisionInstance(context.Background(), &assetReq, nil, func(persistence.Log) {})
 	if err != nil {
 		c.Error(err)
 	}
@@ -53,11 +58,44 @@ func _TestServerCreate(t *testing.T) {
 		EndPointURL: "http://vhub1.dev.intercloud.net:5000/v2.0", RegionName: "RegionOne"}
 	assetModel := &persistence.AssetModel{Name: "kvm", Flavor: "c1.medium", Image: "cloudnode-x86-3.8.0-20130729-0", Id: persistence.NewUUID()}
 	assetReq := persistence.AssetRequest{HostName: "Testing Host", ResourceId: persistence.NewUUID(),
-		ReceivedOn: time.Now().String(), Provider: assetProvider, Model: assetModel}
+		ReceivedOn: time.Now().String(), Provider: *assetProvider, Model: *assetModel}
 	nsp := NewServiceProvision(assetProvider)
-	sd, eId, err := nsp.ProvisionInstance(&assetReq)
+	sd, eId, err := nsp.ProvisionInstance(context.Background(), &assetReq, nil, func(persistence.Log) {})
 	if err != nil {
 		t.Error(err.Error())
 	}
-	fmt.Println("%s %v", eId, sd)
+	fmt.Printf("%s %v\n", eId, sd)
+}
+
+type WaitSuite struct{}
+
+var _ = Suite(&WaitSuite{})
+
+// nova answering GetServer with the status of each server, a 404 for the others
+func novaWithServers(statuses map[string]string) (*httptest.Server, *ServiceProvision) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, ok := statuses[r.URL.Path[len("/servers/"):]]
+		if !ok {
+			http.Error(w, `{"itemNotFound": {"message": "Instance could not be found", "code": 404}}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"server": {"id": "%s", "status": "%s"}}`, r.URL.Path, status)
+	}))
+	return ts, &ServiceProvision{nova: nova.New(client.NewPublicClient(ts.URL))}
+}
+
+func (s *WaitSuite) TestWaitServerToStart(c *C) {
+	ts, svc := novaWithServers(map[string]string{"up": nova.StatusActive, "broken": nova.StatusError})
+	defer ts.Close()
+
+	polls, err := svc.waitServerToStart(context.Background(), "up")
+	c.Assert(err, IsNil)
+	c.Assert(polls, Equals, 1)
+
+	_, err = svc.waitServerToStart(context.Background(), "broken")
+	c.Assert(err, ErrorMatches, ".*status ERROR")
+
+	_, err = svc.waitServerToStart(context.Background(), "gone")
+	c.Assert(err, NotNil)
 }
@@ -0,0 +1,193 @@
+package scheduler
+
+import (
+	"fmt"
+	"stormstack.org/stormio/conf"
+	"stormstack.org/stormio/persistence"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Limits bound the provisioning against one asset provider, an endpoint and
+ * tenant: how many servers are started per minute, with a burst of them
+ * allowed at once, and how many are being built at the same time. A Rate or
+ * Concurrency of 0 doesn't limit.
+ */
+type Limits struct {
+	Rate        float64 // per minute
+	Burst       int
+	Concurrency int
+}
+
+// Token bucket and worker pool of one provider
+type providerLimiter struct {
+	limits  Limits
+	tokens  float64
+	last    time.Time
+	running int
+}
+
+type limiter struct {
+	sync.Mutex
+	defaults  Limits
+	tenants   map[string]Limits
+	providers map[string]*providerLimiter
+}
+
+func newLimiter(defaults Limits, tenants map[string]Limits) *limiter {
+	return &limiter{defaults: defaults, tenants: tenants, providers: make(map[string]*providerLimiter)}
+}
+
+// Key of the asset provider the limits apply to
+func providerKey(ap *persistence.AssetProvider) string {
+	return ap.EndPointURL + "|" + ap.Tenant
+}
+
+/*
+ * loadLimiter reads the defaults from the section, the rate falling back to
+ * [server] rate-limit, and the limits of a tenant from the options prefixed
+ * with its name.
+ *
+ *	[limits]
+ *	rate=10
+ *	burst=3
+ *	concurrency=5
+ *	lab.tenant.rate=2
+ *	lab.tenant.concurrency=1
+ */
+func loadLimiter(c *conf.ConfigFile, section string, rate int) (*limiter, error) {
+	defaults := Limits{Rate: float64(rate), Burst: 1, Concurrency: 10}
+	tenants := make(map[string]Limits)
+	options, err := c.GetOptions(section)
+	if err != nil {
+		return newLimiter(defaults, tenants), nil
+	}
+	// the defaults first, the tenants start from them
+	for _, perTenant := range []bool{false, true} {
+		for _, option := range options {
+			dot := strings.LastIndex(option, ".")
+			if (dot > 0) != perTenant {
+				continue
+			}
+			value, _ := c.GetString(section, option)
+			if !perTenant {
+				err = defaults.set(option, value)
+			} else {
+				tenant := strings.ToLower(option[:dot])
+				limits, found := tenants[tenant]
+				if !found {
+					limits = defaults
+				}
+				err = limits.set(option[dot+1:], value)
+				tenants[tenant] = limits
+			}
+			if err != nil {
+				return nil, fmt.Errorf("[%s] %s=%s: %v", section, option, value, err)
+			}
+		}
+	}
+	return newLimiter(defaults, tenants), nil
+}
+
+func (l *Limits) set(name, value string) (err error) {
+	switch name {
+	case "rate":
+		l.Rate, err = strconv.ParseFloat(value, 64)
+	case "burst":
+		l.Burst, err = strconv.Atoi(value)
+	case "concurrency":
+		l.Concurrency, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unknown option")
+	}
+	if err == nil && (l.Rate < 0 || l.Burst < 0 || l.Concurrency < 0) {
+		err = fmt.Errorf("can't be negative")
+	}
+	return
+}
+
+func (l *limiter) provider(key string) *providerLimiter {
+	pl, found := l.providers[key]
+	if !found {
+		limits := l.defaults
+		if tenant := key[strings.LastIndex(key, "|")+1:]; tenant != "" {
+			if tl, found := l.tenants[strings.ToLower(tenant)]; found {
+				limits = tl
+			}
+		}
+		if limits.Burst < 1 {
+			limits.Burst = 1
+		}
+		pl = &providerLimiter{limits: limits, tokens: float64(limits.Burst), last: time.Now()}
+		l.providers[key] = pl
+	}
+	return pl
+}
+
+// Tokens earned since the last look, up to the burst
+func (pl *providerLimiter) refill(now time.Time) {
+	pl.tokens += now.Sub(pl.last).Minutes() * pl.limits.Rate
+	if pl.tokens > float64(pl.limits.Burst) {
+		pl.tokens = float64(pl.limits.Burst)
+	}
+	pl.last = now
+}
+
+// How long until the provider can start one more, 0 when it can now
+func (pl *providerLimiter) wait(now time.Time) time.Duration {
+	if pl.limits.Concurrency > 0 && pl.running >= pl.limits.Concurrency {
+		return time.Second
+	}
+	if pl.limits.Rate <= 0 {
+		return 0
+	}
+	pl.refill(now)
+	if pl.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - pl.tokens) / pl.limits.Rate * float64(time.Minute))
+}
+
+/*
+ * acquire takes a slot in the pool of the provider and a token from its
+ * bucket, or says how long to wait when there is none. Every acquire that
+ * succeeded is paired with a release.
+ */
+func (l *limiter) acquire(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	pl := l.provider(key)
+	if wait := pl.wait(time.Now()); wait > 0 {
+		return false, wait
+	}
+	if pl.limits.Rate > 0 {
+		pl.tokens--
+	}
+	pl.running++
+	return true, 0
+}
+
+func (l *limiter) release(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if pl, found := l.providers[key]; found && pl.running > 0 {
+		pl.running--
+	}
+}
+
+// The providers that can't start one more right now
+func (l *limiter) saturated() []string {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	var keys []string
+	for key, pl := range l.providers {
+		if pl.wait(now) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
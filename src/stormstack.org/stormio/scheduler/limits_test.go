@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	. "launchpad.net/gocheck"
+	"stormstack.org/stormio/conf"
+	"testing"
+	"time"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type LimitsSuite struct{}
+
+var _ = Suite(&LimitsSuite{})
+
+func (s *LimitsSuite) TestLoad(c *C) {
+	cfg, err := conf.ReadConfigBytes([]byte("[limits]\nburst=3\nconcurrency=5\n" +
+		"Lab.Tenant.rate=2\nlab.tenant.concurrency=1\n"))
+	c.Assert(err, IsNil)
+	l, err := loadLimiter(cfg, "limits", 10)
+	c.Assert(err, IsNil)
+	c.Assert(l.defaults, Equals, Limits{Rate: 10, Burst: 3, Concurrency: 5})
+	c.Assert(l.tenants["lab.tenant"], Equals, Limits{Rate: 2, Burst: 3, Concurrency: 1})
+	c.Assert(l.provider("http://lab:5000/v2.0|Lab.Tenant").limits, Equals, l.tenants["lab.tenant"])
+
+	for _, bad := range []string{"rate=-1", "workers=3", "lab.burst=many"} {
+		cfg, _ := conf.ReadConfigBytes([]byte("[limits]\n" + bad + "\n"))
+		_, err := loadLimiter(cfg, "limits", 10)
+		c.Assert(err, NotNil, Commentf(bad))
+	}
+}
+
+func (s *LimitsSuite) TestUnlimited(c *C) {
+	// no rate-limit configured used to divide by zero
+	cfg, _ := conf.ReadConfigBytes([]byte("[server]\n"))
+	l, err := loadLimiter(cfg, "limits", 0)
+	c.Assert(err, IsNil)
+	for i := 0; i < 10; i++ {
+		ok, _ := l.acquire("a")
+		c.Assert(ok, Equals, true)
+	}
+}
+
+func (s *LimitsSuite) TestTokenBucket(c *C) {
+	l := newLimiter(Limits{Rate: 60, Burst: 2}, nil)
+	for i := 0; i < 2; i++ {
+		ok, _ := l.acquire("a")
+		c.Assert(ok, Equals, true)
+	}
+	ok, wait := l.acquire("a")
+	c.Assert(ok, Equals, false)
+	c.Assert(wait > 0 && wait <= time.Second, Equals, true, Commentf("%v", wait))
+	c.Assert(l.saturated(), DeepEquals, []string{"a"})
+
+	// another provider isn't held back
+	ok, _ = l.acquire("b")
+	c.Assert(ok, Equals, true)
+
+	l.providers["a"].last = time.Now().Add(-time.Second)
+	ok, _ = l.acquire("a")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *LimitsSuite) TestWorkerPool(c *C) {
+	l := newLimiter(Limits{Concurrency: 2}, nil)
+	l.acquire("a")
+	l.acquire("a")
+	ok, _ := l.acquire("a")
+	c.Assert(ok, Equals, false)
+	l.release("a")
+	ok, _ = l.acquire("a")
+	c.Assert(ok, Equals, true)
+	c.Assert(l.providers["a"].running, Equals, 2)
+}
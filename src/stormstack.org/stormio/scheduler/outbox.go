@@ -0,0 +1,149 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"labix.org/v2/mgo/bson"
+	"launchpad.net/goose/errors"
+	goosehttp "launchpad.net/goose/http"
+	"net/http"
+	"stormstack.org/stormio/persistence"
+	"time"
+)
+
+/*
+ * The calls to Vertex go through the outbox: recorded along with the change
+ * they tell about, then delivered here with retries. Every stormio delivers,
+ * a callback is claimed by one of them at a time.
+ */
+
+// Records the callback, body marshalled as json unless nil
+func (prov *Provisioner) record(cb *persistence.Callback, body interface{}) error {
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		cb.Body = string(b)
+	}
+	if err := prov.Outbox.Record(cb); err != nil {
+		log.Errorf("[areq %s][res %s] Unable to record the %s callback :%v", cb.AssetId, cb.ResourceId, cb.Kind, err)
+		return err
+	}
+	log.Debugf("[areq %s][res %s] Recorded the %s callback %s", cb.AssetId, cb.ResourceId, cb.Kind, cb.Id)
+	return nil
+}
+
+func (prov *Provisioner) deliver() {
+	for {
+		cb, err := prov.Outbox.Claim(prov.owner)
+		if err != nil {
+			log.Errorf("Unable to claim callbacks :%v", err)
+		}
+		if cb == nil {
+			if !prov.sleep(prov.poll) {
+				return
+			}
+			continue
+		}
+		prov.inflight.Add(1)
+		prov.send(cb)
+		prov.inflight.Done()
+	}
+}
+
+/*
+ * send makes one attempt at the callback. A failed one is retried with the
+ * backoff of the [outbox] policy until it is exhausted, then dead lettered.
+ */
+func (prov *Provisioner) send(cb *persistence.Callback) {
+	headers := make(http.Header)
+	if cb.Token != "" {
+		headers.Add("V-Auth-Token", cb.Token)
+	}
+	reqData := &goosehttp.RequestData{ReqHeaders: headers, ExpectedStatus: cb.Expected}
+	if cb.Body != "" {
+		reqData.ReqValue = json.RawMessage(cb.Body)
+	}
+	log.Debugf("[areq %s][res %s] Delivering the %s callback to [%s], attempt %d", cb.AssetId, cb.ResourceId, cb.Kind, cb.Url, cb.Attempts)
+	started := time.Now()
+	err := prov.Client.SendRequest(cb.Method, "", cb.Url, reqData)
+	step := persistence.NewLog(persistence.StepNotify, started, err, fmt.Sprintf("%s callback to %s, attempt %d", cb.Kind, cb.Url, cb.Attempts))
+	prov.withAsset(cb.AssetId, func(conn *persistence.Connection, ar *persistence.AssetRequest) {
+		prov.addStep(conn, ar.Id, step)
+	})
+	switch {
+	case err == nil:
+		log.Debugf("[areq %s][res %s] Caller acknowledged the %s callback", cb.AssetId, cb.ResourceId, cb.Kind)
+		if err := prov.Outbox.Delivered(cb); err != nil {
+			log.Errorf("[areq %s] Unable to remove the delivered callback %s :%v", cb.AssetId, cb.Id, err)
+		}
+		prov.delivered(cb)
+	case cb.Kind == persistence.CallbackAttach && errors.IsNotFound(err):
+		// Vertex is done with the resource, nothing to retry
+		log.Warnf("[areq %s][res %s] Caller doesn't know the resource, deleting the asset :%v", cb.AssetId, cb.ResourceId, err)
+		prov.Outbox.Delivered(cb)
+		prov.dropAsset(cb.AssetId)
+	case prov.Callbacks.Exhausted(cb.Attempts):
+		log.Errorf("[areq %s][res %s] Giving up the %s callback after %d attempts :%v", cb.AssetId, cb.ResourceId, cb.Kind, cb.Attempts, err)
+		if err := prov.Outbox.DeadLetter(cb, err); err != nil {
+			log.Errorf("[areq %s] Unable to dead letter callback %s :%v", cb.AssetId, cb.Id, err)
+			return
+		}
+		prov.deadLettered(cb)
+	default:
+		delay := prov.Callbacks.Backoff(cb.Attempts)
+		log.Warnf("[areq %s][res %s] The %s callback failed, retrying in %v :%v", cb.AssetId, cb.ResourceId, cb.Kind, delay, err)
+		if err := prov.Outbox.Retry(cb, delay, err); err != nil {
+			log.Errorf("[areq %s] Unable to hand back callback %s :%v", cb.AssetId, cb.Id, err)
+		}
+	}
+}
+
+// An attach replayed after it was dead lettered gets the request going again
+func (prov *Provisioner) delivered(cb *persistence.Callback) {
+	if cb.Kind != persistence.CallbackAttach {
+		return
+	}
+	prov.withAsset(cb.AssetId, func(conn *persistence.Connection, ar *persistence.AssetRequest) {
+		if ar.Status == persistence.RequestNotifyFail {
+			prov.UpdateStatus(conn, ar, persistence.RequestHalfFilled)
+		}
+	})
+}
+
+// Vertex never heard of the server of a request whose attach is dead lettered
+func (prov *Provisioner) deadLettered(cb *persistence.Callback) {
+	if cb.Kind != persistence.CallbackAttach {
+		return
+	}
+	prov.withAsset(cb.AssetId, func(conn *persistence.Connection, ar *persistence.AssetRequest) {
+		ar.FailureReason = "Caller was not notified of the server: " + cb.LastError
+		prov.UpdateStatus(conn, ar, persistence.RequestNotifyFail)
+	})
+}
+
+func (prov *Provisioner) dropAsset(assetId string) {
+	prov.withAsset(assetId, func(conn *persistence.Connection, ar *persistence.AssetRequest) {
+		if !persistence.CanTransition(ar.Status, persistence.RequestMarkDeletion) {
+			return
+		}
+		if prov.Enqueue(persistence.JobDelete, ar) == nil {
+			prov.UpdateStatus(conn, ar, persistence.RequestMarkDeletion)
+		}
+	})
+}
+
+// Runs f on the asset request, if it is still there
+func (prov *Provisioner) withAsset(assetId string, f func(*persistence.Connection, *persistence.AssetRequest)) {
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		log.Errorf("[areq %s] Error in getting connection :%v", assetId, err)
+		return
+	}
+	defer conn.Close()
+	if ar, err := conn.Find(bson.M{"_id": assetId}); err == nil {
+		f(conn, ar)
+	}
+}
@@ -0,0 +1,242 @@
+package scheduler
+
+import (
+	log "github.com/cihub/seelog"
+	"labix.org/v2/mgo/bson"
+	"stormstack.org/stormio/cache"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/provision"
+	"stormstack.org/stormio/util"
+	"time"
+)
+
+/*
+ * The reconciler compares the servers of every asset provider in the cache
+ * with the asset requests in Mongo:
+ *
+ *	orphan  a server stormio created that no asset request knows of
+ *	ghost   an asset request whose server is no longer in Nova
+ *
+ * Servers and requests that changed within the grace period are left out,
+ * a build in flight has its server before the request has its ServerId.
+ * Another stormio may share the tenant: only the orphans tagged with the
+ * asset request and the environment of this one are deleted.
+ */
+
+// What the reconciler did about a drift
+const (
+	DriftDeleted     = "DELETED"
+	DriftRemediating = "REMEDIATING"
+	DriftFixFailed   = "FIX_FAILED"
+	DriftNotOurs     = "NOT_OURS" // not tagged by this stormio, left alone
+)
+
+type Drift struct {
+	Provider string `json:"provider"`
+	ServerId string `json:"serverId"`
+	Name     string `json:"name,omitempty"`
+	AssetId  string `json:"assetId,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type Reconciliation struct {
+	StartedOn  string   `json:"startedOn"`
+	FinishedOn string   `json:"finishedOn"`
+	Orphans    []*Drift `json:"orphans"`
+	Ghosts     []*Drift `json:"ghosts"`
+	Errors     []string `json:"errors,omitempty"` // providers not listed
+}
+
+// The policy on the drifts found, applied by the leader only
+type reconcilePolicy struct {
+	grace           time.Duration
+	deleteOrphans   bool
+	remediateGhosts bool
+}
+
+// Statuses in which the request has a server Nova should know of
+var serverStatuses = map[string]bool{
+	persistence.RequestHalfFilled:         true,
+	persistence.RequestProvision:          true,
+	persistence.RequestRetryModuleInstall: true,
+	persistence.RequestRetryModuleConfig:  true,
+	persistence.RequestNotifyFail:         true,
+	persistence.RequestFulfilled:          true,
+}
+
+/*
+ * diff finds the orphans among the servers and the ghosts among the
+ * requests of one provider, leaving out what changed after settled.
+ */
+func diff(provider string, servers []provision.Server, requests []*persistence.AssetRequest, settled string) (orphans, ghosts []*Drift) {
+	inNova := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		inNova[server.Id] = true
+	}
+	known, assets := make(map[string]bool), make(map[string]*persistence.AssetRequest)
+	for _, ar := range requests {
+		assets[ar.Id] = ar
+		if ar.ServerId == "" {
+			continue
+		}
+		known[ar.ServerId] = true
+		if !inNova[ar.ServerId] && serverStatuses[ar.Status] && ar.StatusChangedOn < settled {
+			ghosts = append(ghosts, &Drift{Provider: provider, ServerId: ar.ServerId, Name: ar.HostName,
+				AssetId: ar.Id, Status: ar.Status})
+		}
+	}
+	for _, server := range servers {
+		if known[server.Id] {
+			continue
+		}
+		// the server of a build in flight, or the one being replaced
+		if ar := assets[server.AssetId]; ar != nil && !serverStatuses[ar.Status] {
+			continue
+		}
+		if created, err := time.Parse(time.RFC3339, server.Created); err == nil && persistence.FormatTime(created) >= settled {
+			continue
+		}
+		orphans = append(orphans, &Drift{Provider: provider, ServerId: server.Id, Name: server.Name,
+			AssetId: server.AssetId, Status: server.Status})
+	}
+	return
+}
+
+func loadReconcilePolicy() reconcilePolicy {
+	return reconcilePolicy{
+		grace:           time.Duration(util.GetIntDefault("reconcile", "grace", 15)) * time.Minute,
+		deleteOrphans:   util.GetBoolDefault("reconcile", "delete-orphans", false),
+		remediateGhosts: util.GetBoolDefault("reconcile", "remediate-ghosts", false),
+	}
+}
+
+/*
+ * reconcile runs every [reconcile] interval seconds on every stormio, so
+ * each has a report to show; only the leader fixes the drifts it finds.
+ */
+func (prov *Provisioner) reconcile() {
+	interval := time.Duration(util.GetIntDefault("reconcile", "interval", 300)) * time.Second
+	if interval <= 0 {
+		log.Info("Reconciliation with the asset providers is disabled")
+		return
+	}
+	for prov.sleep(interval) {
+		prov.Reconcile(prov.IsLeader())
+	}
+}
+
+/*
+ * Reconcile goes through the asset providers in the cache and keeps the
+ * report as the last one. With fix, the drifts are dealt with as the
+ * [reconcile] policy says.
+ */
+func (prov *Provisioner) Reconcile(fix bool) (*Reconciliation, error) {
+	policy := loadReconcilePolicy()
+	report := &Reconciliation{StartedOn: persistence.Now(), Orphans: []*Drift{}, Ghosts: []*Drift{}}
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		log.Errorf("Error in getting connection, not reconciling :%v", err)
+		return nil, err
+	}
+	defer conn.Close()
+	requests, err := conn.FindAll(bson.M{})
+	if err != nil {
+		log.Errorf("Unable to load the asset requests to reconcile :%v", err)
+		return nil, err
+	}
+	// by tenant, the servers listed are those of the tenant whoever the user
+	byProvider, done := make(map[string][]*persistence.AssetRequest), make(map[string]bool)
+	for _, ar := range requests {
+		key := providerKey(&ar.Provider)
+		byProvider[key] = append(byProvider[key], ar)
+	}
+
+	settled := persistence.FormatTime(time.Now().Add(-policy.grace))
+	cache.Each(func(ap *persistence.AssetProvider, svc *provision.ServiceProvision) {
+		provider := providerKey(ap)
+		if done[provider] {
+			return
+		}
+		done[provider] = true
+		servers, err := svc.Servers()
+		if err != nil {
+			log.Errorf("Unable to list the servers of %s, not reconciled :%v", provider, err)
+			report.Errors = append(report.Errors, provider+": "+err.Error())
+			return
+		}
+		orphans, ghosts := diff(provider, servers, byProvider[provider], settled)
+		for _, orphan := range orphans {
+			log.Warnf("Server %s (%s) of %s has no asset request", orphan.ServerId, orphan.Name, provider)
+			if fix && policy.deleteOrphans {
+				prov.deleteOrphan(svc, servers, orphan)
+			}
+		}
+		for _, ghost := range ghosts {
+			log.Warnf("[areq %s] Server %s is %s but gone from %s", ghost.AssetId, ghost.ServerId, ghost.Status, provider)
+			if fix && policy.remediateGhosts {
+				prov.remediateGhost(conn, ghost)
+			}
+		}
+		report.Orphans = append(report.Orphans, orphans...)
+		report.Ghosts = append(report.Ghosts, ghosts...)
+	})
+	report.FinishedOn = persistence.Now()
+
+	prov.reportLock.Lock()
+	prov.reconciled = report
+	prov.reportLock.Unlock()
+	return report, nil
+}
+
+// LastReconciliation is the report of the last pass on this stormio, nil before the first
+func (prov *Provisioner) LastReconciliation() *Reconciliation {
+	prov.reportLock.Lock()
+	defer prov.reportLock.Unlock()
+	return prov.reconciled
+}
+
+func (prov *Provisioner) deleteOrphan(svc *provision.ServiceProvision, servers []provision.Server, orphan *Drift) {
+	for i := range servers {
+		if servers[i].Id != orphan.ServerId {
+			continue
+		}
+		if !ours(&servers[i]) {
+			log.Infof("Orphan server %s (%s) of %s is not tagged by this stormio, not deleting it", orphan.ServerId, orphan.Name, orphan.Provider)
+			orphan.Action = DriftNotOurs
+			return
+		}
+		if err := svc.DeleteServer(&servers[i]); err != nil {
+			log.Errorf("Unable to delete the orphan server %s :%v", orphan.ServerId, err)
+			orphan.Action, orphan.Error = DriftFixFailed, err.Error()
+			return
+		}
+		log.Infof("Deleted the orphan server %s (%s) of %s", orphan.ServerId, orphan.Name, orphan.Provider)
+		orphan.Action = DriftDeleted
+	}
+}
+
+// Created by a stormio of this environment for an asset request, the only servers it deletes
+func ours(server *provision.Server) bool {
+	env := util.GetString("application", "environment")
+	return server.AssetId != "" && env != "" && server.Environment == env
+}
+
+// The ghost is rebuilt on the floating ip it kept, as a remediation
+func (prov *Provisioner) remediateGhost(conn *persistence.Connection, ghost *Drift) {
+	ar, err := conn.Find(bson.M{"_id": ghost.AssetId})
+	if err == nil && ar.ServerId != ghost.ServerId {
+		// moved on since it was loaded
+		return
+	}
+	if err == nil {
+		err = prov.Remediate(conn, ar)
+	}
+	if err != nil {
+		log.Errorf("[areq %s] Unable to remediate the request whose server is gone :%v", ghost.AssetId, err)
+		ghost.Action, ghost.Error = DriftFixFailed, err.Error()
+		return
+	}
+	ghost.Action = DriftRemediating
+}
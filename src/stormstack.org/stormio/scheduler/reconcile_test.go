@@ -0,0 +1,56 @@
+package scheduler
+
+import (
+	. "launchpad.net/gocheck"
+	"stormstack.org/stormio/conf"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/provision"
+	"stormstack.org/stormio/util"
+	"time"
+)
+
+type ReconcileSuite struct{}
+
+var _ = Suite(&ReconcileSuite{})
+
+func (s *ReconcileSuite) TestDiff(c *C) {
+	now := time.Now()
+	old, recent := now.Add(-time.Hour), now.Add(-time.Minute)
+	settled := persistence.FormatTime(now.Add(-15 * time.Minute))
+	servers := []provision.Server{
+		{Id: "s1", AssetId: "a1", Created: old.Format(time.RFC3339)},
+		{Id: "s2", Created: old.Format(time.RFC3339)},                // orphan
+		{Id: "s3", Created: recent.Format(time.RFC3339)},             // too recent to tell
+		{Id: "s4", AssetId: "a4", Created: old.Format(time.RFC3339)}, // a4 is building
+		{Id: "s5", AssetId: "a5", Created: old.Format(time.RFC3339)}, // a5 moved on to s6, orphan
+	}
+	requests := []*persistence.AssetRequest{
+		{Id: "a1", ServerId: "s1", Status: persistence.RequestFulfilled, StatusChangedOn: persistence.FormatTime(old)},
+		{Id: "a4", Status: persistence.RequestBuild, StatusChangedOn: persistence.FormatTime(old)},
+		{Id: "a5", ServerId: "s6", Status: persistence.RequestFulfilled, StatusChangedOn: persistence.FormatTime(old)},
+		{Id: "a7", ServerId: "s7", Status: persistence.RequestHalfFilled, StatusChangedOn: persistence.FormatTime(recent)},
+		{Id: "a8", ServerId: "s8", Status: persistence.RequestMarkDeletion, StatusChangedOn: persistence.FormatTime(old)},
+	}
+
+	orphans, ghosts := diff("p", servers, requests, settled)
+	c.Assert(orphans, HasLen, 2)
+	c.Assert(orphans[0].ServerId, Equals, "s2")
+	c.Assert(orphans[1].ServerId, Equals, "s5")
+	c.Assert(orphans[1].Provider, Equals, "p")
+	// s6 is gone, s7 only just changed, a8 is being deleted
+	c.Assert(ghosts, HasLen, 1)
+	c.Assert(ghosts[0].AssetId, Equals, "a5")
+	c.Assert(ghosts[0].ServerId, Equals, "s6")
+}
+
+func (s *ReconcileSuite) TestOurs(c *C) {
+	saved := util.Config
+	defer func() { util.Config = saved }()
+	util.Config, _ = conf.ReadConfigBytes([]byte("[application]\nenvironment=dev3\n"))
+
+	c.Assert(ours(&provision.Server{Id: "s1", AssetId: "a1", Environment: "dev3"}), Equals, true)
+	// another stormio sharing the tenant, or one from before the tags
+	c.Assert(ours(&provision.Server{Id: "s2", AssetId: "a2", Environment: "prod"}), Equals, false)
+	c.Assert(ours(&provision.Server{Id: "s3", AssetId: "a3"}), Equals, false)
+	c.Assert(ours(&provision.Server{Id: "s4", Environment: "dev3"}), Equals, false)
+}
@@ -1,120 +1,674 @@
 package scheduler
 
 import (
+	"context"
 	"fmt"
 	log "github.com/cihub/seelog"
+	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"launchpad.net/goose/client"
-	"launchpad.net/goose/errors"
 	goosehttp "launchpad.net/goose/http"
 	"launchpad.net/goose/identity"
 	"net/http"
+	"os"
 	"stormstack.org/stormio/cache"
+	"stormstack.org/stormio/events"
 	"stormstack.org/stormio/persistence"
 	"stormstack.org/stormio/provision"
 	"stormstack.org/stormio/stormstack"
 	"stormstack.org/stormio/util"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrNoFloatingIP = fmt.Errorf("No floating ip to retain, nothing to remediate")
+
+// The lease held by the stormio running the singleton loops
+const leaderLease = "leader:scheduler"
+
 type Provisioner struct {
-	DelNotification chan *persistence.AssetRequest
-	CRequest        chan *persistence.AssetRequest
-	CRemediation    chan *persistence.AssetRequest
-	CNotification   chan string
-	Client          client.Client
+	Queue      *persistence.Queue
+	Client     client.Client
+	Events     *events.Hub
+	States     *persistence.StateMachine
+	Retry      *provision.RetryPolicies
+	Leases     *persistence.Leases
+	Outbox     *persistence.Outbox
+	Callbacks  *provision.RetryPolicy // delivery of the outbox
+	Hooks      *provision.Hooks       // called at the phases of a server
+	limits     *limiter               // per asset provider, on creating servers
+	owner      string                 // leases the jobs claimed by this stormio
+	poll       time.Duration
+	leaderTTL  time.Duration
+	leading    int32                         // 1 while this stormio holds the leader lease
+	builds     map[string]context.CancelFunc // of the jobs running here, by asset request
+	buildsLock sync.Mutex
+	reconciled *Reconciliation // last report of the reconciler
+	reportLock sync.Mutex
+	quit       chan struct{}
+	inflight   sync.WaitGroup
 }
 
-const (
-	MaxBuffer = 50
-)
-
 /*
  *
- * Provisioner keep holds of the channel using for communicating the progress
- * in various steps
+ * Provisioner works off the jobs queued in Mongo, every step of an asset
+ * request is a job claimed by one of the workers.
  *
  */
-func NewProvisioner() (pro *Provisioner) {
-	crequest := make(chan *persistence.AssetRequest, MaxBuffer)
-	cremediation := make(chan *persistence.AssetRequest, MaxBuffer)
-	dnotifies := make(chan *persistence.AssetRequest, MaxBuffer)
-	cnotifies := make(chan string, MaxBuffer)
-	prov := &Provisioner{dnotifies, crequest, cremediation, cnotifies, client.NewPublicClient("")}
+func NewProvisioner() (*Provisioner, error) {
+	retry, err := provision.LoadRetryPolicies(util.Config, "retry")
+	if err != nil {
+		return nil, err
+	}
+	callbacks, err := provision.LoadRetryPolicy(util.Config, "outbox", provision.RetryPolicy{
+		MaxAttempts: 10, Initial: 10 * time.Second, Max: 10 * time.Minute, Multiplier: 2, Jitter: 0.2})
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := provision.LoadHooks(util.Config, "hooks")
+	if err != nil {
+		return nil, err
+	}
+	limits, err := loadLimiter(util.Config, "limits", util.GetIntDefault("server", "rate-limit", 0))
+	if err != nil {
+		return nil, err
+	}
+	queue, err := persistence.OpenQueue(persistence.JobCollection)
+	if err != nil {
+		return nil, err
+	}
+	leases, err := persistence.OpenLeases(persistence.LeaseCollection)
+	if err != nil {
+		queue.Close()
+		return nil, err
+	}
+	outbox, err := persistence.OpenOutbox(persistence.OutboxCollection)
+	if err != nil {
+		queue.Close()
+		leases.Close()
+		return nil, err
+	}
+	queue.MaxDepth = util.GetIntDefault("queue", "max-depth", 1000)
+	queue.MaxAttempts = util.GetIntDefault("queue", "max-attempts", 5)
+	queue.Lease = time.Duration(util.GetIntDefault("queue", "lease", 120)) * time.Second
+	queue.Aging = time.Duration(util.GetIntDefault("queue", "aging", 300)) * time.Second
+	host, _ := os.Hostname()
+	prov := &Provisioner{
+		Queue:     queue,
+		Client:    client.NewPublicClient(""),
+		Events:    events.NewHub(),
+		States:    persistence.NewStateMachine(),
+		Retry:     retry,
+		Leases:    leases,
+		Outbox:    outbox,
+		Callbacks: callbacks,
+		Hooks:     hooks,
+		limits:    limits,
+		owner:     fmt.Sprintf("%s:%d:%s", host, os.Getpid(), persistence.NewUUID()),
+		poll:      time.Duration(util.GetIntDefault("queue", "poll-interval", 2)) * time.Second,
+		leaderTTL: time.Duration(util.GetIntDefault("cluster", "leader-lease", 30)) * time.Second,
+		quit:      make(chan struct{}),
+		builds:    make(map[string]context.CancelFunc),
+	}
+	prov.States.OnEnter(persistence.AnyStatus, func(ar *persistence.AssetRequest, from string) {
+		prov.Events.Publish(events.FromAsset(events.TypeStatus, ar))
+	})
 	prov.StartProvisioner()
-	pro = prov
-	return
+	return prov, nil
+}
+
+/*
+ * Enqueue queues the job of the given kind for the asset request, with the
+ * priority of its class. A create is a retry once the request failed, and
+ * goes with the priority of the request when it has one.
+ */
+func (prov *Provisioner) Enqueue(kind string, ar *persistence.AssetRequest) error {
+	job := &persistence.Job{Kind: kind, AssetId: ar.Id, ResourceId: ar.ResourceId, Provider: providerKey(&ar.Provider)}
+	if kind == persistence.JobCreate {
+		job.Priority = createPriority(ar)
+	}
+	if kind == persistence.JobCreate && ar.NotBefore > persistence.Now() {
+		// held in the queue until it is time
+		job.VisibleAt = ar.NotBefore
+	}
+	err := prov.Queue.Enqueue(job)
+	if err != nil {
+		log.Errorf("[areq %s] Unable to queue the %s job :%v", ar.Id, kind, err)
+	}
+	return err
+}
+
+// Reprioritize moves the create of the request still queued to its priority
+func (prov *Provisioner) Reprioritize(ar *persistence.AssetRequest) error {
+	return prov.Queue.Reprioritize(persistence.JobCreate, ar.Id, createPriority(ar))
+}
+
+func createPriority(ar *persistence.AssetRequest) int {
+	switch {
+	case ar.Priority > 0:
+		return ar.Priority
+	case ar.Status == persistence.RequestRetry:
+		return persistence.PriorityRetry
+	}
+	return persistence.PriorityCreate
 }
 
 func (prov *Provisioner) StartProvisioner() {
-	go func() {
-		RateLimit := time.Duration(util.GetInt("server", "rate-limit"))
-		throttle := time.Tick(time.Minute / RateLimit)
-		for arReq := range prov.CRequest {
-			log.Debugf("[areq %s] Server creation request received from Vertex", arReq.Id)
-			go func(assetReq *persistence.AssetRequest) {
-				conn, err := persistence.DefaultSession()
-				defer conn.Close()
-				if err != nil {
-					log.Errorf("[areq %s] Error in getting persistent session :%v", assetReq.Id, err)
-					return
-				}
+	// one worker for both, so a remediation goes ahead of the creates for the limits of its provider
+	go prov.work(prov.limits, prov.build, persistence.JobCreate, persistence.JobRemediate)
+	go prov.work(nil, prov.activate, persistence.JobActivate)
+	go prov.work(nil, prov.delete, persistence.JobDelete)
+	go prov.deliver()
+	go prov.lead()
+	go prov.RescheduleOldRequests()
+	go prov.reapExpired()
+	go prov.reconcile()
+}
 
-				if err := prov.createServer(conn, assetReq); err == nil {
-					////shouldn't notify Vertex if fip is nil
-					if assetReq.IpAddress == "" {
-						log.Debugf("[areq %s] Floating IP is not allocated", assetReq.Id)
-						return
-					}
-					//// code ends
-					log.Debugf("[areq %s] Notifying VertexPlatform to create an Asset, ServerId:%s", assetReq.Id, assetReq.ServerId)
-					prov.updateAndNotify(conn, assetReq)
+/*
+ * lead keeps trying for the leader lease, renewing it while it is held.
+ * Several stormio can work off the same queue, but the loops going through
+ * every request, rescheduling and remediating, only run on the leader. A new
+ * leader resumes what a stopped one may have left half way.
+ */
+func (prov *Provisioner) lead() {
+	for {
+		ok, err := prov.Leases.Acquire(leaderLease, prov.owner, prov.leaderTTL)
+		if err != nil {
+			log.Errorf("Unable to take the leader lease :%v", err)
+		}
+		switch {
+		case ok && atomic.SwapInt32(&prov.leading, 1) == 0:
+			log.Infof("Leading the scheduler as %s", prov.owner)
+			go prov.resumeInterrupted()
+		case !ok && atomic.SwapInt32(&prov.leading, 0) == 1:
+			log.Warnf("No longer leading the scheduler")
+		}
+		if !prov.sleep(prov.leaderTTL / 3) {
+			return
+		}
+	}
+}
+
+// IsLeader tells whether this stormio runs the singleton loops
+func (prov *Provisioner) IsLeader() bool {
+	return atomic.LoadInt32(&prov.leading) == 1
+}
+
+/*
+ * work claims the jobs of the given kinds and runs each in its own go
+ * routine. With limits, the jobs of a provider out of tokens or workers are
+ * left in the queue for the others to go first, and a job claimed just as
+ * its provider ran out is deferred until it can go. The lease of a running
+ * job is extended until handle returns; an error hands the job back to be
+ * tried again later.
+ */
+func (prov *Provisioner) work(limits *limiter, handle func(context.Context, *persistence.Job) error, kinds ...string) {
+	for {
+		var saturated []string
+		if limits != nil {
+			saturated = limits.saturated()
+		}
+		job, err := prov.Queue.ClaimExcept(prov.owner, saturated, kinds...)
+		if err != nil {
+			log.Errorf("Unable to claim %v jobs :%v", kinds, err)
+		}
+		if job == nil {
+			if !prov.sleep(prov.poll) {
+				return
+			}
+			continue
+		}
+		if limits != nil {
+			if ok, wait := limits.acquire(job.Provider); !ok {
+				log.Debugf("[areq %s] Provider %s is at its limits, deferring the %s job by %v", job.AssetId, job.Provider, job.Kind, wait)
+				if err := prov.Queue.Defer(job, wait); err != nil {
+					log.Errorf("[areq %s] Unable to defer the %s job :%v", job.AssetId, job.Kind, err)
 				}
-			}(arReq)
-			<-throttle //Rate limit
+				continue
+			}
+		}
+		log.Debugf("[areq %s] Claimed the %s job, attempt %d", job.AssetId, job.Kind, job.Attempts)
+		prov.inflight.Add(1)
+		go func() {
+			defer prov.inflight.Done()
+			if limits != nil {
+				defer limits.release(job.Provider)
+			}
+			prov.run(job, handle)
+		}()
+		select {
+		case <-prov.quit:
+			return
+		default:
+		}
+	}
+}
+
+/*
+ * run handles the job holding the lock of its asset request, so no two jobs
+ * of a request run at once, on this or another stormio. A job whose request
+ * is locked is deferred. The job is handed a context cancelled when the
+ * request is deleted meanwhile, see Cancel.
+ */
+func (prov *Provisioner) run(job *persistence.Job, handle func(context.Context, *persistence.Job) error) {
+	lock, holder := "areq:"+job.AssetId, prov.owner+"/"+job.Id
+	locked, err := prov.Leases.Acquire(lock, holder, prov.Queue.Lease)
+	if !locked {
+		if err != nil {
+			log.Errorf("[areq %s] Unable to lock the asset request :%v", job.AssetId, err)
+		} else {
+			log.Debugf("[areq %s] Asset request is locked by another job, deferring the %s job", job.AssetId, job.Kind)
 		}
+		if err := prov.Queue.Defer(job, prov.poll); err != nil {
+			log.Errorf("[areq %s] Unable to defer the %s job :%v", job.AssetId, job.Kind, err)
+		}
+		return
+	}
+	defer prov.Leases.Release(lock, holder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prov.buildsLock.Lock()
+	prov.builds[job.AssetId] = cancel
+	prov.buildsLock.Unlock()
+	defer func() {
+		prov.buildsLock.Lock()
+		delete(prov.builds, job.AssetId)
+		prov.buildsLock.Unlock()
+		cancel()
 	}()
+	if job.Kind == persistence.JobCreate || job.Kind == persistence.JobRemediate {
+		go prov.watchDeletion(ctx, job.AssetId, cancel)
+	}
 
+	// the lock expired and was taken, by another job or stormio
+	var lost int32
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		for remReq := range prov.CRemediation {
-			go func(assetReq *persistence.AssetRequest) {
-				conn, err := persistence.DefaultSession()
-				defer conn.Close()
+		renew := time.NewTicker(prov.Queue.Lease / 3)
+		defer renew.Stop()
+		for {
+			select {
+			case <-renew.C:
+				if err := prov.Queue.Extend(job); err != nil {
+					log.Errorf("[areq %s] Unable to extend the lease of the %s job :%v", job.AssetId, job.Kind, err)
+				}
+				locked, err := prov.Leases.Acquire(lock, holder, prov.Queue.Lease)
 				if err != nil {
-					log.Errorf("[areq %s][res %s] Error in getting persistence session :%v", assetReq.Id, assetReq.ResourceId, err)
+					log.Errorf("[areq %s] Unable to extend the lock of the asset request :%v", job.AssetId, err)
+				} else if !locked {
+					log.Errorf("[areq %s] Lost the lock of the asset request, stopping the %s job", job.AssetId, job.Kind)
+					atomic.StoreInt32(&lost, 1)
+					cancel()
 					return
 				}
-				if err := prov.terminateFailedResource(assetReq, true); err == nil {
-					if err := prov.createServer(conn, assetReq); err == nil {
-						log.Debugf("[areq %s][res %s] Notifying VertexPlatform to create an Asset, ServerId:%s", assetReq.Id, assetReq.ResourceId, assetReq.ServerId)
-						prov.updateAndNotify(conn, assetReq)
-					}
-				}
-			}(remReq)
+			case <-done:
+				return
+			}
 		}
 	}()
 
-	go func() {
-		for resourceId := range prov.CNotification {
-			log.Debugf("[res %s] VCG is activated notification received", resourceId)
-			go prov.notifyActivation(resourceId)
+	err = handle(ctx, job)
+	if atomic.LoadInt32(&lost) == 1 {
+		// whoever holds the lock is on it, the job is tried again after
+		if err := prov.Queue.Defer(job, prov.poll); err != nil {
+			log.Errorf("[areq %s] Unable to defer the %s job :%v", job.AssetId, job.Kind, err)
 		}
-	}()
+		return
+	}
+	if rl, ok := err.(*retryLater); ok {
+		if err := prov.Queue.Defer(job, rl.delay); err != nil {
+			log.Errorf("[areq %s] Unable to defer the %s job :%v", job.AssetId, job.Kind, err)
+		}
+		return
+	}
+	if err == nil {
+		if err := prov.Queue.Ack(job); err != nil {
+			log.Errorf("[areq %s] Unable to ack the %s job :%v", job.AssetId, job.Kind, err)
+		}
+		return
+	}
+	delay := time.Duration(job.Attempts) * 30 * time.Second
+	exhausted, qerr := prov.Queue.Retry(job, delay, err)
+	switch {
+	case qerr != nil:
+		log.Errorf("[areq %s] Unable to hand back the %s job :%v", job.AssetId, job.Kind, qerr)
+	case exhausted:
+		log.Errorf("[areq %s] Giving up the %s job after %d attempts :%v", job.AssetId, job.Kind, job.Attempts, err)
+		prov.giveUp(job)
+	default:
+		log.Warnf("[areq %s] The %s job failed, retrying in %v :%v", job.AssetId, job.Kind, delay, err)
+	}
+}
 
-	go func() {
-		for delReq := range prov.DelNotification {
-			log.Debugf("[res %s] Delete notification recevied", delReq.ServerId)
-			go stormstack.DomainDeleteAgent(delReq)
-			go stormstack.DeRegisterStormAgent(delReq)
-			go prov.notifyDeActivation(delReq)
-			go prov.notifyDettachAsset(delReq)
+/*
+ * Cancel stops the job running here for the asset request, the build of a
+ * request being deleted. It is false when there is none, a build running on
+ * another stormio notices the deletion by itself.
+ */
+func (prov *Provisioner) Cancel(assetId string) bool {
+	prov.buildsLock.Lock()
+	defer prov.buildsLock.Unlock()
+	cancel, found := prov.builds[assetId]
+	if found {
+		log.Infof("[areq %s] Cancelling the job in flight", assetId)
+		cancel()
+	}
+	return found
+}
+
+// Cancels the build once its request is marked for deletion or gone, wherever the delete came in
+func (prov *Provisioner) watchDeletion(ctx context.Context, assetId string, cancel context.CancelFunc) {
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		log.Errorf("[areq %s] Error in getting connection, deletes won't cancel the build :%v", assetId, err)
+		return
+	}
+	defer conn.Close()
+	tick := time.NewTicker(prov.poll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			ar, err := conn.Find(bson.M{"_id": assetId})
+			if err == mgo.ErrNotFound || (err == nil && ar.Status == persistence.RequestMarkDeletion) {
+				log.Infof("[areq %s] Asset request is being deleted, cancelling the build", assetId)
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
 		}
+	}
+}
+
+// A create or remediation that can't be done fails the asset request
+func (prov *Provisioner) giveUp(job *persistence.Job) {
+	if job.Kind != persistence.JobCreate && job.Kind != persistence.JobRemediate {
+		return
+	}
+	conn, ar, err := prov.load(job)
+	if err != nil || ar == nil {
+		return
+	}
+	defer conn.Close()
+	ar.FailureReason = fmt.Sprintf("Gave up the %s job after %d attempts: %s", job.Kind, job.Attempts, job.LastError)
+	prov.UpdateStatus(conn, ar, persistence.RequestFail)
+}
+
+// The asset request of the job, nil when it is gone meanwhile
+func (prov *Provisioner) load(job *persistence.Job) (*persistence.Connection, *persistence.AssetRequest, error) {
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	ar, err := conn.Find(bson.M{"_id": job.AssetId})
+	if err == mgo.ErrNotFound {
+		log.Debugf("[areq %s] Asset request is gone, dropping the %s job", job.AssetId, job.Kind)
+		conn.Close()
+		return nil, nil, nil
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, ar, nil
+}
+
+func (prov *Provisioner) build(ctx context.Context, job *persistence.Job) error {
+	if job.Kind == persistence.JobRemediate {
+		return prov.remediate(ctx, job)
+	}
+	return prov.create(ctx, job)
+}
+
+func (prov *Provisioner) create(ctx context.Context, job *persistence.Job) error {
+	conn, assetReq, err := prov.load(job)
+	if err != nil || assetReq == nil {
+		return err
+	}
+	defer conn.Close()
+	switch assetReq.Status {
+	case persistence.RequestNew, persistence.RequestRetry, persistence.RequestBuild:
+	default:
+		log.Debugf("[areq %s] Asset request is %s, nothing to create", assetReq.Id, assetReq.Status)
+		return nil
+	}
+	if assetReq.NotBefore > persistence.Now() {
+		notBefore, _ := time.Parse(persistence.TimeLayout, assetReq.NotBefore)
+		return &retryLater{notBefore.Sub(time.Now()), fmt.Errorf("not before %s", assetReq.NotBefore)}
+	}
+	log.Debugf("[areq %s] Server creation request received from Vertex", assetReq.Id)
+	// claimed again after stormio stopped half way or a failed attempt, the
+	// server may be up. No need to delete the salt key of a retry.
+	if assetReq.Status != persistence.RequestNew && assetReq.ServerId != "" {
+		prov.terminateFailedResource(assetReq, false)
+		assetReq.ServerId = ""
+	}
+
+	if err := prov.createServer(ctx, conn, assetReq); err != nil {
+		if persistence.IsStatusConflict(err) || ctx.Err() != nil {
+			log.Infof("[areq %s] Leaving the asset request as it is :%v", assetReq.Id, err)
+			return nil
+		}
+		// the retries make way for the new creates
+		job.Priority = createPriority(assetReq)
+		return err
+	}
+	////shouldn't notify Vertex if fip is nil
+	if assetReq.IpAddress == "" {
+		log.Debugf("[areq %s] Floating IP is not allocated", assetReq.Id)
+		return nil
+	}
+	//// code ends
+	log.Debugf("[areq %s] Notifying VertexPlatform to create an Asset, ServerId:%s", assetReq.Id, assetReq.ServerId)
+	prov.updateAndNotify(conn, assetReq)
+	return nil
+}
+
+func (prov *Provisioner) remediate(ctx context.Context, job *persistence.Job) error {
+	conn, assetReq, err := prov.load(job)
+	if err != nil || assetReq == nil {
+		return err
+	}
+	defer conn.Close()
+	if !remediating(assetReq) {
+		log.Debugf("[areq %s] Asset request is %s, nothing to remediate", assetReq.Id, assetReq.Status)
+		return nil
+	}
+	assetReq.Remediation = true
+	if err := prov.terminateFailedResource(assetReq, true); err != nil {
+		return err
+	}
+	if err := prov.createServer(ctx, conn, assetReq); err != nil {
+		if persistence.IsStatusConflict(err) || ctx.Err() != nil {
+			log.Infof("[areq %s] Leaving the asset request as it is :%v", assetReq.Id, err)
+			return nil
+		}
+		return err
+	}
+	if assetReq.Status != persistence.RequestHalfFilled {
+		return nil
+	}
+	log.Debugf("[areq %s][res %s] Notifying VertexPlatform to create an Asset, ServerId:%s", assetReq.Id, assetReq.ResourceId, assetReq.ServerId)
+	prov.updateAndNotify(conn, assetReq)
+	return nil
+}
+
+/*
+ * A remediation is carried on by its job after a failed attempt, the request
+ * in RETRY, or after the stormio doing it stopped half way, in BUILD.
+ */
+func remediating(ar *persistence.AssetRequest) bool {
+	switch ar.Status {
+	case persistence.RequestRemediation:
+		return true
+	case persistence.RequestRetry, persistence.RequestBuild:
+		return ar.Remediation
+	}
+	return false
+}
+
+func (prov *Provisioner) activate(_ context.Context, job *persistence.Job) error {
+	log.Debugf("[res %s] VCG is activated notification received", job.ResourceId)
+	if err := prov.notifyActivation(job.ResourceId); err != nil && !persistence.IsStatusConflict(err) {
+		return err
+	}
+	return nil
+}
+
+func (prov *Provisioner) delete(ctx context.Context, job *persistence.Job) error {
+	conn, delReq, err := prov.load(job)
+	if err != nil || delReq == nil {
+		return err
+	}
+	conn.Close()
+	log.Debugf("[res %s] Delete notification recevied", delReq.ServerId)
+	// a hook failing closed holds the delete back, it is tried again
+	if _, err := prov.Hooks.Run(ctx, provision.NewHookEvent(provision.PhaseBeforeDelete, delReq)); err != nil {
+		return err
+	}
+	// nothing is torn down until the caller is sure to hear of it
+	if err := prov.notifyDettachAsset(delReq); err != nil {
+		return err
+	}
+	var steps sync.WaitGroup
+	for _, step := range []func(*persistence.AssetRequest) error{stormstack.DomainDeleteAgent,
+		stormstack.DeRegisterStormAgent, prov.notifyDeActivation} {
+		steps.Add(1)
+		go func(step func(*persistence.AssetRequest) error) {
+			defer steps.Done()
+			step(delReq)
+		}(step)
+	}
+	steps.Wait()
+	// nothing is left to hold back
+	prov.Hooks.Run(ctx, provision.NewHookEvent(provision.PhaseAfterDelete, delReq))
+	return nil
+}
+
+/*
+ * Delete marks the request for deletion and queues its delete, cancelling a
+ * build in flight, which is rolled back before the delete gets to run.
+ * Deleting a request already marked is a no-op.
+ */
+func (prov *Provisioner) Delete(conn *persistence.Connection, ar *persistence.AssetRequest) error {
+	if ar.Status == persistence.RequestMarkDeletion {
+		log.Debugf("[areq %s] Delete already in progress", ar.Id)
+		return nil
+	}
+	if err := prov.Enqueue(persistence.JobDelete, ar); err != nil {
+		return err
+	}
+	if err := prov.UpdateStatus(conn, ar, persistence.RequestMarkDeletion); err != nil {
+		return err
+	}
+	prov.Cancel(ar.Id)
+	return nil
+}
+
+/*
+ * Remediate rebuilds the server of the request keeping its floating ip: the
+ * ip is tracked so it isn't released meanwhile, and the new server retains
+ * it. The request goes through REMEDIATION, BUILD and SERVER_CREATED again.
+ */
+func (prov *Provisioner) Remediate(conn *persistence.Connection, ar *persistence.AssetRequest) error {
+	if ar.IpAddress == "" {
+		return ErrNoFloatingIP
+	}
+	if !persistence.CanTransition(ar.Status, persistence.RequestRemediation) {
+		return &persistence.TransitionError{Id: ar.Id, From: ar.Status, To: persistence.RequestRemediation}
+	}
+	serviceProvision, err := cache.GetProvider(&ar.Provider)
+	if err != nil {
+		return fmt.Errorf("No valid asset provider credentials")
+	}
+	serviceProvision.TrackFloatingIP(ar.IpAddress)
+	ar.Remediation = true
+	ar.Remediations++
+	ar.Attempts, ar.FailureReason, ar.NextAttemptOn = 0, "", ""
+	log.Infof("[areq %s][res %s] Remediating server %s, retaining %s", ar.Id, ar.ResourceId, ar.ServerId, ar.IpAddress)
+	// queued once it is REMEDIATION, a worker claiming it sooner would drop
+	// it. Failing to queue, the leader queues it again when rescheduling.
+	if err := prov.UpdateStatus(conn, ar, persistence.RequestRemediation); err != nil {
+		return err
+	}
+	return prov.Enqueue(persistence.JobRemediate, ar)
+}
+
+// Sleeps for d, false when the provisioner is stopped meanwhile
+func (prov *Provisioner) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-prov.quit:
+		return false
+	}
+}
+
+/*
+ * Stop claims no more jobs and waits for the running ones until the
+ * timeout. The jobs still queued stay in Mongo; the ones cut short are
+ * claimed again once their lease runs out, on this or another stormio.
+ */
+func (prov *Provisioner) Stop(timeout time.Duration) {
+	close(prov.quit)
+	done := make(chan struct{})
+	go func() {
+		prov.inflight.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+		log.Info("Provisioner stopped, no work in flight")
+	case <-time.After(timeout):
+		log.Warnf("Provisioner stopped with work still in flight after %v, it is resumed on the next start", timeout)
+	}
+	// another stormio takes over right away instead of waiting for the lease to expire
+	if prov.IsLeader() {
+		prov.Leases.Release(leaderLease, prov.owner)
+	}
+	prov.Leases.Close()
+	prov.Outbox.Close()
+	prov.Queue.Close()
+}
 
-	go prov.RescheduleOldRequests()
+/*
+ * Queues again what may have been accepted without its job making it to the
+ * queue, stormio stopping in between. Jobs still queued are left as they are.
+ */
+func (prov *Provisioner) resumeInterrupted() {
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		log.Errorf("Error in getting connection, interrupted requests are not resumed :%v", err)
+		return
+	}
+	defer conn.Close()
+	status := []string{persistence.RequestNew, persistence.RequestBuild, persistence.RequestRemediation}
+	assetReqs, err := conn.FindAll(bson.M{"status": bson.M{"$in": status}})
+	if err != nil {
+		log.Errorf("Unable to find the interrupted requests :%v", err)
+		return
+	}
+	for _, assetReq := range assetReqs {
+		if assetReq.Status == persistence.RequestRemediation {
+			prov.Enqueue(persistence.JobRemediate, assetReq)
+		} else {
+			prov.Enqueue(persistence.JobCreate, assetReq)
+		}
+	}
 }
 
-func (prov *Provisioner) createServer(conn *persistence.Connection, ar *persistence.AssetRequest) (err error) {
+/*
+ * createServer makes one attempt at the server of the request. A failed
+ * attempt leaves the request in RETRY and returns a retryLater with the wait
+ * the retry policy of the error asks for, or moves it to FAIL once the
+ * policy is exhausted, the reason recorded in FailureReason. A build
+ * cancelled, or done for a request deleted meanwhile, is rolled back.
+ */
+func (prov *Provisioner) createServer(ctx context.Context, conn *persistence.Connection, ar *persistence.AssetRequest) (err error) {
 	log.Debugf("[areq %s] Creating a VCG", ar.Id)
 
 	serviceProvision, err := cache.GetProvider(&ar.Provider)
@@ -122,59 +676,174 @@ func (prov *Provisioner) createServer(conn *persistence.Connection, ar *persiste
 		log.Criticalf("[%s][%s]No service provision instance, can't proceed with server creation", ar.Id, ar.ResourceId)
 		return fmt.Errorf("No valid asset provider credentials")
 	}
-	created := false
-	ar.Status = persistence.RequestBuild
-	conn.Update(ar)
-
-	for i := 0; i < 5; i++ {
-		entityId := ""
-		entityId, fip, err := serviceProvision.ProvisionInstance(ar)
-		if err == nil && fip != "" {
-			ar.ServerId = entityId
-			ar.IpAddress = fip
-			created = true
-			break
-		} else {
-			if entityId != "" {
-				ar.ServerId = entityId
+	if err := prov.UpdateStatus(conn, ar, persistence.RequestBuild); err != nil {
+		return err
+	}
+
+	entityId, fip, perr := serviceProvision.ProvisionInstance(ctx, ar, prov.Hooks, func(entry persistence.Log) {
+		prov.addStep(conn, ar.Id, entry)
+	})
+	if ctx.Err() != nil {
+		prov.rollback(serviceProvision, ar, entityId, fip)
+		return ctx.Err()
+	}
+	if perr == nil && fip != "" {
+		ar.ServerId, ar.IpAddress = entityId, fip
+		ar.FailureReason, ar.NextAttemptOn = "", ""
+		if err = prov.UpdateStatus(conn, ar, persistence.RequestHalfFilled); persistence.IsStatusConflict(err) {
+			// deleted while it was being built, nobody is left to clean it up
+			prov.rollback(serviceProvision, ar, entityId, fip)
+		}
+		return
+	}
+
+	if entityId != "" {
+		ar.ServerId = entityId
+	}
+	if perr == nil {
+		perr = &provision.ProvisionError{Code: provision.ErrorAssociateIP, Err: fmt.Errorf("No floating ip")}
+	}
+	teardown := func() {
+		pe, ok := perr.(*provision.ProvisionError)
+		if !ok {
+			return
+		}
+		switch pe.Code {
+		case provision.ErrorServerCreate, provision.ErrorSettingHostName, provision.ErrorAssociateIP, provision.ErrorStormRegister, provision.ErrorHook:
+			if len(entityId) > 0 {
+				serviceProvision.DeprovisionInstance(ar)
 			}
-			perr := err.(*provision.ProvisionError)
-			switch perr.Code {
-			case provision.ErrorServerCreate, provision.ErrorSettingHostName, provision.ErrorAssociateIP, provision.ErrorStormRegister:
-				if len(entityId) > 0 {
-					serviceProvision.DeprovisionInstance(ar)
+			// the one being retained is kept for the next attempt
+			if fip != "" && !ar.Remediation {
+				if err := serviceProvision.ReleaseFloatingIP(fip); err != nil {
+					log.Errorf("[areq %s] Unable to release floating ip %s :%v", ar.Id, fip, err)
 				}
-			case provision.ErrorFindFlavor, provision.ErrorFindImage:
-				log.Debugf("Image / Flavor not found %v", perr)
-
 			}
+		case provision.ErrorFindFlavor, provision.ErrorFindImage:
+			log.Debugf("Image / Flavor not found %v", pe)
 		}
-		log.Debugf("[arq %s] Provisioning instance failed for the Asset Request. Retrying in 10 seconds", ar.Id)
-		time.Sleep(10 * time.Second)
 	}
-	if created {
-		ar.Status = persistence.RequestHalfFilled
+	if toldOf(perr) {
+		prov.tearDown(ar, entityId, fip, teardown)
 	} else {
-		//Reschedule it
-		log.Debugf("[areq %s] Rescheduling the Asset create request in 5min", ar.Id)
-		ar.Status = persistence.RequestRetry
+		teardown()
 	}
-	conn.Update(ar)
-	return
+
+	ar.Attempts++
+	ar.FailureReason = perr.Error()
+	policy := prov.Retry.For(perr)
+	if policy.Exhausted(ar.Attempts) {
+		log.Errorf("[areq %s] Provisioning failed after %d attempts, giving up :%v", ar.Id, ar.Attempts, perr)
+		prov.addStep(conn, ar.Id, persistence.NewLog(persistence.StepFail, time.Time{}, perr,
+			fmt.Sprintf("Gave up after %d attempts", ar.Attempts)))
+		ar.NextAttemptOn = ""
+		return prov.UpdateStatus(conn, ar, persistence.RequestFail)
+	}
+	delay := policy.Backoff(ar.Attempts)
+	ar.NextAttemptOn = persistence.FormatTime(time.Now().Add(delay))
+	log.Debugf("[areq %s] Provisioning attempt %d failed, retrying in %v :%v", ar.Id, ar.Attempts, delay, perr)
+	prov.addStep(conn, ar.Id, persistence.NewLog(persistence.StepRetry, time.Time{}, perr,
+		fmt.Sprintf("Attempt %d failed, retrying at %s", ar.Attempts, ar.NextAttemptOn)))
+	if err = prov.UpdateStatus(conn, ar, persistence.RequestRetry); err != nil {
+		return
+	}
+	return &retryLater{delay, perr}
 }
 
-func (prov *Provisioner) updateAndNotify(conn *persistence.Connection, arRes *persistence.AssetRequest) {
-	err := prov.notifyAttachAsset(arRes)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			arRes.Status = persistence.RequestMarkDeletion
-		} else {
-			arRes.Status = persistence.RequestNotifyFail
+/*
+ * Undoes what a build got to before its request was deleted: the server, its
+ * floating ip, retained for a rebuild or not, and the storm agent it
+ * registered. The delete job of the request only runs once this is done,
+ * holding its lock, and knows none of it.
+ */
+func (prov *Provisioner) rollback(svc *provision.ServiceProvision, ar *persistence.AssetRequest, serverId, fip string) {
+	log.Infof("[areq %s] Asset request is being deleted, rolling back server %s and floating ip %s", ar.Id, serverId, fip)
+	if fip == "" && ar.Remediation {
+		fip = ar.IpAddress
+	}
+	prov.tearDown(ar, serverId, fip, func() {
+		if serverId != "" {
+			ar.ServerId = serverId
+			if err := svc.DeprovisionInstance(ar); err != nil {
+				log.Errorf("[areq %s] Unable to delete server %s :%v", ar.Id, serverId, err)
+			}
+		}
+		if fip != "" {
+			if err := svc.ReleaseFloatingIP(fip); err != nil {
+				log.Errorf("[areq %s] Unable to release floating ip %s :%v", ar.Id, fip, err)
+			}
+		}
+		stormstack.DomainDeleteAgent(ar)
+		stormstack.DeRegisterStormAgent(ar)
+	})
+}
+
+/*
+ * Runs teardown between the before-delete and after-delete hooks, so the
+ * systems told of the server before RunServer hear it is gone. Nothing is
+ * held back by a hook failing here, the build is undone all the same.
+ */
+func (prov *Provisioner) tearDown(ar *persistence.AssetRequest, serverId, fip string, teardown func()) {
+	event := provision.NewHookEvent(provision.PhaseBeforeDelete, ar)
+	event.ServerId, event.IpAddress = serverId, fip
+	if _, err := prov.Hooks.Run(context.Background(), event); err != nil {
+		log.Warnf("[areq %s] Tearing down server %s all the same :%v", ar.Id, serverId, err)
+	}
+	teardown()
+	event.Phase = provision.PhaseAfterDelete
+	prov.Hooks.Run(context.Background(), event)
+}
+
+// Whether the hooks before RunServer were told of the server, all but failing themselves
+func toldOf(perr error) bool {
+	if pe, ok := perr.(*provision.ProvisionError); ok {
+		if he, ok := pe.Err.(*provision.HookError); ok {
+			return he.Phase != provision.PhaseBeforeRunServer
 		}
 	}
+	return true
+}
+
+// retryLater hands the job back to be claimed after delay, as the retry policy asks
+type retryLater struct {
+	delay time.Duration
+	cause error
+}
+
+func (rl *retryLater) Error() string {
+	return fmt.Sprintf("retrying in %v: %v", rl.delay, rl.cause)
+}
+
+// Records the attach callback before the server of the request is saved
+func (prov *Provisioner) updateAndNotify(conn *persistence.Connection, arRes *persistence.AssetRequest) {
+	if err := prov.notifyAttachAsset(arRes); err != nil {
+		arRes.FailureReason = "Unable to record the attach callback: " + err.Error()
+		prov.UpdateStatus(conn, arRes, persistence.RequestNotifyFail)
+		return
+	}
 	conn.Update(arRes)
 }
 
+/*
+ * UpdateStatus moves the request to the given status through the state
+ * machine, which keeps the one it leaves in PreviousStatus and runs the
+ * hooks, publishing the transition among them.
+ */
+func (prov *Provisioner) UpdateStatus(conn *persistence.Connection, ar *persistence.AssetRequest, status string) error {
+	if err := prov.States.Transition(conn, ar, status); err != nil {
+		log.Errorf("[areq %s] Unable to save status %s :%v", ar.Id, status, err)
+		return err
+	}
+	return nil
+}
+
+// Records a step on the timeline of the request, a failure to is only logged
+func (prov *Provisioner) addStep(conn *persistence.Connection, assetId string, entry persistence.Log) {
+	if err := conn.Record(assetId, entry); err != nil {
+		log.Warnf("[areq %s] Unable to record %s on the timeline :%v", assetId, entry.Step, err)
+	}
+}
+
 /*
  * Send this information to VertexPlatform
  */
@@ -201,35 +870,36 @@ func (prov *Provisioner) notifyAttachAsset(arRes *persistence.AssetRequest) erro
 	req.Asset.IsActive = true
 	req.Asset.AgentId = arRes.AgentId
 
-	var resp persistence.AssetRequest
-	headers := make(http.Header)
-	headers.Add("V-Auth-Token", arRes.Notify.Token)
-	reqData := &goosehttp.RequestData{ReqHeaders: headers, ReqValue: req, RespValue: &resp,
-		ExpectedStatus: []int{http.StatusOK}}
-	url := fmt.Sprintf("%s", arRes.Notify.Url)
-	log.Debugf("[areq %s][res %s] Updating Caller [%s] with Asset details", arRes.Id, arRes.ResourceId, url)
-	err := prov.Client.SendRequest(client.POST, "", url, reqData)
-	if err != nil {
-		log.Errorf("[areq %s][res %s] Caller Error on Asset attach. Error[%v]", arRes.Id, arRes.ResourceId, err)
-		return err
-	}
-	log.Debugf("[areq %s][res %s] Update to Caller on Asset attach acknowledged", arRes.Id, arRes.ResourceId)
-	return nil
+	log.Debugf("[areq %s][res %s] Updating Caller [%s] with Asset details", arRes.Id, arRes.ResourceId, arRes.Notify.Url)
+	return prov.record(&persistence.Callback{Kind: persistence.CallbackAttach, AssetId: arRes.Id,
+		ResourceId: arRes.ResourceId, Method: client.POST, Url: arRes.Notify.Url, Token: arRes.Notify.Token,
+		Expected: []int{http.StatusOK}}, req)
 }
 
+/*
+ * Records the detach of the deleted request, once however often its delete
+ * job is retried. Vertex not knowing the asset, never attached, is as good.
+ */
 func (prov *Provisioner) notifyDettachAsset(ar *persistence.AssetRequest) error {
+	url := fmt.Sprintf("%s/%s", ar.Notify.Url, ar.Id)
+	log.Debugf("[res %s] Deleting the attached asset in Caller [%s]", ar.ResourceId, url)
+	return prov.record(&persistence.Callback{Id: persistence.CallbackDetach + ":" + ar.Id, Kind: persistence.CallbackDetach,
+		AssetId: ar.Id, ResourceId: ar.ResourceId, Method: client.DELETE, Url: url, Token: ar.Notify.Token,
+		Expected: []int{http.StatusOK, http.StatusNoContent, http.StatusNotFound}}, nil)
+}
+
+// Detaches the asset right away, without holding back the callbacks to come
+func (prov *Provisioner) detachNow(ar *persistence.AssetRequest) {
 	headers := make(http.Header)
 	headers.Add("V-Auth-Token", ar.Notify.Token)
-	reqData := &goosehttp.RequestData{ReqHeaders: headers, ExpectedStatus: []int{http.StatusOK, http.StatusNoContent}}
+	reqData := &goosehttp.RequestData{ReqHeaders: headers,
+		ExpectedStatus: []int{http.StatusOK, http.StatusNoContent, http.StatusNotFound}}
 	url := fmt.Sprintf("%s/%s", ar.Notify.Url, ar.Id)
-
-	err := prov.Client.SendRequest(client.DELETE, "", url, reqData)
-	if err != nil {
-		log.Errorf("[res %s] Caller error on Asset Detach Error[%v]", ar.ResourceId, err)
-		return err
+	if err := prov.Client.SendRequest(client.DELETE, "", url, reqData); err != nil {
+		log.Warnf("[res %s] Caller error on Asset Detach, going on :%v", ar.ResourceId, err)
+		return
 	}
-	log.Debugf("[res %s] Deleted the attached asset in  Caller [%s]", ar.ResourceId, url)
-	return nil
+	log.Debugf("[res %s] Deleted the attached asset in Caller [%s]", ar.ResourceId, url)
 }
 
 func (prov *Provisioner) getAssetProvider(id string) (*persistence.AssetProvider, error) {
@@ -254,42 +924,134 @@ func (prov *Provisioner) getAssetModel(id string) (*persistence.AssetModel, erro
 
 func (prov *Provisioner) RescheduleOldRequests() {
 	//Don't start immediately, wait for 5 min and start
-	time.Sleep(time.Duration(2) * time.Minute)
+	if !prov.sleep(time.Duration(2) * time.Minute) {
+		return
+	}
 
 	for {
+		if !prov.IsLeader() {
+			if !prov.sleep(prov.leaderTTL) {
+				return
+			}
+			continue
+		}
+		// the only sweep of the cluster, a Mongo outage only skips a round
 		conn, err := persistence.DefaultSession()
 		if err != nil {
-			log.Errorf("Error in getting connection :%v", err)
-			return
+			log.Errorf("Error in getting connection, rescheduling again in 5 minutes :%v", err)
+			if !prov.sleep(time.Duration(5) * time.Minute) {
+				return
+			}
+			continue
 		}
-		status := []string{persistence.RequestRetry, persistence.RequestMarkDeletion}
+		status := []string{persistence.RequestRetry, persistence.RequestMarkDeletion, persistence.RequestRemediation}
 		assetReqs, err := conn.FindAll(bson.M{"status": bson.M{"$in": status}})
-		log.Debugf("These many %d asset requests have to retry", len(assetReqs))
 		if err != nil {
-			return
+			log.Errorf("Unable to find the requests to reschedule, again in 5 minutes :%v", err)
+			conn.Close()
+			if !prov.sleep(time.Duration(5) * time.Minute) {
+				return
+			}
+			continue
 		}
+		log.Debugf("These many %d asset requests have to retry", len(assetReqs))
 		for _, assetReq := range assetReqs {
 			switch assetReq.Status {
 			case persistence.RequestMarkDeletion:
+				// queued, the delete waits for a build still running to be rolled back
 				log.Debugf("[areq %s][res %s] Marked for Deletion. Terminate the asset for HostName[%s]", assetReq.Id, assetReq.ResourceId, assetReq.HostName)
-				prov.notifyDeActivation(assetReq)
+				prov.Enqueue(persistence.JobDelete, assetReq)
 			case persistence.RequestRetry:
+				// the retry is normally still queued, this only catches the ones whose job got lost
+				if assetReq.NextAttemptOn > persistence.Now() {
+					continue
+				}
 				log.Debugf("[areq %s][res %s]  Recreating the asset HostName[%s]", assetReq.Id, assetReq.ResourceId, assetReq.HostName)
-				// Ravi: RequestRetry happens when openstack server creation failed in last attempt. Hence no need to delete salt key
-				prov.terminateFailedResource(assetReq, false)
-				prov.CRequest <- assetReq
+				if assetReq.Remediation {
+					prov.Enqueue(persistence.JobRemediate, assetReq)
+					continue
+				}
+				prov.Enqueue(persistence.JobCreate, assetReq)
+			case persistence.RequestRemediation:
+				prov.Enqueue(persistence.JobRemediate, assetReq)
 			}
 
 		}
+		if util.GetBoolDefault("remediation", "auto", false) {
+			prov.remediateStalled(conn)
+		}
 
 		conn.Close()
-		time.Sleep(time.Duration(5) * time.Minute)
+		if !prov.sleep(time.Duration(5) * time.Minute) {
+			return
+		}
 	}
 	return
 }
 
+/*
+ * reapExpired deletes the requests whose ExpiresAt passed, every [schedule]
+ * reap-interval seconds, on the leader.
+ */
+func (prov *Provisioner) reapExpired() {
+	interval := time.Duration(util.GetIntDefault("schedule", "reap-interval", 60)) * time.Second
+	for prov.sleep(interval) {
+		if !prov.IsLeader() {
+			continue
+		}
+		conn, err := persistence.DefaultSession()
+		if err != nil {
+			log.Errorf("Error in getting connection, expired requests are not deleted :%v", err)
+			continue
+		}
+		expired, err := conn.FindAll(bson.M{
+			"expiresat": bson.M{"$gt": "", "$lte": persistence.Now()},
+			"status":    bson.M{"$ne": persistence.RequestMarkDeletion},
+		})
+		if err != nil {
+			log.Errorf("Unable to find the expired requests :%v", err)
+		}
+		for _, ar := range expired {
+			log.Infof("[areq %s][res %s] Expired at %s, deleting", ar.Id, ar.ResourceId, ar.ExpiresAt)
+			if err := prov.Delete(conn, ar); err != nil {
+				log.Errorf("[areq %s] Unable to delete the expired request :%v", ar.Id, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+/*
+ * A server that doesn't get activated within [remediation]
+ * activation-timeout minutes is taken for sick and rebuilt, at most
+ * max-auto times.
+ */
+func (prov *Provisioner) remediateStalled(conn *persistence.Connection) {
+	timeout := time.Duration(util.GetIntDefault("remediation", "activation-timeout", 30)) * time.Minute
+	maxAuto := util.GetIntDefault("remediation", "max-auto", 3)
+	status := []string{persistence.RequestHalfFilled, persistence.RequestProvision,
+		persistence.RequestRetryModuleInstall, persistence.RequestRetryModuleConfig}
+	// requests saved before the change time was kept have none to go by
+	stalled, err := conn.FindAll(bson.M{
+		"status":          bson.M{"$in": status},
+		"statuschangedon": bson.M{"$lt": persistence.FormatTime(time.Now().Add(-timeout)), "$gt": ""},
+		"remediations":    bson.M{"$lt": maxAuto},
+	})
+	if err != nil {
+		log.Errorf("Unable to find the stalled requests :%v", err)
+		return
+	}
+	for _, ar := range stalled {
+		log.Warnf("[areq %s][res %s] Not activated %v after the server was created, remediating", ar.Id, ar.ResourceId, timeout)
+		if err := prov.Remediate(conn, ar); err != nil {
+			log.Errorf("[areq %s] Unable to remediate :%v", ar.Id, err)
+		}
+	}
+}
+
+// Vertex may have heard of the server being replaced, it is told best effort
 func (prov *Provisioner) terminateFailedResource(ar *persistence.AssetRequest, deleteSaltKey bool) error {
-	prov.notifyDettachAsset(ar)
+	prov.detachNow(ar)
 	return prov.terminateInstance(ar, deleteSaltKey)
 }
 
@@ -320,17 +1082,22 @@ func (prov *Provisioner) terminateInstance(ar *persistence.AssetRequest, deleteK
 }
 
 func (prov *Provisioner) notifyDeActivation(ar *persistence.AssetRequest) (err error) {
-	if err = prov.terminateInstance(ar, false); err == nil {
-		conn, err := persistence.DefaultSession()
-		if err == nil {
-			defer conn.Close()
-		}
-		return conn.Remove(ar.Id)
+	if err = prov.terminateInstance(ar, false); err != nil {
+		return err
+	}
+	conn, err := persistence.DefaultSession()
+	if err != nil {
+		log.Errorf("[areq %s] Error in getting connection :%v", ar.Id, err)
+		return err
+	}
+	defer conn.Close()
+	if err = conn.Remove(ar.Id); err == nil {
+		prov.Events.Publish(events.FromAsset(events.TypeDeleted, ar))
 	}
 	return err
 }
 
-//On notify activation, modules will be installed and pushes configuration.
+// On notify activation, modules will be installed and pushes configuration.
 func (prov *Provisioner) notifyActivation(resourceId string) error {
 	conn, cerr := persistence.DefaultSession()
 	if cerr != nil {
@@ -341,46 +1108,33 @@ func (prov *Provisioner) notifyActivation(resourceId string) error {
 	ar, err := conn.Find(bson.M{"resourceid": resourceId})
 	defer conn.Close()
 
+	if err == mgo.ErrNotFound {
+		return persistence.ErrGone
+	}
 	if err != nil {
 		return err
 	}
-	if ar.Status == persistence.RequestFulfilled {
-		log.Errorf("[res %s] Resource already fullfilled", resourceId)
-		return fmt.Errorf("Resource is %s already full filled", resourceId)
+	if !persistence.CanTransition(ar.Status, persistence.RequestFulfilled) {
+		log.Errorf("[res %s] Resource can't be fullfilled while %s", resourceId, ar.Status)
+		return &persistence.TransitionError{Id: ar.Id, From: ar.Status, To: persistence.RequestFulfilled}
 	}
-	conn.Update(ar)
 
-	if err = prov.activateVertexResource(resourceId); err != nil {
-		//TODO This needs to be fixed, what is the correct status
-		ar.Status = persistence.RequestRetry
-		conn.Update(ar)
+	if err = prov.activateVertexResource(ar); err != nil {
 		return err
 	}
 
 	log.Debugf("[res %s] Successfully activated resource", resourceId)
-	ar.Status = persistence.RequestFulfilled
-	if ar.Remediation {
-		ar.Remediation = false
-	}
 	ar.Remediation = false
-	conn.Update(ar)
+	prov.UpdateStatus(conn, ar, persistence.RequestFulfilled)
 	return nil
 }
 
-func (prov *Provisioner) activateVertexResource(resourceId string) (err error) {
-	resp := make(util.Response)
-	reqData := &goosehttp.RequestData{RespValue: &resp,
-		ExpectedStatus: []int{http.StatusOK}}
+func (prov *Provisioner) activateVertexResource(ar *persistence.AssetRequest) error {
 	vertexPlatformURL := util.GetString("external", "vertex-url")
-	url := fmt.Sprintf("%s/resource/%s/activated", vertexPlatformURL, resourceId)
-	log.Debugf("[res %s] Setting resource into Active state", resourceId)
-	err = prov.Client.SendRequest(client.PUT, "", url, reqData)
-
-	if err != nil {
-		log.Errorf("[res %s] Changing resource status failed,  Error[%v]", resourceId, err)
-		return
-	}
-	return
+	url := fmt.Sprintf("%s/resource/%s/activated", vertexPlatformURL, ar.ResourceId)
+	log.Debugf("[res %s] Setting resource into Active state", ar.ResourceId)
+	return prov.record(&persistence.Callback{Kind: persistence.CallbackActivate, AssetId: ar.Id,
+		ResourceId: ar.ResourceId, Method: client.PUT, Url: url, Expected: []int{http.StatusOK}}, nil)
 }
 
 func (prov *Provisioner) UploadImage(assetProvider *persistence.AssetProvider, req *http.Request) string {
@@ -409,21 +1163,17 @@ func (prov *Provisioner) CheckFIPAvailability(ar *persistence.AssetRequest) (cou
 	return -1, fmt.Errorf("Floating IPS are not available")
 }
 
-func (prov *Provisioner) RenameServer(assetId, newName string) error {
-	conn, err := persistence.DefaultSession()
-	if err != nil {
-		log.Errorf("areq %s] Error in getting connection :%v", assetId, err)
-		return err
-	}
-	defer conn.Close()
-	ar, _ := conn.Find(bson.M{"_id": assetId})
+// RenameServer renames the server of the request, the caller records the new host name
+func (prov *Provisioner) RenameServer(ar *persistence.AssetRequest, newName string) error {
 	svcProv, err := cache.GetProvider(&ar.Provider)
 	if err != nil {
 		log.Criticalf("[%s][%s]No service provision instance, can't proceed with renaming server ", ar.Id, ar.ResourceId)
 		return fmt.Errorf("No valid asset provider credentials, can't rename")
 	}
 
-	ar.HostName = newName
-	conn.Update(ar)
-	return svcProv.RenameServer(ar.ServerId, newName)
+	if err := svcProv.RenameServer(ar.ServerId, newName); err != nil {
+		log.Errorf("[areq %s][res %s] Unable to rename server %s :%v", ar.Id, ar.ResourceId, ar.ServerId, err)
+		return fmt.Errorf("Unable to rename")
+	}
+	return nil
 }
@@ -0,0 +1,204 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	. "launchpad.net/gocheck"
+	"launchpad.net/goose/identity"
+	"launchpad.net/goose/testservices/openstackservice"
+	"net/http"
+	"net/http/httptest"
+	"stormstack.org/stormio/conf"
+	"stormstack.org/stormio/persistence"
+	"stormstack.org/stormio/provision"
+	"stormstack.org/stormio/util"
+	"time"
+)
+
+type SchedulerSuite struct{}
+
+var _ = Suite(&SchedulerSuite{})
+
+func (s *SchedulerSuite) TestCancel(c *C) {
+	prov := &Provisioner{builds: make(map[string]context.CancelFunc)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	prov.builds["a1"] = cancel
+
+	c.Assert(prov.Cancel("a2"), Equals, false)
+	c.Assert(ctx.Err(), IsNil)
+	c.Assert(prov.Cancel("a1"), Equals, true)
+	c.Assert(ctx.Err(), Equals, context.Canceled)
+}
+
+func (s *SchedulerSuite) TestTearDownHooks(c *C) {
+	var phases []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event provision.HookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		phases = append(phases, event.Phase+" "+event.IpAddress)
+		// failing closed, nothing is held back
+		http.Error(w, "no", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	cfg, _ := conf.ReadConfigBytes([]byte("[hooks]\nbefore-delete=ipam\nafter-delete=ipam\nipam.url=" + server.URL + "\n"))
+	hooks, err := provision.LoadHooks(cfg, "hooks")
+	c.Assert(err, IsNil)
+	prov := &Provisioner{Hooks: hooks}
+
+	prov.tearDown(&persistence.AssetRequest{Id: "a1"}, "s1", "10.0.0.7", func() {
+		phases = append(phases, "teardown")
+	})
+	c.Assert(phases, DeepEquals, []string{"before-delete 10.0.0.7", "teardown", "after-delete 10.0.0.7"})
+
+	hookErr := &provision.HookError{Hook: "ipam", Phase: provision.PhaseBeforeRunServer, Err: fmt.Errorf("no")}
+	c.Assert(toldOf(&provision.ProvisionError{Code: provision.ErrorHook, Err: hookErr}), Equals, false)
+	hookErr.Phase = provision.PhaseAfterFIP
+	c.Assert(toldOf(&provision.ProvisionError{Code: provision.ErrorHook, Err: hookErr}), Equals, true)
+	c.Assert(toldOf(&provision.ProvisionError{Code: provision.ErrorServerCreate, Err: fmt.Errorf("no")}), Equals, true)
+}
+
+func (s *SchedulerSuite) TestRemediating(c *C) {
+	for _, t := range []struct {
+		status      string
+		remediation bool
+		remediating bool
+	}{
+		{persistence.RequestRemediation, false, true},
+		// a failed attempt, or a stormio stopped half way
+		{persistence.RequestRetry, true, true},
+		{persistence.RequestBuild, true, true},
+		// the create of the request, not its remediation
+		{persistence.RequestRetry, false, false},
+		{persistence.RequestBuild, false, false},
+		{persistence.RequestHalfFilled, true, false},
+		{persistence.RequestFail, true, false},
+		{persistence.RequestMarkDeletion, true, false},
+	} {
+		ar := &persistence.AssetRequest{Status: t.status, Remediation: t.remediation}
+		c.Assert(remediating(ar), Equals, t.remediating, Commentf("%s remediation %v", t.status, t.remediation))
+	}
+}
+
+/*
+ * An OpenStack double, keystone and nova, with the asset provider to
+ * authenticate against it.
+ */
+func fakeCloud() (*httptest.Server, persistence.AssetProvider) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	creds := &identity.Credentials{URL: server.URL, User: "fred", Secrets: "secret", Region: "r1", TenantName: "t1"}
+	openstackservice.New(creds).SetupHTTP(mux)
+	return server, persistence.AssetProvider{EndPointURL: server.URL, Username: "fred", Password: "secret",
+		Tenant: "t1", RegionName: "r1"}
+}
+
+type RemediateSuite struct {
+	saved    *conf.ConfigFile
+	session  *mgo.Session
+	cloud    *httptest.Server
+	provider persistence.AssetProvider
+	prov     *Provisioner
+	conn     *persistence.Connection
+}
+
+var _ = Suite(&RemediateSuite{})
+
+func (s *RemediateSuite) SetUpSuite(c *C) {
+	session, err := mgo.DialWithTimeout("localhost:27017", time.Second)
+	if err != nil {
+		c.Skip("no mongo to remediate against: " + err.Error())
+	}
+	s.session = session
+	s.saved = util.Config
+	util.Config, _ = conf.ReadConfigBytes([]byte("[database]\nhost=localhost\nport=27017\n"))
+	queue, err := persistence.OpenQueue("JobsRemediateTest")
+	c.Assert(err, IsNil)
+	s.prov = &Provisioner{Queue: queue, States: persistence.NewStateMachine()}
+	s.conn, err = persistence.DefaultSession()
+	c.Assert(err, IsNil)
+	s.cloud, s.provider = fakeCloud()
+}
+
+func (s *RemediateSuite) TearDownSuite(c *C) {
+	if s.session == nil {
+		return
+	}
+	s.cloud.Close()
+	s.conn.Close()
+	s.prov.Queue.Close()
+	s.session.Close()
+	util.Config = s.saved
+}
+
+func (s *RemediateSuite) SetUpTest(c *C) {
+	s.session.DB(persistence.Database).C("JobsRemediateTest").DropCollection()
+}
+
+// A request of the fake cloud saved in status
+func (s *RemediateSuite) request(c *C, status string, remediation bool) *persistence.AssetRequest {
+	ar := &persistence.AssetRequest{Id: persistence.NewUUID(), ResourceId: persistence.NewUUID(), HostName: "vcg",
+		ServerId: "s1", IpAddress: "10.0.0.7", Provider: s.provider, Status: status, Remediation: remediation,
+		StatusChangedOn: persistence.Now()}
+	c.Assert(s.conn.Create(ar), IsNil)
+	return ar
+}
+
+func (s *RemediateSuite) TestRemediate(c *C) {
+	ar := s.request(c, persistence.RequestFulfilled, false)
+	defer s.conn.Remove(ar.Id)
+	c.Assert(s.prov.Remediate(s.conn, ar), IsNil)
+
+	stored, err := s.conn.Find(bson.M{"_id": ar.Id})
+	c.Assert(err, IsNil)
+	c.Assert(stored.Status, Equals, persistence.RequestRemediation)
+	c.Assert(stored.Remediation, Equals, true)
+	c.Assert(stored.Remediations, Equals, 1)
+	job, err := s.prov.Queue.Claim("test", persistence.JobRemediate)
+	c.Assert(err, IsNil)
+	c.Assert(job, NotNil)
+	c.Assert(job.AssetId, Equals, ar.Id)
+
+	// once is enough
+	c.Assert(persistence.IsStatusConflict(s.prov.Remediate(s.conn, stored)), Equals, true)
+}
+
+func (s *RemediateSuite) TestRemediateRefused(c *C) {
+	ar := s.request(c, persistence.RequestFulfilled, false)
+	defer s.conn.Remove(ar.Id)
+	ar.IpAddress = ""
+	c.Assert(s.prov.Remediate(s.conn, ar), Equals, ErrNoFloatingIP)
+
+	ar = s.request(c, persistence.RequestBuild, false)
+	defer s.conn.Remove(ar.Id)
+	c.Assert(persistence.IsStatusConflict(s.prov.Remediate(s.conn, ar)), Equals, true)
+	job, err := s.prov.Queue.Claim("test", persistence.JobRemediate)
+	c.Assert(err, IsNil)
+	c.Assert(job, IsNil)
+}
+
+// The job of a remediation the request moved on from is dropped, untouched
+func (s *RemediateSuite) TestRemediateDropped(c *C) {
+	for _, t := range []struct {
+		status      string
+		remediation bool
+	}{
+		{persistence.RequestHalfFilled, true},
+		{persistence.RequestRetry, false},
+		{persistence.RequestMarkDeletion, true},
+	} {
+		ar := s.request(c, t.status, t.remediation)
+		defer s.conn.Remove(ar.Id)
+		err := s.prov.remediate(context.Background(), &persistence.Job{Kind: persistence.JobRemediate, AssetId: ar.Id})
+		c.Assert(err, IsNil)
+		stored, err := s.conn.Find(bson.M{"_id": ar.Id})
+		c.Assert(err, IsNil)
+		c.Assert(stored.Status, Equals, t.status)
+		c.Assert(stored.ServerId, Equals, "s1")
+	}
+	// gone meanwhile
+	c.Assert(s.prov.remediate(context.Background(), &persistence.Job{Kind: persistence.JobRemediate, AssetId: "gone"}), IsNil)
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	seelog "github.com/cihub/seelog"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -28,5 +31,27 @@ func main() {
 	port := util.GetString("server", "port")
     fmt.Printf("Starting stormio on %s:%s using %d CPUs", host, port, ncpu)
 	seelog.Debugf("No of CPU's available :%d", ncpu)
-	controllers.StartServer(host, port)
+	if err := controllers.StartServer(host, port); err != nil {
+		seelog.Criticalf("Unable to start on %s:%s :%v", host, port, err)
+		seelog.Flush()
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	sig := <-signals
+	for ; sig == syscall.SIGHUP; sig = <-signals {
+		reloaded, err := controllers.ReloadTLS()
+		switch {
+		case err != nil:
+			seelog.Errorf("Unable to reload the TLS certificates, keeping the loaded ones :%v", err)
+		case reloaded:
+			seelog.Info("TLS certificates reloaded")
+		default:
+			seelog.Debug("Not serving TLS, no certificates to reload")
+		}
+	}
+	timeout := time.Duration(util.GetIntDefault("server", "shutdown-timeout", 30)) * time.Second
+	seelog.Infof("Received %v, shutting down within %v", sig, timeout)
+	controllers.StopServer(timeout)
 }
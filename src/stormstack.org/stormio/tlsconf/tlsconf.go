@@ -0,0 +1,183 @@
+/*
+ * Package tlsconf builds the TLS configuration of the stormio listener from
+ * the [server] section.
+ *
+ * The certificate, its key and the client CA bundle are read again on
+ * Reload, connections accepted afterwards are served with the new files
+ * while the established ones carry on. A reload that fails keeps what was
+ * loaded before.
+ */
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"stormstack.org/stormio/conf"
+	"strings"
+	"sync"
+)
+
+const (
+	optCert       = "tls-cert"
+	optKey        = "tls-key"
+	optMinVersion = "tls-min-version"
+	optCiphers    = "tls-ciphers"
+	optClientCA   = "tls-client-ca"
+	optClientAuth = "tls-client-auth"
+
+	DefaultMinVersion = tls.VersionTLS12
+)
+
+var (
+	ErrNoKey         = errors.New("tlsconf: tls-cert is set without tls-key")
+	ErrNoClientCerts = errors.New("tlsconf: no certificate found in the client CA bundle")
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuths = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+type Reloader struct {
+	sync.RWMutex
+	certFile, keyFile, caFile string
+	base                      *tls.Config
+	cert                      *tls.Certificate
+	clientCAs                 *x509.CertPool
+}
+
+/*
+ * Load reads the TLS options of the section, nil is returned when tls-cert
+ * isn't set and the listener stays plain HTTP.
+ *
+ *	[server]
+ *	tls-cert=/etc/stormio/tls/server.crt
+ *	tls-key=/etc/stormio/tls/server.key
+ *	tls-min-version=1.2
+ *	tls-ciphers=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+ *	tls-client-ca=/etc/stormio/tls/vertex-ca.crt
+ *	tls-client-auth=require
+ *
+ * The ciphers apply up to TLS 1.2, the TLS 1.3 suites aren't configurable.
+ * Client certificates are required once tls-client-ca is set, unless
+ * tls-client-auth says optional.
+ */
+func Load(c *conf.ConfigFile, section string) (*Reloader, error) {
+	certFile, _ := c.GetString(section, optCert)
+	if certFile == "" {
+		return nil, nil
+	}
+	r := &Reloader{certFile: certFile, base: &tls.Config{MinVersion: DefaultMinVersion}}
+	if r.keyFile, _ = c.GetString(section, optKey); r.keyFile == "" {
+		return nil, ErrNoKey
+	}
+
+	if name, _ := c.GetString(section, optMinVersion); name != "" {
+		version, ok := versions[name]
+		if !ok {
+			return nil, fmt.Errorf("tlsconf: unknown TLS version %s", name)
+		}
+		r.base.MinVersion = version
+	}
+
+	if names, _ := c.GetString(section, optCiphers); names != "" {
+		ciphers, err := CipherSuites(strings.Split(names, ","))
+		if err != nil {
+			return nil, err
+		}
+		r.base.CipherSuites = ciphers
+	}
+
+	r.caFile, _ = c.GetString(section, optClientCA)
+	if r.caFile != "" {
+		r.base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if name, _ := c.GetString(section, optClientAuth); name != "" {
+		auth, ok := clientAuths[name]
+		if !ok {
+			return nil, fmt.Errorf("tlsconf: unknown client auth %s", name)
+		}
+		if auth != tls.NoClientCert && r.caFile == "" {
+			return nil, fmt.Errorf("tlsconf: %s needs %s", optClientAuth, optClientCA)
+		}
+		r.base.ClientAuth = auth
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CipherSuites maps IANA suite names to their ids, insecure suites are refused.
+func CipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("tlsconf: unknown or insecure cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Reload reads the certificate, its key and the client CA bundle again.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tlsconf: %v", err)
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		bundle, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("tlsconf: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return ErrNoClientCerts
+		}
+	}
+	r.Lock()
+	r.cert, r.clientCAs = &cert, pool
+	r.Unlock()
+	return nil
+}
+
+// Config is handed to the listener, every handshake picks what was loaded last.
+func (r *Reloader) Config() *tls.Config {
+	config := r.base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return r.current(), nil
+	}
+	return config
+}
+
+func (r *Reloader) current() *tls.Config {
+	r.RLock()
+	defer r.RUnlock()
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{*r.cert}
+	config.ClientCAs = r.clientCAs
+	return config
+}
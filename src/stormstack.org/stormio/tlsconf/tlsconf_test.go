@@ -0,0 +1,156 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"math/big"
+	"net"
+	"path/filepath"
+	"stormstack.org/stormio/conf"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type TLSSuite struct {
+	dir string
+}
+
+var _ = Suite(&TLSSuite{})
+
+func (s *TLSSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+// Writes a self signed certificate and its key, returns the pair
+func (s *TLSSuite) writeCert(c *C, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, name+".crt"), certPEM, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, name+".key"), keyPEM, 0600), IsNil)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	c.Assert(err, IsNil)
+	return pair
+}
+
+func (s *TLSSuite) load(c *C, options string) (*Reloader, error) {
+	cfg, err := conf.ReadConfigBytes([]byte("[server]\nport=9080\n" + options))
+	c.Assert(err, IsNil)
+	return Load(cfg, "server")
+}
+
+// Handshakes over a pipe, returns the server certificate seen by the client
+func handshake(c *C, server *tls.Config, client *tls.Config) (*x509.Certificate, error) {
+	sconn, cconn := net.Pipe()
+	go func() {
+		tc := tls.Server(sconn, server)
+		if tc.Handshake() == nil {
+			io.Copy(ioutil.Discard, tc)
+		}
+		sconn.Close()
+	}()
+	tc := tls.Client(cconn, client)
+	defer tc.Close()
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	// a rejected client certificate is only reported on the first read
+	tc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := tc.Read(make([]byte, 1)); err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+	}
+	return tc.ConnectionState().PeerCertificates[0], nil
+}
+
+func (s *TLSSuite) TestDisabled(c *C) {
+	r, err := s.load(c, "")
+	c.Assert(err, IsNil)
+	c.Assert(r, IsNil)
+}
+
+func (s *TLSSuite) TestOptions(c *C) {
+	s.writeCert(c, "server")
+	_, err := s.load(c, "tls-cert="+s.dir+"/server.crt\n")
+	c.Assert(err, Equals, ErrNoKey)
+	_, err = s.load(c, "tls-cert="+s.dir+"/server.crt\ntls-key="+s.dir+"/server.key\ntls-min-version=0.9\n")
+	c.Assert(err, ErrorMatches, ".*unknown TLS version 0.9")
+	_, err = s.load(c, "tls-cert="+s.dir+"/server.crt\ntls-key="+s.dir+"/server.key\ntls-ciphers=TLS_RSA_WITH_RC4_128_SHA\n")
+	c.Assert(err, ErrorMatches, ".*insecure cipher suite TLS_RSA_WITH_RC4_128_SHA")
+	_, err = s.load(c, "tls-cert="+s.dir+"/server.crt\ntls-key="+s.dir+"/server.key\ntls-client-auth=require\n")
+	c.Assert(err, ErrorMatches, ".*tls-client-auth needs tls-client-ca")
+
+	r, err := s.load(c, "tls-cert="+s.dir+"/server.crt\ntls-key="+s.dir+"/server.key\n"+
+		"tls-min-version=1.3\ntls-ciphers=TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256\n")
+	c.Assert(err, IsNil)
+	config := r.Config()
+	c.Assert(config.MinVersion, Equals, uint16(tls.VersionTLS13))
+	c.Assert(config.CipherSuites, DeepEquals, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256})
+	c.Assert(config.ClientAuth, Equals, tls.NoClientCert)
+}
+
+func (s *TLSSuite) TestReload(c *C) {
+	s.writeCert(c, "server")
+	r, err := s.load(c, "tls-cert="+s.dir+"/server.crt\ntls-key="+s.dir+"/server.key\n")
+	c.Assert(err, IsNil)
+	client := &tls.Config{InsecureSkipVerify: true}
+	cert, err := handshake(c, r.Config(), client)
+	c.Assert(err, IsNil)
+	c.Assert(cert.Subject.CommonName, Equals, "server")
+
+	// the renewed pair is written in place
+	renewed := s.writeCert(c, "renewed")
+	certPEM, _ := ioutil.ReadFile(s.dir + "/renewed.crt")
+	keyPEM, _ := ioutil.ReadFile(s.dir + "/renewed.key")
+	c.Assert(ioutil.WriteFile(s.dir+"/server.crt", certPEM, 0600), IsNil)
+	c.Assert(r.Reload(), ErrorMatches, ".*private key does not match public key")
+	c.Assert(ioutil.WriteFile(s.dir+"/server.key", keyPEM, 0600), IsNil)
+	c.Assert(r.Reload(), IsNil)
+
+	cert, err = handshake(c, r.Config(), client)
+	c.Assert(err, IsNil)
+	c.Assert(cert.Raw, DeepEquals, renewed.Certificate[0])
+}
+
+func (s *TLSSuite) TestClientCertificate(c *C) {
+	s.writeCert(c, "server")
+	vertex := s.writeCert(c, "vertex")
+	stranger := s.writeCert(c, "stranger")
+	r, err := s.load(c, "tls-cert="+s.dir+"/server.crt\ntls-key="+s.dir+"/server.key\ntls-client-ca="+s.dir+"/vertex.crt\n")
+	c.Assert(err, IsNil)
+
+	_, err = handshake(c, r.Config(), &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, NotNil)
+	_, err = handshake(c, r.Config(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{stranger}})
+	c.Assert(err, NotNil)
+	_, err = handshake(c, r.Config(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{vertex}})
+	c.Assert(err, IsNil)
+}
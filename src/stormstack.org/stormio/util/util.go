@@ -140,6 +140,24 @@ func GetInt(catag, key string) int {
 	return val
 }
 
+// GetBoolDefault is GetBool for optional keys
+func GetBoolDefault(catag, key string, def bool) bool {
+	val, err := Config.GetBool(catag, key)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+// GetIntDefault is GetInt for optional keys
+func GetIntDefault(catag, key string, def int) int {
+	val, err := Config.GetInt(catag, key)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
 func GetString(catag, key string) string {
 	val, err := Config.GetString(catag, key)
 	if err != nil {